@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"github.com/miekg/dns"
 	"log"
 	"net/http"
@@ -17,20 +18,32 @@ type AdBlocker interface {
 }
 
 func NewAdBlockerHTTP(resolvers []*ServerConfig, filterURL string) AdBlocker {
+	filter, err := LoadAdBlockerHTTP(resolvers, filterURL)
+	if err != nil {
+		log.Panicf("Unable to load the ad blocker: %v", err)
+	}
+	return filter
+}
+
+// LoadAdBlockerHTTP works like NewAdBlockerHTTP, but returns the error
+// instead of panicking, e.g. when reloading the config.
+func LoadAdBlockerHTTP(resolvers []*ServerConfig, filterURL string) (
+	AdBlocker, error) {
 	if len(resolvers) == 0 {
-		log.Panicf("Bootstrap resolvers are empty: %v", resolvers)
+		return nil, fmt.Errorf("bootstrap resolvers are empty: %v",
+			resolvers)
 	}
 	for _, r := range resolvers {
 		if r == nil {
-			log.Panicf("Bootstrap resolvers supplied as nil: %v", resolvers)
+			return nil, fmt.Errorf("bootstrap resolvers supplied as nil: %v",
+				resolvers)
 		}
 	}
 	clients := make([]*http.Client, len(resolvers))
 	for i := 0; i < len(resolvers); i++ {
-		clients[i] = NewHTTPSClient(resolvers[i].String())
+		clients[i] = NewHTTPSClient(resolvers[i])
 	}
-	filter := NewABTreeFilter(FetchFilterByURL(clients, filterURL))
-	return filter
+	return LoadABTreeFilter(FetchFilterByURL(clients, filterURL))
 }
 
 // ABTreeFilter is an ABFilter implemented with tree of nodes.
@@ -81,17 +94,45 @@ func NewABTreeFilter(fetchFilter func() (string, error)) AdBlocker {
 	if ferr != nil {
 		log.Panicf("Unable to fetch the initial ABP filter string: %v", ferr)
 	}
-	domains, perr := ParseABPList(abpFilter)
+	f, perr := newABTreeFilterFromString(fetchFilter, abpFilter)
 	if perr != nil {
 		return nil
 	}
+	return f
+}
+
+// LoadABTreeFilter works like NewABTreeFilter, but returns the error instead
+// of panicking.
+func LoadABTreeFilter(fetchFilter func() (string, error)) (AdBlocker, error) {
+	if fetchFilter == nil {
+		return nil, fmt.Errorf("%w: LoadABTreeFilter()", NilArgumentError)
+	}
+	abpFilter, ferr := fetchFilter()
+	if ferr != nil {
+		return nil, fmt.Errorf("unable to fetch the ABP filter string: %w",
+			ferr)
+	}
+	f, perr := newABTreeFilterFromString(fetchFilter, abpFilter)
+	if perr != nil {
+		return nil, perr
+	}
+	return f, nil
+}
+
+func newABTreeFilterFromString(fetchFilter func() (string, error),
+	abpFilter string) (*ABTreeFilter, error) {
+	domains, perr := ParseABPList(abpFilter)
+	if perr != nil {
+		return nil, perr
+	}
 	f := &ABTreeFilter{
-		rootNode:   NewABTreeFilterNode(),
-		filterHash: HashString(abpFilter),
-		lastUpdate: time.Now(),
+		rootNode:    NewABTreeFilterNode(),
+		fetchFilter: fetchFilter,
+		filterHash:  HashString(abpFilter),
+		lastUpdate:  time.Now(),
 	}
 	f.rootNode.InsertBlockedDomains(domains)
-	return f
+	return f, nil
 }
 
 func UpdateABTreeFilter(f *ABTreeFilter) error {
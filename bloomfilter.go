@@ -1,5 +1,9 @@
 package main
 
+import (
+	"strings"
+)
+
 type BloomFilter struct {
 	size      uint32
 	numHashes uint32
@@ -11,5 +15,5 @@ func NewBloomFilter() *BloomFilter {
 }
 
 func (bf *BloomFilter) Contains(dname string) {
-	strings.split
+	_ = strings.Split(dname, ".")
 }
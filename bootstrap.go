@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"time"
+)
+
+// Seconds to keep the resolved addresses of an upstream host name at least,
+// and to wait before retrying a failed resolution
+const MinBootstrapTTL = 30
+const BootstrapRetryInterval = 30
+
+// Bootstrapper resolves the host names of the upstream servers through the
+// bootstrap servers, which are given by their addresses.
+type Bootstrapper struct {
+	clients []DNSClient
+	names   []string
+}
+
+func NewBootstrapper(servers []*ServerConfig) *Bootstrapper {
+	b := &Bootstrapper{
+		clients: make([]DNSClient, len(servers)),
+		names:   make([]string, len(servers)),
+	}
+	for i, s := range servers {
+		b.clients[i] = NewDNSClient(s)
+		b.names[i] = s.String()
+	}
+	return b
+}
+
+// Resolve returns the IPv4 and IPv6 addresses of the host, and how long
+// they can be used for. The bootstrap servers are asked in turn until one
+// of them answers.
+func (b *Bootstrapper) Resolve(ctx context.Context, host string) ([]net.IP,
+	time.Duration, error) {
+	err := errors.New("no bootstrap server")
+	for i, c := range b.clients {
+		var ips []net.IP
+		var ttl uint32
+		ips, ttl, err = resolveAddrsWith(ctx, c, host)
+		if err == nil {
+			if ttl < MinBootstrapTTL {
+				ttl = MinBootstrapTTL
+			}
+			return ips, time.Duration(ttl) * time.Second, nil
+		}
+		err = fmt.Errorf("%s: %w", b.names[i], err)
+	}
+	return nil, 0, fmt.Errorf("unable to resolve %s: %w", host, err)
+}
+
+// DialContext connects to the address with the dialer, trying each of the
+// addresses of its host in turn if it is given by its host name.
+func (b *Bootstrapper) DialContext(ctx context.Context, dialer ContextDialer,
+	network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return dialer.DialContext(ctx, network, addr)
+	}
+	ips, _, err := b.Resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = dialer.DialContext(ctx, network,
+			net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// Close closes the clients of the bootstrap servers.
+func (b *Bootstrapper) Close() {
+	for _, c := range b.clients {
+		closeClient(c)
+	}
+}
+
+// resolveAddrsWith queries the A and AAAA records of the host, and returns
+// the addresses with their smallest TTL.
+func resolveAddrsWith(ctx context.Context, c DNSClient, host string) (
+	[]net.IP, uint32, error) {
+	ips := make([]net.IP, 0)
+	var minTTL uint32 = DefaultMaxTTL
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		req := new(dns.Msg)
+		req.SetQuestion(dns.Fqdn(host), qtype)
+		resp, err := c.ExchangeContext(ctx, req)
+		if err != nil {
+			return nil, 0, err
+		}
+		if resp.Rcode != dns.RcodeSuccess {
+			return nil, 0, fmt.Errorf("%s for %s",
+				dns.RcodeToString[resp.Rcode], req.Question[0].String())
+		}
+		for _, rr := range resp.Answer {
+			ip := rrAddr(rr)
+			if ip == nil {
+				continue
+			}
+			ips = append(ips, ip)
+			if rr.Header().Ttl < minTTL {
+				minTTL = rr.Header().Ttl
+			}
+		}
+	}
+	if len(ips) == 0 {
+		return nil, 0, fmt.Errorf("no address for %s", host)
+	}
+	return ips, minTTL, nil
+}
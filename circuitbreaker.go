@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"log"
+	"sync"
+	"time"
+)
+
+const DefaultBreakerFailThreshold = 5
+const DefaultBreakerCoolDown = 5
+const DefaultBreakerMaxCoolDown = 300
+
+// States of a circuit breaker
+const (
+	// queries are sent to the upstream
+	CircuitClosed = "closed"
+	// queries fail right away until the cool-down is over
+	CircuitOpen = "open"
+	// a single trial query is sent to decide whether to close the circuit
+	CircuitHalfOpen = "half-open"
+)
+
+// CircuitBreaker is a DNSClient cutting off an upstream that fails on real
+// traffic. After consecutive failures or SERVFAILs, the circuit is opened,
+// and the queries fail right away for a cool-down. Then a single trial
+// query is let through: the circuit is closed if it succeeds, or opened
+// again for twice the cool-down if it fails.
+type CircuitBreaker struct {
+	client      DNSClient
+	name        string
+	threshold   int
+	minCoolDown time.Duration
+	maxCoolDown time.Duration
+	state       string
+	failures    int
+	coolDown    time.Duration
+	openUntil   time.Time
+	trialSent   bool
+	now         func() time.Time
+	sync.Mutex
+}
+
+// NewCircuitBreaker wraps the client of the named upstream in a circuit
+// breaker, or returns the client as is if the breaker is disabled.
+func NewCircuitBreaker(client DNSClient, name string,
+	cfg *CircuitBreakerConfig) DNSClient {
+	if cfg == nil || cfg.FailThreshold < 0 {
+		return client
+	}
+	return &CircuitBreaker{
+		client:      client,
+		name:        name,
+		threshold:   cfg.FailThreshold,
+		minCoolDown: time.Duration(cfg.CoolDown) * time.Second,
+		maxCoolDown: time.Duration(cfg.MaxCoolDown) * time.Second,
+		state:       CircuitClosed,
+		coolDown:    time.Duration(cfg.CoolDown) * time.Second,
+		now:         time.Now,
+	}
+}
+
+func (cb *CircuitBreaker) ExchangeContext(ctx context.Context,
+	msg *dns.Msg) (*dns.Msg, error) {
+	if cb == nil {
+		return nil, fmt.Errorf(
+			"attempted to use uninitialized DNS client")
+	}
+	if err := cb.allow(); err != nil {
+		return nil, err
+	}
+	resp, err := cb.client.ExchangeContext(ctx, msg)
+	switch {
+	case err != nil && errors.Is(err, context.Canceled):
+		cb.release()
+	case err != nil:
+		cb.reportFailure(err)
+	case resp != nil && resp.Rcode == dns.RcodeServerFailure:
+		cb.reportFailure(errors.New("server failure"))
+	default:
+		cb.reportSuccess()
+	}
+	return resp, err
+}
+
+// allow checks if a query may be sent, half-opening the circuit once the
+// cool-down is over.
+func (cb *CircuitBreaker) allow() error {
+	cb.Lock()
+	defer cb.Unlock()
+	switch cb.state {
+	case CircuitOpen:
+		if cb.now().Before(cb.openUntil) {
+			return fmt.Errorf("%w: %s", CircuitOpenError, cb.name)
+		}
+		cb.state = CircuitHalfOpen
+		log.Printf("Circuit of upstream %s is half-open, sending a trial "+
+			"query", cb.name)
+	case CircuitHalfOpen:
+		if cb.trialSent {
+			return fmt.Errorf("%w: %s", CircuitOpenError, cb.name)
+		}
+	default:
+		return nil
+	}
+	cb.trialSent = true
+	return nil
+}
+
+// release lets another query be the trial, if the caller cancelled this one.
+func (cb *CircuitBreaker) release() {
+	cb.Lock()
+	defer cb.Unlock()
+	cb.trialSent = false
+}
+
+func (cb *CircuitBreaker) reportFailure(err error) {
+	cb.Lock()
+	defer cb.Unlock()
+	cb.failures++
+	switch cb.state {
+	case CircuitHalfOpen:
+		cb.coolDown *= 2
+		if cb.coolDown > cb.maxCoolDown {
+			cb.coolDown = cb.maxCoolDown
+		}
+	case CircuitClosed:
+		if cb.failures < cb.threshold {
+			return
+		}
+	default:
+		return
+	}
+	cb.state = CircuitOpen
+	cb.trialSent = false
+	cb.openUntil = cb.now().Add(cb.coolDown)
+	log.Printf("Circuit of upstream %s is open for %s after %d failures: %s",
+		cb.name, cb.coolDown, cb.failures, err.Error())
+}
+
+func (cb *CircuitBreaker) reportSuccess() {
+	cb.Lock()
+	defer cb.Unlock()
+	cb.failures = 0
+	if cb.state == CircuitClosed {
+		return
+	}
+	cb.state = CircuitClosed
+	cb.trialSent = false
+	cb.coolDown = cb.minCoolDown
+	log.Printf("Circuit of upstream %s is closed", cb.name)
+}
+
+// State returns the state of the circuit. An open circuit whose cool-down
+// is over is reported half-open, as the next query is let through.
+func (cb *CircuitBreaker) State() string {
+	cb.Lock()
+	defer cb.Unlock()
+	if cb.state == CircuitOpen && !cb.now().Before(cb.openUntil) {
+		return CircuitHalfOpen
+	}
+	return cb.state
+}
+
+// Close closes the connections of the wrapped client.
+func (cb *CircuitBreaker) Close() error {
+	closeClient(cb.client)
+	return nil
+}
+
+// NumSpoofed returns the number of responses the wrapped client dropped as
+// suspected spoofing.
+func (cb *CircuitBreaker) NumSpoofed() int64 {
+	return NumSpoofed(cb.client)
+}
+
+// CircuitState returns the state of the circuit breaker of the client, or
+// closed if it has none.
+func CircuitState(c DNSClient) string {
+	if cb, ok := c.(*CircuitBreaker); ok {
+		return cb.State()
+	}
+	return CircuitClosed
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/miekg/dns"
+	"testing"
+	"time"
+)
+
+// Outcomes of the queries to breakerTestClient
+const (
+	breakerOK       = "ok"
+	breakerFail     = "fail"
+	breakerServFail = "servfail"
+	breakerCancel   = "cancel"
+)
+
+// breakerTestClient answers the queries with the outcome it is set to, or
+// blocks until release is closed if it is set.
+type breakerTestClient struct {
+	outcome string
+	release chan struct{}
+	calls   int
+}
+
+func (c *breakerTestClient) ExchangeContext(ctx context.Context,
+	req *dns.Msg) (*dns.Msg, error) {
+	c.calls++
+	if c.release != nil {
+		<-c.release
+	}
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	switch c.outcome {
+	case breakerFail:
+		return nil, errors.New("connection refused")
+	case breakerServFail:
+		resp.Rcode = dns.RcodeServerFailure
+	case breakerCancel:
+		return nil, context.Canceled
+	}
+	return resp, nil
+}
+
+func newTestBreaker(client DNSClient) (*CircuitBreaker, *time.Time) {
+	cb := NewCircuitBreaker(client, "test", &CircuitBreakerConfig{
+		FailThreshold: 3,
+		CoolDown:      5,
+		MaxCoolDown:   20,
+	}).(*CircuitBreaker)
+	now := time.Now()
+	cb.now = func() time.Time { return now }
+	return cb, &now
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	type step struct {
+		// the time passed since the start
+		at      time.Duration
+		outcome string
+		// whether the query fails right away, without reaching the client
+		rejected bool
+		// the state after the query
+		state string
+	}
+	failures := func(at time.Duration, n int) []step {
+		steps := make([]step, n)
+		for i := range steps {
+			steps[i] = step{at: at, outcome: breakerFail,
+				state: CircuitClosed}
+		}
+		steps[n-1].state = CircuitOpen
+		return steps
+	}
+	s := time.Second
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{name: "opened after consecutive failures",
+			steps: append(failures(0, 3),
+				step{at: 4 * s, rejected: true, state: CircuitOpen})},
+		{name: "failures counted again after a success",
+			steps: []step{
+				{outcome: breakerFail, state: CircuitClosed},
+				{outcome: breakerFail, state: CircuitClosed},
+				{outcome: breakerOK, state: CircuitClosed},
+				{outcome: breakerFail, state: CircuitClosed},
+				{outcome: breakerFail, state: CircuitClosed},
+			}},
+		{name: "opened after SERVFAILs",
+			steps: []step{
+				{outcome: breakerServFail, state: CircuitClosed},
+				{outcome: breakerServFail, state: CircuitClosed},
+				{outcome: breakerServFail, state: CircuitOpen},
+			}},
+		{name: "closed by a successful trial",
+			steps: append(failures(0, 3),
+				step{at: 5 * s, outcome: breakerOK, state: CircuitClosed},
+				step{at: 5 * s, outcome: breakerFail,
+					state: CircuitClosed})},
+		{name: "cool-down doubled by a failed trial",
+			steps: append(failures(0, 3),
+				step{at: 5 * s, outcome: breakerFail, state: CircuitOpen},
+				step{at: 14 * s, rejected: true, state: CircuitOpen},
+				step{at: 15 * s, outcome: breakerOK, state: CircuitClosed})},
+		{name: "cool-down reset once closed",
+			steps: append(append(failures(0, 3),
+				step{at: 5 * s, outcome: breakerFail, state: CircuitOpen},
+				step{at: 15 * s, outcome: breakerOK, state: CircuitClosed}),
+				append(failures(15*s, 3),
+					step{at: 20 * s, outcome: breakerOK,
+						state: CircuitClosed})...)},
+		{name: "cool-down capped",
+			steps: append(failures(0, 3),
+				// open for 10s, 20s, and then 20s again
+				step{at: 5 * s, outcome: breakerFail, state: CircuitOpen},
+				step{at: 15 * s, outcome: breakerFail, state: CircuitOpen},
+				step{at: 35 * s, outcome: breakerFail, state: CircuitOpen},
+				step{at: 54 * s, rejected: true, state: CircuitOpen},
+				step{at: 55 * s, outcome: breakerOK, state: CircuitClosed})},
+		{name: "trial released on cancel",
+			steps: append(failures(0, 3),
+				step{at: 5 * s, outcome: breakerCancel,
+					state: CircuitHalfOpen},
+				step{at: 5 * s, outcome: breakerOK, state: CircuitClosed})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &breakerTestClient{}
+			cb, now := newTestBreaker(client)
+			start := *now
+			req := new(dns.Msg)
+			req.SetQuestion("example.", dns.TypeA)
+			for i, st := range tt.steps {
+				*now = start.Add(st.at)
+				client.outcome = st.outcome
+				calls := client.calls
+				_, err := cb.ExchangeContext(context.Background(), req)
+				rejected := errors.Is(err, CircuitOpenError)
+				if rejected != st.rejected ||
+					(client.calls == calls) != st.rejected {
+					t.Fatalf("query %d at %s: got the error %v", i, st.at,
+						err)
+				}
+				if state := cb.State(); state != st.state {
+					t.Fatalf("query %d at %s: got the state %s, want %s",
+						i, st.at, state, st.state)
+				}
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerSingleTrial(t *testing.T) {
+	client := &breakerTestClient{outcome: breakerFail}
+	cb, now := newTestBreaker(client)
+	req := new(dns.Msg)
+	req.SetQuestion("example.", dns.TypeA)
+	for i := 0; i < 3; i++ {
+		_, _ = cb.ExchangeContext(context.Background(), req)
+	}
+	*now = now.Add(5 * time.Second)
+	// the trial query is held by the upstream
+	client.outcome = breakerOK
+	client.release = make(chan struct{})
+	done := make(chan error)
+	go func() {
+		_, err := cb.ExchangeContext(context.Background(), req)
+		done <- err
+	}()
+	for cb.State() != CircuitHalfOpen || !cb.trialInFlight() {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := cb.ExchangeContext(context.Background(),
+		req); !errors.Is(err, CircuitOpenError) {
+		t.Errorf("got the error %v during the trial, want %v", err,
+			CircuitOpenError)
+	}
+	close(client.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if state := cb.State(); state != CircuitClosed {
+		t.Errorf("got the state %s after the trial, want %s", state,
+			CircuitClosed)
+	}
+}
+
+func (cb *CircuitBreaker) trialInFlight() bool {
+	cb.Lock()
+	defer cb.Unlock()
+	return cb.trialSent
+}
@@ -1,8 +1,9 @@
 package main
 
 import (
+	"bytes"
 	"context"
-	"crypto/tls"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"github.com/miekg/dns"
@@ -10,7 +11,7 @@ import (
 	"log"
 	"net"
 	"net/http"
-	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,26 +20,30 @@ const (
 	UDPProto     = "udp"
 	TCPProto     = "tcp"
 	TLSProto     = "tcp-tls"
+	HTTPSProto   = "https"
+	QUICProto    = "quic"
+	// the upstream of the recursion mode, set up from RecursionConfig
+	RecursiveProto = "recursive"
 )
-const TCPTimeoutMillis = 1000
-const TCPBackOffMillis = 10
-const TCPMaxRetry = 3
 
+// the port an opportunistic upstream falls back to
+const CleartextDNSPort = 53
+
+// DNSClient sends queries to an upstream server. ExchangeContext gives up
+// once the context is done, whether the deadline passed or the query was
+// cancelled.
 type DNSClient interface {
-	Exchange(*dns.Msg) (*dns.Msg, error)
+	ExchangeContext(context.Context, *dns.Msg) (*dns.Msg, error)
 }
 
+// UDPClient is a DNSClient querying a server over UDP. Responses whose
+// question differs from the query are dropped as suspected spoofing. With
+// case randomization, the question name is sent in 0x20 mixed case, and the
+// response has to echo the exact casing.
 type UDPClient struct {
-	client     *dns.Client
-	serverAddr string
-}
-
-type TCPClient struct {
-	client     *dns.Client
-	conn       *dns.Conn
-	tlsCfg     *tls.Config
-	serverAddr string
-	sync.Mutex
+	serverAddr    string
+	randomizeCase bool
+	numSpoofed    atomic.Int64
 }
 
 type DefaultClient struct {
@@ -46,38 +51,12 @@ type DefaultClient struct {
 	tcpClient DNSClient
 }
 
-// DNSClientPool represents a pool of clients, each querying a different
-// upstream DNS server.
-type DNSClientPool struct {
-	clients []DNSClient
-	C       <-chan DNSClient
-}
-
-// NewDNSClientPool creates a pool of clients
-func NewDNSClientPool(servers []*ServerConfig) *DNSClientPool {
-	pool := make(chan DNSClient, 0)
-	cp := &DNSClientPool{
-		C: pool,
-	}
-	if len(servers) == 0 {
-		close(pool)
-		return cp
-	}
-	cp.clients = make([]DNSClient, len(servers))
-	for i := 0; i < len(servers); i++ {
-		cp.clients[i] = NewDNSClient(servers[i])
-	}
-	go func() {
-		i := 0
-		for {
-			if i >= len(cp.clients) {
-				i = 0
-			}
-			pool <- cp.clients[i]
-			i += 1
-		}
-	}()
-	return cp
+// OpportunisticClient queries an encrypted upstream in the opportunistic
+// privacy profile (RFC 8310 Section 5), falling back to cleartext DNS on
+// port 53 when no encrypted connection can be made to the server.
+type OpportunisticClient struct {
+	encrypted DNSClient
+	cleartext DNSClient
 }
 
 func NewDNSClient(server *ServerConfig) DNSClient {
@@ -87,174 +66,226 @@ func NewDNSClient(server *ServerConfig) DNSClient {
 	var rv DNSClient
 	switch server.Proto {
 	case DefaultProto:
-		rv = NewDefaultClient(server.String())
+		rv = NewEDNSClient(NewDefaultClient(server), server)
 	case UDPProto:
-		rv = NewUDPClient(server.String())
+		rv = NewEDNSClient(NewUDPClient(server), server)
 	case TCPProto:
-		rv = NewTCPClient(server.String(), false)
+		rv = NewTCPClient(server, false)
 	case TLSProto:
-		rv = NewTCPClient(server.String(), true)
+		rv = NewTCPClient(server, true)
+	case HTTPSProto:
+		rv = NewDoHClient(server)
+	case QUICProto:
+		rv = NewDoQClient(server)
+	case RecursiveProto:
+		rv = server.Recursion.Resolver()
 	default:
 		log.Panicf("invalid protocol %s; this should not happen", server.Proto)
 	}
+	// the strict profile never falls back to cleartext
+	if server.PrivacyProfile == OpportunisticPrivacy && server.IP != nil &&
+		server.Proto != HTTPSProto {
+		rv = NewOpportunisticClient(rv, server)
+	}
 	return rv
 }
 
-func NewDefaultClient(serverAddr string) DNSClient {
-	uc := NewUDPClient(serverAddr)
-	tc := NewTCPClient(serverAddr, false)
+func NewOpportunisticClient(encrypted DNSClient,
+	server *ServerConfig) DNSClient {
+	cleartext := &ServerConfig{
+		IP:             server.IP,
+		Port:           CleartextDNSPort,
+		Proto:          DefaultProto,
+		MaxConns:       server.MaxConns,
+		IdleTimeout:    server.IdleTimeout,
+		EDNSBufferSize: server.EDNSBufferSize,
+		proxyDialer:    server.proxyDialer,
+	}
+	// a proxied upstream falls back to TCP through the same proxy
+	if server.proxyDialer != nil {
+		cleartext.Proto = TCPProto
+	}
+	return &OpportunisticClient{
+		encrypted: encrypted,
+		cleartext: NewDNSClient(cleartext),
+	}
+}
+
+func NewDefaultClient(server *ServerConfig) DNSClient {
+	uc := NewUDPClient(server)
+	tc := NewTCPClient(server, false)
 	return &DefaultClient{
 		udpClient: uc,
 		tcpClient: tc,
 	}
 }
 
-func NewUDPClient(serverAddr string) DNSClient {
+func NewUDPClient(server *ServerConfig) DNSClient {
 	return &UDPClient{
-		client:     new(dns.Client),
-		serverAddr: serverAddr,
-	}
-}
-
-func NewTCPClient(serverAddr string, useTLS bool) DNSClient {
-	dc := new(dns.Client)
-	dc.Net = TCPProto
-	var tlsCfg *tls.Config
-	if useTLS {
-		tlsCfg = &(tls.Config{})
-	}
-	tc := TCPClient{
-		client:     dc,
-		conn:       nil,
-		tlsCfg:     tlsCfg,
-		serverAddr: serverAddr,
+		serverAddr:    server.String(),
+		randomizeCase: server.CaseRandomization,
 	}
-	return &tc
 }
 
-func (c *DefaultClient) Exchange(msg *dns.Msg) (*dns.Msg, error) {
+func (c *DefaultClient) ExchangeContext(ctx context.Context,
+	msg *dns.Msg) (*dns.Msg, error) {
 	if c == nil {
 		return nil, fmt.Errorf(
 			"attempted to use uninitialized DNS client")
 	}
-	resp, err := c.udpClient.Exchange(msg)
+	resp, err := c.udpClient.ExchangeContext(ctx, msg)
 	if err != nil {
 		return nil, err
 	}
 	if resp.Truncated {
-		return c.tcpClient.Exchange(msg)
+		return c.tcpClient.ExchangeContext(ctx, msg)
 	}
 	return resp, nil
 }
 
-func (c *UDPClient) Exchange(msg *dns.Msg) (*dns.Msg, error) {
+// NumSpoofed returns the number of responses dropped as suspected spoofing.
+func (c *DefaultClient) NumSpoofed() int64 {
+	if c == nil {
+		return 0
+	}
+	return NumSpoofed(c.udpClient)
+}
+
+// Close closes the TCP connections of the client.
+func (c *DefaultClient) Close() error {
+	if closer, ok := c.tcpClient.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (c *OpportunisticClient) ExchangeContext(ctx context.Context,
+	msg *dns.Msg) (*dns.Msg, error) {
 	if c == nil {
 		return nil, fmt.Errorf(
 			"attempted to use uninitialized DNS client")
 	}
-	resp, _, err := c.client.Exchange(msg, c.serverAddr)
+	resp, err := c.encrypted.ExchangeContext(ctx, msg)
+	if err != nil && errors.Is(err, ConnectionError) && ctx.Err() == nil {
+		log.Printf("Falling back to cleartext DNS: %s", err.Error())
+		return c.cleartext.ExchangeContext(ctx, msg)
+	}
 	return resp, err
 }
 
-func (tc *TCPClient) Exchange(req *dns.Msg) (*dns.Msg, error) {
-	if tc == nil {
+// Close closes the connections of both the encrypted and the cleartext
+// clients.
+func (c *OpportunisticClient) Close() error {
+	closeClient(c.encrypted)
+	closeClient(c.cleartext)
+	return nil
+}
+
+func (c *UDPClient) ExchangeContext(ctx context.Context,
+	msg *dns.Msg) (*dns.Msg, error) {
+	if c == nil {
 		return nil, fmt.Errorf(
 			"attempted to use uninitialized DNS client")
 	}
-	var resp *dns.Msg
-	var err error
-	tc.Lock()
-	defer tc.Unlock()
-	if tc.conn == nil {
-		tc.conn, err = tc.CreateConn()
-		if err != nil {
-			return nil, err
-		}
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
-	resp, _, err = tc.client.ExchangeWithConn(req, tc.conn)
-	// retry with new connection if connection closed
-	if err == nil && resp != nil {
-		return resp, nil
-	}
-	backoff := time.Duration(TCPBackOffMillis) * time.Millisecond
-	for i := 0; i < TCPMaxRetry; i++ {
-		_ = tc.conn.Close()
-		tc.conn = nil
-		time.Sleep(backoff)
-		backoff *= 2
-		tc.conn, err = tc.CreateConn()
-		if err != nil {
-			return nil, err
-		}
-		resp, _, err = tc.client.ExchangeWithConn(req, tc.conn)
-		if err == nil && resp != nil {
-			return resp, nil
-		}
+	query := msg
+	if c.randomizeCase && len(msg.Question) == 1 {
+		query = msg.Copy()
+		query.Question[0].Name = RandomizeCase(msg.Question[0].Name)
 	}
+	client := &dns.Client{Net: UDPProto}
+	conn, err := client.DialContext(ctx, c.serverAddr)
 	if err != nil {
 		return nil, err
 	}
-	if resp == nil {
-		return nil, errors.New("connection failed")
+	defer func() {
+		_ = conn.Close()
+	}()
+	// unblock the read as soon as the query is cancelled
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	defer stop()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(DefaultQueryTimeout * time.Millisecond)
 	}
-	return resp, nil
-}
-
-func (tc *TCPClient) GetOrCreateConn() (*dns.Conn, error) {
-	tc.Lock()
-	defer tc.Unlock()
-	if tc.conn != nil {
-		if IsConnAlive(tc.conn) {
-			return tc.conn, nil
-		}
-		_ = tc.conn.Close()
-		tc.conn = nil
+	_ = conn.SetDeadline(deadline)
+	if opt := query.IsEdns0(); opt != nil {
+		conn.UDPSize = opt.UDPSize()
+	}
+	resp, err := c.exchange(conn, query)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
 	}
-	conn, err := tc.CreateConn()
 	if err != nil {
 		return nil, err
 	}
-	tc.conn = conn
-	return tc.conn, nil
-}
-
-func (tc *TCPClient) CreateConn() (*dns.Conn, error) {
-	timeout := TCPTimeoutMillis * time.Millisecond
-	if tc.tlsCfg != nil {
-		return dns.DialTimeoutWithTLS("tcp-tls", tc.serverAddr,
-			tc.tlsCfg, timeout)
+	if query != msg {
+		RestoreCase(resp, msg.Question[0].Name)
 	}
-	return dns.DialTimeout("tcp", tc.serverAddr, timeout)
+	return resp, nil
 }
 
-// IsConnAlive checks if a TCP connection is kept alive.
-func IsConnAlive(conn *dns.Conn) bool {
-	if conn == nil {
-		return false
-	}
-	oneByte := make([]byte, 1)
-	if err := conn.SetReadDeadline(time.Now()); err != nil {
-		return false
+// exchange sends the query, and reads until the response to it arrives.
+// Responses with the query ID but another question are dropped and counted
+// (RFC 5452 Section 9.1).
+func (c *UDPClient) exchange(conn *dns.Conn, query *dns.Msg) (*dns.Msg,
+	error) {
+	if err := conn.WriteMsg(query); err != nil {
+		return nil, err
 	}
-	if _, err := conn.Read(oneByte); err == io.EOF {
-		return false
+	for {
+		resp, err := conn.ReadMsg()
+		if err != nil {
+			return nil, err
+		}
+		if resp.Id != query.Id {
+			continue
+		}
+		if len(query.Question) == 0 || (len(resp.Question) == 1 &&
+			c.isEchoed(query.Question[0], resp.Question[0])) {
+			return resp, nil
+		}
+		c.numSpoofed.Add(1)
+		log.Printf("Dropped a suspected spoofed response from %s for %s",
+			c.serverAddr, query.Question[0].String())
 	}
-	if err := conn.SetReadDeadline(time.Time{}); err != nil {
-		return false
+}
+
+// isEchoed checks that the question of the response is the one of the
+// query, with the exact casing if it was randomized.
+func (c *UDPClient) isEchoed(q, echo dns.Question) bool {
+	if !c.randomizeCase {
+		return isSameQuestion(q, echo)
 	}
-	return true
+	return q.Name == echo.Name && q.Qtype == echo.Qtype &&
+		q.Qclass == echo.Qclass
 }
 
-func NewHTTPSClient(resolverIP string) *http.Client {
-	dialer := &net.Dialer{
+// NumSpoofed returns the number of responses dropped as suspected spoofing.
+func (c *UDPClient) NumSpoofed() int64 {
+	return c.numSpoofed.Load()
+}
+
+// NewHTTPSClient creates an HTTP client that resolves host names through
+// the given DNS server. If the server has a proxy, the client connects
+// through the proxy instead, which resolves the host names itself.
+func NewHTTPSClient(resolver *ServerConfig) *http.Client {
+	resolvClient := NewDNSClient(resolver)
+	var dialer ContextDialer = &net.Dialer{
 		Resolver: &net.Resolver{
 			PreferGo: true,
 			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-				d := tls.Dialer{}
-				return d.DialContext(ctx, TCPProto, resolverIP)
+				return NewDNSClientConn(resolvClient), nil
 			},
 		},
 	}
+	if resolver.proxyDialer != nil {
+		dialer = resolver.proxyDialer
+	}
 
 	dialContext := func(ctx context.Context, network, addr string) (net.Conn, error) {
 		return dialer.DialContext(ctx, network, addr)
@@ -267,3 +298,88 @@ func NewHTTPSClient(resolverIP string) *http.Client {
 	}
 	return client
 }
+
+// DNSClientConn adapts a DNSClient to a stream-oriented net.Conn, so that
+// net.Resolver can send its queries through any supported protocol.
+type DNSClientConn struct {
+	client   DNSClient
+	deadline time.Time
+	wbuf     bytes.Buffer
+	rbuf     bytes.Buffer
+}
+
+func NewDNSClientConn(client DNSClient) net.Conn {
+	return &DNSClientConn{client: client}
+}
+
+// Write takes length-prefixed queries (RFC 1035 4.2.2), and queues the
+// length-prefixed responses for Read.
+func (cc *DNSClientConn) Write(b []byte) (int, error) {
+	cc.wbuf.Write(b)
+	for cc.wbuf.Len() >= 2 {
+		buffered := cc.wbuf.Bytes()
+		msgLen := int(binary.BigEndian.Uint16(buffered))
+		if len(buffered) < msgLen+2 {
+			break
+		}
+		req := new(dns.Msg)
+		err := req.Unpack(buffered[2 : msgLen+2])
+		cc.wbuf.Next(msgLen + 2)
+		if err != nil {
+			return 0, err
+		}
+		resp, err := cc.exchange(req)
+		if err != nil {
+			return 0, err
+		}
+		packed, err := resp.Pack()
+		if err != nil {
+			return 0, err
+		}
+		_ = binary.Write(&cc.rbuf, binary.BigEndian, uint16(len(packed)))
+		cc.rbuf.Write(packed)
+	}
+	return len(b), nil
+}
+
+// exchange sends the query within the deadline set on the conn, or within
+// the default query timeout if there is none.
+func (cc *DNSClientConn) exchange(req *dns.Msg) (*dns.Msg, error) {
+	deadline := cc.deadline
+	if deadline.IsZero() {
+		deadline = time.Now().Add(DefaultQueryTimeout * time.Millisecond)
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	return cc.client.ExchangeContext(ctx, req)
+}
+
+func (cc *DNSClientConn) Read(b []byte) (int, error) {
+	return cc.rbuf.Read(b)
+}
+
+func (cc *DNSClientConn) Close() error {
+	return nil
+}
+
+func (cc *DNSClientConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func (cc *DNSClientConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func (cc *DNSClientConn) SetDeadline(t time.Time) error {
+	cc.deadline = t
+	return nil
+}
+
+func (cc *DNSClientConn) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+func (cc *DNSClientConn) SetWriteDeadline(t time.Time) error {
+	cc.deadline = t
+	return nil
+}
@@ -1,19 +1,25 @@
 package main
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/miekg/dns"
 	"io"
+	"log"
 	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 )
 
 const TLDListURL = "https://data.iana.org/TLD/tlds-alpha-by-domain.txt"
-const MaxConfigFileSize = 4096
-const DefaultCacheTTL = 600
-const DefaultMinTTL = 600
+const MaxConfigFileSize = 65536
 const DefaultMaxTTL = 86400
 const DefaultNegativeCacheTTL = 10
 const DefaultCachePurgeInterval = 600
@@ -21,6 +27,17 @@ const DefaultCacheCompactInterval = 1800
 const PortMin = 1
 const PortMax = 65535
 const DefaultListenPort = 53
+const DefaultTLSListenPort = 853
+const DefaultShutdownTimeout = 5
+const DefaultQueryTimeout = 4000
+const DefaultHealthCheckInterval = 30
+const DefaultHealthCheckQueryName = "."
+const DefaultHealthCheckFailThreshold = 3
+const DefaultHealthCheckRecoverThreshold = 2
+const DefaultMaxConns = 4
+const DefaultConnIdleTimeout = 30
+const DefaultListenerMaxConns = 1024
+const DefaultListenerIdleTimeout = 10
 
 type RecordType struct {
 	Name  string
@@ -61,13 +78,105 @@ type LiteDNSConfig struct {
 	LocalNameServers []*ServerConfig  `json:"LocalNameServers"`
 	AdBlocker        *AdBlockerConfig `json:"adBlocker"`
 	CacheConfig      *DNSCacheConfig  `json:"cacheConfig"`
-	ListenerConfig   *ServerConfig    `json:"listenerConfig"`
+	ListenerConfig   ListenerConfigs  `json:"listenerConfig"`
+	// Seconds to wait for in-flight queries on shutdown
+	ShutdownTimeout int64 `json:"shutdownTimeout"`
+	// Milliseconds to spend on a query, across all upstream attempts
+	QueryTimeout int64 `json:"queryTimeout"`
+	// Reload the config when the file is modified, besides on SIGHUP
+	WatchConfig    bool                  `json:"watchConfig"`
+	HealthCheck    *HealthCheckConfig    `json:"healthCheck"`
+	CircuitBreaker *CircuitBreakerConfig `json:"circuitBreaker"`
+	// How to pick the upstream for a query, e.g. "fastest"
+	UpstreamStrategy string        `json:"upstreamStrategy"`
+	Racing           *RacingConfig `json:"racing"`
+	// Servers for specific domains, taking precedence over the local and
+	// upstream servers
+	ForwardingRules []*ForwardingRule `json:"forwardingRules"`
+	Recursion       *RecursionConfig  `json:"recursion"`
+	// Servers resolving the host names of the other servers
+	BootstrapServers []*ServerConfig `json:"bootstrapServers"`
+	// The proxy URL of the TCP, DNS-over-TLS and DNS-over-HTTPS upstream,
+	// forwarding and bootstrap servers without one of their own
+	Proxy  string        `json:"proxy"`
+	ECS    *ECSConfig    `json:"ecs"`
+	DNSSEC *DNSSECConfig `json:"dnssec"`
+	// What to do with the local queries the local name servers do not
+	// answer
+	LocalFallback *LocalFallbackConfig `json:"localFallback"`
 }
 
 type ServerConfig struct {
-	IP    net.IP `json:"ip"`
+	IP net.IP `json:"ip"`
+	// The host name of a server, resolved through the bootstrap servers
+	// instead of an IP address, and verified in its TLS certificate
+	Host  string `json:"host"`
 	Port  uint16 `json:"port"`
 	Proto string `json:"proto"`
+	// The bootstrap servers resolving the host in the URL of a DoH
+	// upstream given by neither an IP address nor a host name
+	bootstrapServers []*ServerConfig
+	// The certificate and key files for serving TLS on a listener. If
+	// GenerateCert is set, a self-signed pair is created when missing.
+	CertFile     string `json:"certFile"`
+	KeyFile      string `json:"keyFile"`
+	GenerateCert bool   `json:"generateCert"`
+	// The URL path and the proxies allowed to set X-Forwarded-For for a
+	// DNS-over-HTTPS listener.
+	Path           string         `json:"path"`
+	TrustedProxies []netip.Prefix `json:"trustedProxies"`
+	// The URL template and the HTTP method for a DNS-over-HTTPS upstream.
+	URL    string `json:"url"`
+	Method string `json:"method"`
+	// The relative share of queries for the weighted strategy
+	Weight int `json:"weight"`
+	// The recursion settings of the recursive resolver upstream
+	Recursion *RecursionConfig `json:"-"`
+	// The connections to a TCP or DNS-over-TLS upstream: how many are kept
+	// open, how many can be open at once, and the seconds an unused one is
+	// kept open. On a TCP or DNS-over-TLS listener, how many client
+	// connections can be open at once, and the seconds an idle one is kept
+	// open.
+	MinConns    int   `json:"minConns"`
+	MaxConns    int   `json:"maxConns"`
+	IdleTimeout int64 `json:"idleTimeout"`
+	// The authentication of an encrypted upstream: the name to verify in
+	// its certificate, the CA certificates to verify it with instead of the
+	// system ones, the base64 SHA-256 digests of the pinned public keys, and
+	// the RFC 8310 privacy profile, "strict" or "opportunistic".
+	TLSServerName      string   `json:"tlsServerName"`
+	CAFile             string   `json:"caFile"`
+	SPKIPins           []string `json:"spkiPins"`
+	InsecureSkipVerify bool     `json:"insecureSkipVerify"`
+	PrivacyProfile     string   `json:"privacyProfile"`
+	tlsCfg             *tls.Config
+	// The URL of the SOCKS5 or HTTP proxy to connect to a TCP, DNS-over-TLS
+	// or DNS-over-HTTPS upstream through, or "direct"
+	Proxy       string `json:"proxy"`
+	proxyDialer *ProxyDialer
+	// Send the queries to a UDP upstream in 0x20 mixed case
+	CaseRandomization bool `json:"caseRandomization"`
+	// The EDNS buffer size first advertised to a UDP upstream, lowered if
+	// large responses time out
+	EDNSBufferSize uint16 `json:"ednsBufferSize"`
+}
+
+// ListenerConfigs is the list of local listeners. It can be written either
+// as a single object or as an array of objects in the config file.
+type ListenerConfigs []*ServerConfig
+
+func (lc *ListenerConfigs) UnmarshalJSON(b []byte) error {
+	var single ServerConfig
+	if err := json.Unmarshal(b, &single); err == nil {
+		*lc = ListenerConfigs{&single}
+		return nil
+	}
+	var multiple []*ServerConfig
+	if err := json.Unmarshal(b, &multiple); err != nil {
+		return err
+	}
+	*lc = multiple
+	return nil
 }
 
 type AdBlockerConfig struct {
@@ -76,13 +185,142 @@ type AdBlockerConfig struct {
 	SinkIP6      net.IP `json:"sinkIP6"`
 }
 
+// HealthCheckConfig configures the active probing of the upstream servers.
+// A negative interval disables probing.
+type HealthCheckConfig struct {
+	Interval         int64      `json:"interval"`
+	QueryName        string     `json:"queryName"`
+	QueryType        RecordType `json:"queryType"`
+	FailThreshold    int        `json:"failThreshold"`
+	RecoverThreshold int        `json:"recoverThreshold"`
+}
+
+// CircuitBreakerConfig sets when an upstream failing on real traffic is cut
+// off: after the threshold of consecutive failures, for a cool-down in
+// seconds that doubles on every failed trial up to the maximum. A negative
+// threshold disables the circuit breakers.
+type CircuitBreakerConfig struct {
+	FailThreshold int   `json:"failThreshold"`
+	CoolDown      int64 `json:"coolDown"`
+	MaxCoolDown   int64 `json:"maxCoolDown"`
+}
+
+// LocalFallbackConfig sets the fallback chains of the local queries, tried
+// in order when there is no local name server, or they fail or refuse to
+// answer: one for the private reverse zones of RFC 6303, which may not
+// include "upstream", and one for the other local names. A query left
+// without a fallback is answered with SERVFAIL.
+type LocalFallbackConfig struct {
+	Names               []string `json:"names"`
+	PrivateReverseZones []string `json:"privateReverseZones"`
+}
+
+// ECSConfig sets the EDNS Client Subnet policy, "strip", "forward" or
+// "synthesize", and the longest prefixes of the client addresses sent
+// upstream.
+type ECSConfig struct {
+	Policy     string `json:"policy"`
+	IPv4Prefix uint8  `json:"ipv4Prefix"`
+	IPv6Prefix uint8  `json:"ipv6Prefix"`
+}
+
+// DNSSECConfig enables validating the DNSSEC signatures of the responses
+// from the upstream servers, from the trust anchors of the root zone.
+type DNSSECConfig struct {
+	Enabled bool `json:"enabled"`
+	// The DS or DNSKEY records of the root zone to trust initially, in the
+	// zone file format
+	TrustAnchors []string `json:"trustAnchors"`
+	// The file keeping the keys learned through the RFC 5011 rollover of
+	// the trust anchors
+	TrustAnchorFile string `json:"trustAnchorFile"`
+	anchors         []dns.RR
+}
+
+// RacingConfig sets how many upstreams a query is sent to at once, globally
+// and for the names under a domain suffix. A count of 1 disables racing.
+type RacingConfig struct {
+	Count        int            `json:"count"`
+	SuffixCounts map[string]int `json:"suffixCounts"`
+}
+
+// CountFor returns the number of upstreams to race for the name, by the
+// longest matching suffix.
+func (rc *RacingConfig) CountFor(name string) int {
+	if rc == nil {
+		return 1
+	}
+	if n, ok := LongestSuffixMatch(rc.SuffixCounts, name); ok {
+		return n
+	}
+	return rc.Count
+}
+
+// ForwardingRule sends the queries for the names under any of its domain
+// suffixes to its own servers.
+type ForwardingRule struct {
+	Name     string          `json:"name"`
+	Suffixes []string        `json:"suffixes"`
+	Servers  []*ServerConfig `json:"servers"`
+}
+
+// RecursionConfig enables resolving the queries iteratively from the root
+// servers, instead of forwarding them to the upstream servers.
+type RecursionConfig struct {
+	Enabled bool `json:"enabled"`
+	// The addresses of the root servers, and the port of all authoritative
+	// servers
+	RootHints []net.IP `json:"rootHints"`
+	Port      uint16   `json:"port"`
+	// The number of delegations to cache
+	CacheSize int `json:"cacheSize"`
+	resolver  *RecursiveResolver
+	once      sync.Once
+}
+
+// Resolver returns the recursive resolver for the config, shared by all
+// the clients created from it.
+func (rc *RecursionConfig) Resolver() *RecursiveResolver {
+	rc.once.Do(func() {
+		rc.resolver = NewRecursiveResolver(rc)
+	})
+	return rc.resolver
+}
+
+// DNSCacheConfig sets the size of the cache, the record types it holds, and
+// the range in seconds the lifetimes of the entries are clamped to. An entry
+// expires with the lowest TTL of its answer, or the negative TTL of the SOA
+// record for a negative answer (RFC 2308 Section 5).
 type DNSCacheConfig struct {
-	CacheSize   int           `json:"cacheSize"`
+	CacheSize int   `json:"cacheSize"`
+	MinTTL    int64 `json:"minTTL"`
+	MaxTTL    int64 `json:"maxTTL"`
+	// Deprecated: the fixed lifetime of the entries, now the same as equal
+	// minTTL and maxTTL
 	CacheTTL    int64         `json:"cacheTTL"`
 	RecordTypes []*RecordType `json:"recordTypes"`
+	// The TTL ranges of specific record types, in place of the one above
+	TTLOverrides []*TTLOverride `json:"ttlOverrides"`
+}
+
+// TTLOverride is the TTL range of the cached answers to a record type. A
+// zero maxTTL keeps the maximum of the cache.
+type TTLOverride struct {
+	Type   RecordType `json:"type"`
+	MinTTL int64      `json:"minTTL"`
+	MaxTTL int64      `json:"maxTTL"`
 }
 
 func (sc *ServerConfig) String() string {
+	if sc.Proto == RecursiveProto {
+		return "recursive resolver"
+	}
+	if sc.IP == nil && sc.URL != "" {
+		return sc.URL
+	}
+	if sc.IP == nil && sc.Host != "" {
+		return net.JoinHostPort(sc.Host, strconv.Itoa(int(sc.Port)))
+	}
 	if ipv4 := sc.IP.To4(); ipv4 != nil {
 		return fmt.Sprintf("%s:%d", ipv4.String(), sc.Port)
 	} else {
@@ -90,6 +328,12 @@ func (sc *ServerConfig) String() string {
 	}
 }
 
+// NeedsBootstrap checks if the server is given by its host name, which has
+// to be resolved to connect to it.
+func (sc *ServerConfig) NeedsBootstrap() bool {
+	return sc.Host != "" && sc.IP == nil
+}
+
 func LoadConfig(filename string) (_ *LiteDNSConfig, err error) {
 	InitRecordStrToType()
 	var configFile *os.File
@@ -129,41 +373,567 @@ func LoadConfig(filename string) (_ *LiteDNSConfig, err error) {
 }
 
 func VerifyConfig(config *LiteDNSConfig) error {
-	if config.CacheConfig.CacheTTL <= 0 {
-		config.CacheConfig.CacheTTL = DefaultCacheTTL
+	if config.CacheConfig == nil {
+		return fmt.Errorf("no cache config was specified")
 	}
-	if config.CacheConfig.CacheTTL > DefaultMaxTTL {
-		config.CacheConfig.CacheTTL = DefaultMaxTTL
-	}
-	if config.CacheConfig.CacheTTL < DefaultMinTTL {
-		config.CacheConfig.CacheTTL = DefaultMinTTL
+	if err := VerifyCacheConfig(config.CacheConfig); err != nil {
+		return err
 	}
-	if len(config.CacheConfig.RecordTypes) == 0 {
-		return fmt.Errorf("no DNS record type was specified for caching")
+	if config.Recursion != nil && config.Recursion.Enabled {
+		if len(config.UpstreamServers) > 0 {
+			return fmt.Errorf(
+				"upstream servers cannot be used with recursion enabled")
+		}
+		if err := VerifyRecursionConfig(config.Recursion); err != nil {
+			return err
+		}
+		config.UpstreamServers = []*ServerConfig{
+			{Proto: RecursiveProto, Recursion: config.Recursion},
+		}
 	}
-	config.CacheConfig.RecordTypes = Unique(config.CacheConfig.RecordTypes,
-		func(r *RecordType) uint16 { return r.Value })
 	if len(config.UpstreamServers) == 0 {
 		return fmt.Errorf("no upstream DNS server was specified")
 	}
-	config.UpstreamServers = Unique(config.UpstreamServers,
-		func(s *ServerConfig) string { return s.IP.String() })
+	if _, err := NewProxyDialer(config.Proxy); err != nil {
+		return err
+	}
+	SetDefaultProxy(config.UpstreamServers, config.Proxy)
+	SetDefaultProxy(config.BootstrapServers, config.Proxy)
+	for _, r := range config.ForwardingRules {
+		SetDefaultProxy(r.Servers, config.Proxy)
+	}
+	config.UpstreamServers = Unique(config.UpstreamServers, ServerKey)
 	for _, s := range config.UpstreamServers {
-		if s.Port == 0 {
-			return fmt.Errorf("invalid port 0 for the upstream server %s",
-				s.String())
+		if err := VerifyServerConfig(s, "upstream server"); err != nil {
+			return err
 		}
 	}
-	config.LocalNameServers = Unique(config.LocalNameServers,
-		func(s *ServerConfig) string { return s.IP.String() })
+	config.LocalNameServers = Unique(config.LocalNameServers, ServerKey)
 	for _, s := range config.LocalNameServers {
-		if s.Port == 0 {
-			return fmt.Errorf("invalid port 0 for the local area server %s",
+		if err := VerifyServerConfig(s, "local area server"); err != nil {
+			return err
+		}
+	}
+	switch config.UpstreamStrategy {
+	case "":
+		config.UpstreamStrategy = StrategyRoundRobin
+	case StrategyRoundRobin, StrategyFastest, StrategyWeighted,
+		StrategyRandom, StrategySequential:
+	default:
+		return fmt.Errorf("invalid upstream strategy %s",
+			config.UpstreamStrategy)
+	}
+	if config.Racing == nil {
+		config.Racing = &RacingConfig{}
+	}
+	if err := VerifyRacingConfig(config.Racing); err != nil {
+		return err
+	}
+	if config.ECS == nil {
+		config.ECS = &ECSConfig{}
+	}
+	if err := VerifyECSConfig(config.ECS); err != nil {
+		return err
+	}
+	if config.DNSSEC == nil {
+		config.DNSSEC = &DNSSECConfig{}
+	}
+	if err := VerifyDNSSECConfig(config.DNSSEC); err != nil {
+		return err
+	}
+	if err := VerifyForwardingRules(config.ForwardingRules); err != nil {
+		return err
+	}
+	if err := VerifyBootstrapServers(config); err != nil {
+		return err
+	}
+	if config.HealthCheck == nil {
+		config.HealthCheck = &HealthCheckConfig{}
+	}
+	if err := VerifyHealthCheckConfig(config.HealthCheck); err != nil {
+		return err
+	}
+	if config.CircuitBreaker == nil {
+		config.CircuitBreaker = &CircuitBreakerConfig{}
+	}
+	VerifyCircuitBreakerConfig(config.CircuitBreaker)
+	if config.LocalFallback == nil {
+		config.LocalFallback = &LocalFallbackConfig{}
+	}
+	if err := VerifyLocalFallbackConfig(config.LocalFallback); err != nil {
+		return err
+	}
+	if config.ShutdownTimeout <= 0 {
+		config.ShutdownTimeout = DefaultShutdownTimeout
+	}
+	if config.QueryTimeout <= 0 {
+		config.QueryTimeout = DefaultQueryTimeout
+	}
+	if len(config.ListenerConfig) == 0 {
+		return fmt.Errorf("no local listener was specified")
+	}
+	for _, l := range config.ListenerConfig {
+		if err := VerifyListenerConfig(l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func VerifyRecursionConfig(rc *RecursionConfig) error {
+	if len(rc.RootHints) == 0 {
+		for _, hint := range DefaultRootHints {
+			rc.RootHints = append(rc.RootHints, net.ParseIP(hint))
+		}
+	}
+	for _, ip := range rc.RootHints {
+		if ip == nil {
+			return fmt.Errorf("invalid root hint for the recursion")
+		}
+	}
+	if rc.Port == 0 {
+		rc.Port = DefaultRecursionPort
+	}
+	if rc.CacheSize <= 0 {
+		rc.CacheSize = DefaultRecursionCacheSize
+	}
+	return nil
+}
+
+func VerifyRacingConfig(rc *RacingConfig) error {
+	if rc.Count <= 0 {
+		rc.Count = 1
+	}
+	suffixCounts := make(map[string]int, len(rc.SuffixCounts))
+	for suffix, n := range rc.SuffixCounts {
+		if _, ok := dns.IsDomainName(suffix); !ok {
+			return NewInvalidDomainNameError(suffix)
+		}
+		if n <= 0 {
+			n = 1
+		}
+		suffixCounts[dns.CanonicalName(suffix)] = n
+	}
+	rc.SuffixCounts = suffixCounts
+	return nil
+}
+
+func VerifyECSConfig(ec *ECSConfig) error {
+	switch ec.Policy {
+	case "":
+		ec.Policy = ECSStrip
+	case ECSStrip, ECSForward, ECSSynthesize:
+	default:
+		return fmt.Errorf("invalid ECS policy %s", ec.Policy)
+	}
+	if ec.IPv4Prefix == 0 {
+		ec.IPv4Prefix = DefaultECSPrefix4
+	}
+	if ec.IPv6Prefix == 0 {
+		ec.IPv6Prefix = DefaultECSPrefix6
+	}
+	if ec.IPv4Prefix > 32 || ec.IPv6Prefix > 128 {
+		return fmt.Errorf("invalid ECS prefix lengths /%d and /%d",
+			ec.IPv4Prefix, ec.IPv6Prefix)
+	}
+	return nil
+}
+
+// VerifyCacheConfig checks the record types to cache, and the TTL ranges.
+func VerifyCacheConfig(cc *DNSCacheConfig) error {
+	if len(cc.RecordTypes) == 0 {
+		return fmt.Errorf("no DNS record type was specified for caching")
+	}
+	cc.RecordTypes = Unique(cc.RecordTypes,
+		func(r *RecordType) uint16 { return r.Value })
+	if cc.CacheTTL > 0 {
+		if cc.MinTTL != 0 || cc.MaxTTL != 0 {
+			return fmt.Errorf("cacheTTL cannot be set with minTTL or maxTTL")
+		}
+		log.Printf("The cacheTTL setting is deprecated, use minTTL and " +
+			"maxTTL instead")
+		ttl := min(cc.CacheTTL, DefaultMaxTTL)
+		cc.MinTTL, cc.MaxTTL = ttl, ttl
+	}
+	if cc.MaxTTL <= 0 || cc.MaxTTL > DefaultMaxTTL {
+		cc.MaxTTL = DefaultMaxTTL
+	}
+	if cc.MinTTL < 0 || cc.MinTTL > cc.MaxTTL {
+		return fmt.Errorf("invalid cache TTL range %d-%d", cc.MinTTL,
+			cc.MaxTTL)
+	}
+	for _, o := range cc.TTLOverrides {
+		if o == nil || o.Type.Value == 0 {
+			return fmt.Errorf("no record type for a cache TTL override")
+		}
+		if o.MaxTTL <= 0 || o.MaxTTL > DefaultMaxTTL {
+			o.MaxTTL = cc.MaxTTL
+		}
+		if o.MinTTL < 0 || o.MinTTL > o.MaxTTL {
+			return fmt.Errorf("invalid cache TTL range %d-%d for %s",
+				o.MinTTL, o.MaxTTL, o.Type.Name)
+		}
+	}
+	return nil
+}
+
+// VerifyLocalFallbackConfig checks the fallback actions, and answers the
+// private reverse zones with NXDOMAIN by default.
+func VerifyLocalFallbackConfig(lf *LocalFallbackConfig) error {
+	if lf.PrivateReverseZones == nil {
+		lf.PrivateReverseZones = []string{FallbackNXDomain}
+	}
+	for _, action := range lf.Names {
+		switch action {
+		case FallbackUpstream, FallbackNXDomain, FallbackNoData,
+			FallbackServFail:
+		default:
+			return fmt.Errorf("invalid local fallback %s", action)
+		}
+	}
+	for _, action := range lf.PrivateReverseZones {
+		switch action {
+		case FallbackNXDomain, FallbackNoData, FallbackServFail:
+		case FallbackUpstream:
+			return fmt.Errorf("the private reverse zones may not fall back " +
+				"to the upstream servers")
+		default:
+			return fmt.Errorf("invalid local fallback %s", action)
+		}
+	}
+	return nil
+}
+
+func VerifyDNSSECConfig(dc *DNSSECConfig) error {
+	if len(dc.TrustAnchors) == 0 {
+		dc.TrustAnchors = CloneSlice(DefaultRootTrustAnchors)
+	}
+	dc.anchors = make([]dns.RR, 0, len(dc.TrustAnchors))
+	for _, s := range dc.TrustAnchors {
+		rr, err := dns.NewRR(s)
+		if err != nil || rr == nil {
+			return fmt.Errorf("invalid trust anchor %q", s)
+		}
+		switch rr.(type) {
+		case *dns.DS, *dns.DNSKEY:
+		default:
+			return fmt.Errorf("trust anchor %q is neither DS nor DNSKEY", s)
+		}
+		if dns.CanonicalName(rr.Header().Name) != "." {
+			return fmt.Errorf("trust anchor %q is not for the root zone", s)
+		}
+		dc.anchors = append(dc.anchors, rr)
+	}
+	return nil
+}
+
+// VerifyForwardingRules checks that the rules have distinct names, and that
+// no suffix is claimed by more than one rule.
+func VerifyForwardingRules(rules []*ForwardingRule) error {
+	names := make(map[string]struct{}, len(rules))
+	suffixes := make(map[string]string)
+	for _, r := range rules {
+		if r == nil || r.Name == "" {
+			return fmt.Errorf("forwarding rule without a name")
+		}
+		if _, dup := names[r.Name]; dup {
+			return fmt.Errorf("duplicate forwarding rule %s", r.Name)
+		}
+		names[r.Name] = struct{}{}
+		if len(r.Suffixes) == 0 {
+			return fmt.Errorf("no domain suffix for the forwarding rule %s",
+				r.Name)
+		}
+		for i, suffix := range r.Suffixes {
+			if _, ok := dns.IsDomainName(suffix); !ok {
+				return NewInvalidDomainNameError(suffix)
+			}
+			suffix = dns.CanonicalName(suffix)
+			if other, dup := suffixes[suffix]; dup {
+				return fmt.Errorf("suffix %s is forwarded by both %s and %s",
+					suffix, other, r.Name)
+			}
+			suffixes[suffix] = r.Name
+			r.Suffixes[i] = suffix
+		}
+		if len(r.Servers) == 0 {
+			return fmt.Errorf("no server for the forwarding rule %s", r.Name)
+		}
+		r.Servers = Unique(r.Servers, ServerKey)
+		for _, s := range r.Servers {
+			if err := VerifyServerConfig(s, "forwarding server"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func VerifyHealthCheckConfig(hc *HealthCheckConfig) error {
+	if hc.Interval == 0 {
+		hc.Interval = DefaultHealthCheckInterval
+	}
+	if hc.QueryName == "" {
+		hc.QueryName = DefaultHealthCheckQueryName
+	}
+	hc.QueryName = dns.Fqdn(hc.QueryName)
+	if _, ok := dns.IsDomainName(hc.QueryName); !ok {
+		return NewInvalidDomainNameError(hc.QueryName)
+	}
+	if hc.QueryType.Value == 0 {
+		hc.QueryType = RecordStrToType["NS"]
+	}
+	if hc.FailThreshold <= 0 {
+		hc.FailThreshold = DefaultHealthCheckFailThreshold
+	}
+	if hc.RecoverThreshold <= 0 {
+		hc.RecoverThreshold = DefaultHealthCheckRecoverThreshold
+	}
+	return nil
+}
+
+// VerifyCircuitBreakerConfig fills in the defaults of the circuit breakers.
+func VerifyCircuitBreakerConfig(cb *CircuitBreakerConfig) {
+	if cb.FailThreshold == 0 {
+		cb.FailThreshold = DefaultBreakerFailThreshold
+	}
+	if cb.CoolDown <= 0 {
+		cb.CoolDown = DefaultBreakerCoolDown
+	}
+	if cb.MaxCoolDown <= 0 {
+		cb.MaxCoolDown = DefaultBreakerMaxCoolDown
+	}
+	if cb.MaxCoolDown < cb.CoolDown {
+		cb.MaxCoolDown = cb.CoolDown
+	}
+}
+
+// VerifyBootstrapServers checks that the bootstrap servers are given by
+// their addresses, and that there is one if any server is given by its
+// host name.
+func VerifyBootstrapServers(config *LiteDNSConfig) error {
+	config.BootstrapServers = Unique(config.BootstrapServers, ServerKey)
+	for _, s := range config.BootstrapServers {
+		if err := VerifyServerConfig(s, "bootstrap server"); err != nil {
+			return err
+		}
+		if s.IP == nil {
+			return fmt.Errorf("no IP address for the bootstrap server %s",
+				s.String())
+		}
+	}
+	if len(config.BootstrapServers) > 0 {
+		SetDoHBootstrap(config.UpstreamServers, config.BootstrapServers)
+		SetDoHBootstrap(config.LocalNameServers, config.BootstrapServers)
+		for _, r := range config.ForwardingRules {
+			SetDoHBootstrap(r.Servers, config.BootstrapServers)
+		}
+		return nil
+	}
+	needsBootstrap := NeedsBootstrap(config.UpstreamServers) ||
+		NeedsBootstrap(config.LocalNameServers)
+	for _, r := range config.ForwardingRules {
+		needsBootstrap = needsBootstrap || NeedsBootstrap(r.Servers)
+	}
+	if needsBootstrap {
+		return fmt.Errorf(
+			"no bootstrap server to resolve the server host names")
+	}
+	return nil
+}
+
+// SetDoHBootstrap makes the DoH servers given only by their URL resolve its
+// host through the bootstrap servers instead of the system resolver.
+func SetDoHBootstrap(servers, bootstrap []*ServerConfig) {
+	for _, s := range servers {
+		if s.Proto == HTTPSProto && s.IP == nil && s.Host == "" {
+			s.bootstrapServers = bootstrap
+		}
+	}
+}
+
+// HTTPResolvers returns the servers resolving the host names of the lists
+// to download: the upstream servers given by their addresses, and then the
+// bootstrap servers.
+func (config *LiteDNSConfig) HTTPResolvers() []*ServerConfig {
+	resolvers := make([]*ServerConfig, 0,
+		len(config.UpstreamServers)+len(config.BootstrapServers))
+	for _, s := range config.UpstreamServers {
+		if !s.NeedsBootstrap() {
+			resolvers = append(resolvers, s)
+		}
+	}
+	return append(resolvers, config.BootstrapServers...)
+}
+
+// SetDefaultProxy sets the proxy of the servers without one of their own.
+// Only the servers connected to over TCP get it, as the others cannot be
+// proxied.
+func SetDefaultProxy(servers []*ServerConfig, proxyURL string) {
+	for _, s := range servers {
+		if s == nil || s.Proxy != "" {
+			continue
+		}
+		switch s.Proto {
+		case TCPProto, TLSProto, HTTPSProto:
+			s.Proxy = proxyURL
+		}
+	}
+}
+
+// ServerKey identifies duplicate server entries.
+func ServerKey(s *ServerConfig) string {
+	return s.IP.String() + "\t" + s.Host + "\t" + s.URL
+}
+
+func VerifyServerConfig(s *ServerConfig, kind string) error {
+	if s == nil {
+		return fmt.Errorf("invalid empty %s", kind)
+	}
+	if s.Weight < 0 {
+		return fmt.Errorf("invalid weight %d for the %s %s",
+			s.Weight, kind, s.String())
+	}
+	if s.Weight == 0 {
+		s.Weight = 1
+	}
+	if s.Host != "" {
+		if s.IP != nil {
+			return fmt.Errorf("both IP address and host name for the %s %s",
+				kind, s.String())
+		}
+		s.Host = strings.TrimSuffix(s.Host, ".")
+		if _, ok := dns.IsDomainName(s.Host); !ok {
+			return NewInvalidDomainNameError(s.Host)
+		}
+	}
+	if s.MaxConns <= 0 {
+		s.MaxConns = DefaultMaxConns
+	}
+	if s.MinConns < 0 || s.MinConns > s.MaxConns {
+		return fmt.Errorf("invalid minConns %d for the %s %s",
+			s.MinConns, kind, s.String())
+	}
+	if s.IdleTimeout <= 0 {
+		s.IdleTimeout = DefaultConnIdleTimeout
+	}
+	if s.EDNSBufferSize == 0 {
+		s.EDNSBufferSize = EDNS_BUFFER_SIZE
+	}
+	if s.EDNSBufferSize < dns.MinMsgSize {
+		return fmt.Errorf("invalid EDNS buffer size %d for the %s %s",
+			s.EDNSBufferSize, kind, s.String())
+	}
+	switch s.Proto {
+	case "":
+		s.Proto = DefaultProto
+	case DefaultProto, UDPProto, TCPProto, TLSProto, HTTPSProto, QUICProto:
+	case RecursiveProto:
+		if s.Recursion == nil {
+			return fmt.Errorf("the recursion section enables the %s",
 				s.String())
 		}
+		return VerifyServerProxy(s, kind)
+	default:
+		return fmt.Errorf("invalid protocol %s for the %s %s",
+			s.Proto, kind, s.String())
 	}
-	if config.ListenerConfig.Port == 0 {
+	if err := VerifyServerProxy(s, kind); err != nil {
+		return err
+	}
+	if s.CaseRandomization && s.Proto != DefaultProto && s.Proto != UDPProto {
+		return fmt.Errorf("no case randomization over %s for the %s %s",
+			s.Proto, kind, s.String())
+	}
+	if s.Proto == HTTPSProto {
+		u, err := url.Parse(DoHURLFromTemplate(s.URL))
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("invalid DoH URL %q for the %s", s.URL, kind)
+		}
+		switch strings.ToUpper(s.Method) {
+		case "":
+			s.Method = http.MethodPost
+		case http.MethodGet, http.MethodPost:
+		default:
+			return fmt.Errorf("invalid DoH method %s for the %s %s",
+				s.Method, kind, s.String())
+		}
+		if (s.IP != nil || s.Host != "") && s.Port == 0 {
+			s.Port = DoHDefaultPort
+		}
+		return VerifyUpstreamTLS(s, kind)
+	}
+	if s.IP == nil && s.Host == "" {
+		return fmt.Errorf("no IP address or host name for the %s", kind)
+	}
+	if s.Port == 0 {
+		return fmt.Errorf("invalid port 0 for the %s %s", kind, s.String())
+	}
+	return VerifyUpstreamTLS(s, kind)
+}
+
+// VerifyServerProxy checks that the server is connected to over TCP if it
+// has a proxy, since only TCP connections can be proxied.
+func VerifyServerProxy(s *ServerConfig, kind string) error {
+	pd, err := NewProxyDialer(s.Proxy)
+	if err != nil {
+		return fmt.Errorf("%w for the %s %s", err, kind, s.String())
+	}
+	if pd == nil {
+		return nil
+	}
+	switch s.Proto {
+	case TCPProto, TLSProto, HTTPSProto:
+	default:
+		return fmt.Errorf("unable to proxy the %s protocol of the %s %s",
+			s.Proto, kind, s.String())
+	}
+	s.proxyDialer = pd
+	return nil
+}
+
+func VerifyListenerConfig(l *ServerConfig) error {
+	if l == nil {
+		return fmt.Errorf("invalid empty local listener")
+	}
+	switch l.Proto {
+	case "":
+		l.Proto = DefaultProto
+	case DefaultProto, UDPProto, TCPProto:
+	case TLSProto, QUICProto:
+		if l.CertFile == "" || l.KeyFile == "" {
+			return fmt.Errorf(
+				"no certificate or key file for the TLS listener %s",
+				l.String())
+		}
+		if l.Proto == TLSProto && l.Port == 0 {
+			l.Port = DefaultTLSListenPort
+		}
+	case HTTPSProto:
+		if (l.CertFile == "") != (l.KeyFile == "") {
+			return fmt.Errorf(
+				"both certificate and key files are needed for %s",
+				l.String())
+		}
+		if l.Path == "" {
+			l.Path = DoHDefaultPath
+		}
+		if !strings.HasPrefix(l.Path, "/") {
+			return fmt.Errorf("invalid DoH path %s for the local server %s",
+				l.Path, l.String())
+		}
+	default:
+		return fmt.Errorf("invalid protocol %s for the local server %s",
+			l.Proto, l.String())
+	}
+	if l.Port == 0 {
 		return fmt.Errorf("invalid port 0 for the local server")
 	}
+	if l.MaxConns <= 0 {
+		l.MaxConns = DefaultListenerMaxConns
+	}
+	if l.IdleTimeout <= 0 {
+		l.IdleTimeout = DefaultListenerIdleTimeout
+	}
 	return nil
 }
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestVerifyListenerConfigPort(t *testing.T) {
+	tests := []struct {
+		proto   string
+		port    uint16
+		want    uint16
+		wantErr bool
+	}{
+		{proto: TLSProto, want: DefaultTLSListenPort},
+		{proto: TLSProto, port: 8853, want: 8853},
+		{proto: TCPProto, wantErr: true},
+		{proto: QUICProto, wantErr: true},
+		{proto: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		l := &ServerConfig{IP: net.IPv4(127, 0, 0, 1), Port: tt.port,
+			Proto: tt.proto, CertFile: "cert.pem", KeyFile: "key.pem"}
+		err := VerifyListenerConfig(l)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q on port %d: got the error %v", tt.proto, tt.port,
+				err)
+			continue
+		}
+		if err == nil && l.Port != tt.want {
+			t.Errorf("%q on port %d: got the port %d, want %d", tt.proto,
+				tt.port, l.Port, tt.want)
+		}
+	}
+}
@@ -19,13 +19,16 @@ const (
 	BlockedDomain
 )
 
+// cacheKey identifies a cached response. The subnet is the client subnet
+// the response is valid for (RFC 7871 Section 7.3), or "" for all clients.
 type cacheKey struct {
 	cname   string
 	session string
+	subnet  string
 	recType uint16
 }
 
-func asCacheKey(msg *dns.Msg, session string) cacheKey {
+func asCacheKey(msg *dns.Msg, session string, subnet string) cacheKey {
 	if len(msg.Question) != 1 {
 		log.Panicf("Invalid *dns.Msg with %d questions (should be 1)",
 			len(msg.Question))
@@ -33,6 +36,7 @@ func asCacheKey(msg *dns.Msg, session string) cacheKey {
 	return cacheKey{
 		cname:   dns.CanonicalName(msg.Question[0].Name),
 		session: session,
+		subnet:  subnet,
 		recType: msg.Question[0].Qtype,
 	}
 }
@@ -40,18 +44,31 @@ func asCacheKey(msg *dns.Msg, session string) cacheKey {
 // DNSCache is the interface that wraps the DNS cache operations.
 type DNSCache interface {
 	Query(*dns.Msg, string) (*dns.Msg, error)
-	Update(*dns.Msg, string) error
+	Update(*dns.Msg, string, ValidationState) error
 	PurgeDomain(string) int
 	PurgeExpired() int
 	Flush() int
+	Close()
+}
+
+// ttlRange is the range the cache TTLs of the responses are clamped to.
+type ttlRange struct {
+	min uint32
+	max uint32
+}
+
+func (tr ttlRange) clamp(ttl uint32) uint32 {
+	return min(max(ttl, tr.min), tr.max)
 }
 
 type DNSMapCache struct {
 	cacheMap   map[cacheKey]int
 	lruCache   *LRUCache[DNSRecord]
 	cachedType map[int32]struct{}
-	cacheTTL   int64
+	ttlRange   ttlRange
+	typeTTLs   map[uint16]ttlRange
 	ForceFlush chan<- struct{}
+	done       chan struct{}
 	sync.RWMutex
 }
 
@@ -61,12 +78,19 @@ func NewDNSCache(cfg *DNSCacheConfig) DNSCache {
 		cacheMap:   make(map[cacheKey]int, cfg.CacheSize),
 		lruCache:   NewLRUCache[DNSRecord](cfg.CacheSize),
 		cachedType: make(map[int32]struct{}),
-		cacheTTL:   cfg.CacheTTL,
+		ttlRange: ttlRange{min: uint32(cfg.MinTTL),
+			max: uint32(cfg.MaxTTL)},
+		typeTTLs:   make(map[uint16]ttlRange, len(cfg.TTLOverrides)),
 		ForceFlush: forceFlush,
+		done:       make(chan struct{}),
 	}
 	for _, rrType := range cfg.RecordTypes {
 		ch.cachedType[int32(rrType.Value)] = struct{}{}
 	}
+	for _, o := range cfg.TTLOverrides {
+		ch.typeTTLs[o.Type.Value] = ttlRange{min: uint32(o.MinTTL),
+			max: uint32(o.MaxTTL)}
+	}
 	purgingInterval := DefaultCachePurgeInterval * time.Second
 	compactInterval := DefaultCacheCompactInterval * time.Second
 	go func() {
@@ -74,6 +98,10 @@ func NewDNSCache(cfg *DNSCacheConfig) DNSCache {
 		cTimer := time.NewTimer(compactInterval)
 		for {
 			select {
+			case <-ch.done:
+				pTimer.Stop()
+				cTimer.Stop()
+				return
 			case <-forceFlush:
 				if !pTimer.Stop() {
 					<-pTimer.C
@@ -101,7 +129,8 @@ func NewDNSCache(cfg *DNSCacheConfig) DNSCache {
 }
 
 // Query returns a result if the given query is valid and a cached response
-// is available.
+// is available. A query with a client subnet matches the response cached
+// for the most specific subnet containing it.
 func (ch *DNSMapCache) Query(q *dns.Msg, session string) (*dns.Msg, error) {
 	if ch == nil {
 		panic("Invoked *DNSMapCache.Query() on a nil ptr")
@@ -120,8 +149,13 @@ func (ch *DNSMapCache) Query(q *dns.Msg, session string) (*dns.Msg, error) {
 	}
 	ch.RLock()
 	defer ch.RUnlock()
-	k := asCacheKey(q, session)
-	i, keyFound := ch.cacheMap[k]
+	i, keyFound := 0, false
+	for _, subnet := range ECSCacheSubnets(q) {
+		i, keyFound = ch.cacheMap[asCacheKey(q, session, subnet)]
+		if keyFound {
+			break
+		}
+	}
 	if !keyFound {
 		return nil, nil
 	}
@@ -138,8 +172,10 @@ func (ch *DNSMapCache) Query(q *dns.Msg, session string) (*dns.Msg, error) {
 // Update returns error if the query question section is invalid,
 // if the message is not a valid response, or the query type is not
 // allowed to be cached. It substitutes the old entry with the new if present.
-// Otherwise, it adds the new entry to the cache.
-func (ch *DNSMapCache) Update(msg *dns.Msg, session string) error {
+// Otherwise, it adds the new entry to the cache. The DNSSEC validation state
+// is kept with the entry, and only a secure entry is served with the AD bit.
+func (ch *DNSMapCache) Update(msg *dns.Msg, session string,
+	validation ValidationState) error {
 	if ch == nil {
 		panic("Invoked *DNSMapCache.Update() on a nil ptr")
 	}
@@ -160,35 +196,65 @@ func (ch *DNSMapCache) Update(msg *dns.Msg, session string) error {
 			"%w (%s): *DNSMapCache.Update()",
 			UnsupportedCachingError, msg.Question[0].String())
 	}
-	// RFC 6891: OPT pseudo-RR MUST NOT be cached.
+	subnet := ECSCacheSubnet(msg)
+	// RFC 6891: OPT pseudo-RR MUST NOT be cached. Along with it goes the
+	// padding of the encrypted transports.
 	for i := len(msg.Extra) - 1; i >= 0; i-- {
 		if msg.Extra[i].Header().Rrtype == dns.TypeOPT {
 			msg.Extra = append(msg.Extra[:i], msg.Extra[i+1:]...)
 			break
 		}
 	}
-	ttl := ch.cacheTTL
-	// RFC 2308: Negative entry MUST be cached, but with limited time
-	if msg.Rcode != dns.RcodeSuccess {
-		ttl = DefaultNegativeCacheTTL
-	}
-	expiry := NewExpiry(ttl)
+	ttl := ch.CacheTTL(msg)
+	msg.AuthenticatedData = validation == Secure
 	ch.Lock()
 	defer ch.Unlock()
-	k := asCacheKey(msg, session)
+	k := asCacheKey(msg, session, subnet)
 	if i, ok := ch.cacheMap[k]; ok {
 		_, _ = ch.lruCache.Delete(i)
 	}
-	record := DNSRecord{session: session, entry: msg, expiry: expiry}
+	record := DNSRecord{session: session, subnet: subnet, entry: msg,
+		validation: validation, cachedAt: CurrentUnixTime(),
+		expiry: NewExpiry(int64(ttl))}
 	i, overwrite, old := ch.lruCache.Add(record)
 	if overwrite {
-		oldK := asCacheKey(old.entry, session)
+		oldK := asCacheKey(old.entry, old.session, old.subnet)
 		delete(ch.cacheMap, oldK)
 	}
 	ch.cacheMap[k] = i
 	return nil
 }
 
+// CacheTTL returns how long the response is cached: the lowest TTL of the
+// answer, or the negative TTL of a negative answer, clamped to the range of
+// its record type. The records are left as is, as their TTLs are covered by
+// the DNSSEC signatures.
+func (ch *DNSMapCache) CacheTTL(msg *dns.Msg) uint32 {
+	// RFC 2308 Section 7: a server failure is cached for a short time
+	if msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError {
+		return DefaultNegativeCacheTTL
+	}
+	tr, ok := ch.typeTTLs[msg.Question[0].Qtype]
+	if !ok {
+		tr = ch.ttlRange
+	}
+	if msg.Rcode == dns.RcodeSuccess && len(msg.Answer) > 0 {
+		ttl := msg.Answer[0].Header().Ttl
+		for _, rr := range msg.Answer[1:] {
+			ttl = min(ttl, rr.Header().Ttl)
+		}
+		return tr.clamp(ttl)
+	}
+	// RFC 2308 Section 5: the negative TTL is the lower of the TTL and the
+	// minimum field of the SOA record
+	for _, rr := range msg.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return tr.clamp(min(soa.Hdr.Ttl, soa.Minttl))
+		}
+	}
+	return DefaultNegativeCacheTTL
+}
+
 // PurgeDomain removes all entries that matches the domain name,
 // and returns the total number of removed entries.
 func (ch *DNSMapCache) PurgeDomain(dname string) int {
@@ -228,6 +294,14 @@ func (ch *DNSMapCache) Flush() int {
 	return ch.lruCache.Flush()
 }
 
+// Close stops the periodic purging and compaction of the cache.
+func (ch *DNSMapCache) Close() {
+	if ch == nil {
+		panic("Invoked *DNSMapCache.Close() on a nil ptr")
+	}
+	close(ch.done)
+}
+
 // Compact purges all expired entries and compact the LRU cache.
 func (ch *DNSMapCache) Compact() {
 	if ch == nil {
@@ -240,7 +314,7 @@ func (ch *DNSMapCache) Compact() {
 	})
 	cleanCacheMap := make(map[cacheKey]int, ch.lruCache.MaxSize)
 	ch.lruCache.CompactAndSort(func(i int, record DNSRecord) {
-		k := asCacheKey(record.entry, record.session)
+		k := asCacheKey(record.entry, record.session, record.subnet)
 		cleanCacheMap[k] = i
 	})
 	ch.cacheMap = cleanCacheMap
@@ -252,7 +326,7 @@ func (ch *DNSMapCache) purgeIfTrue(pred func(record DNSRecord) bool) int {
 	}
 	purged := ch.lruCache.Purge(pred)
 	for _, old := range purged {
-		k := asCacheKey(old.entry, old.session)
+		k := asCacheKey(old.entry, old.session, old.subnet)
 		delete(ch.cacheMap, k)
 	}
 	return len(purged)
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"testing"
+)
+
+func TestCacheTTL(t *testing.T) {
+	cfg := &DNSCacheConfig{
+		CacheSize: 16,
+		MinTTL:    60,
+		MaxTTL:    3600,
+		RecordTypes: []*RecordType{{Name: "A", Value: dns.TypeA},
+			{Name: "TXT", Value: dns.TypeTXT}},
+		TTLOverrides: []*TTLOverride{{Type: RecordType{Name: "TXT",
+			Value: dns.TypeTXT}, MinTTL: 300, MaxTTL: 600}},
+	}
+	if err := VerifyCacheConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	ch := NewDNSCache(cfg).(*DNSMapCache)
+	defer ch.Close()
+	const soa = "example. %d IN SOA ns.example. host.example. 1 7200 " +
+		"3600 1209600 %d"
+	tests := []struct {
+		name   string
+		qtype  uint16
+		rcode  int
+		answer []string
+		ns     []string
+		want   uint32
+	}{
+		{name: "raised to the minimum", qtype: dns.TypeA,
+			answer: []string{"a.example. 30 IN A 192.0.2.1"}, want: 60},
+		{name: "lowered to the maximum", qtype: dns.TypeA,
+			answer: []string{"a.example. 7200 IN A 192.0.2.1"}, want: 3600},
+		{name: "lowest TTL of the answer", qtype: dns.TypeA,
+			answer: []string{"a.example. 900 IN A 192.0.2.1",
+				"a.example. 120 IN A 192.0.2.2"}, want: 120},
+		{name: "raised to the minimum of the type", qtype: dns.TypeTXT,
+			answer: []string{`a.example. 100 IN TXT "x"`}, want: 300},
+		{name: "lowered to the maximum of the type", qtype: dns.TypeTXT,
+			answer: []string{`a.example. 1000 IN TXT "x"`}, want: 600},
+		{name: "NXDOMAIN with the SOA minimum", qtype: dns.TypeA,
+			rcode: dns.RcodeNameError,
+			ns:    []string{fmt.Sprintf(soa, 900, 120)}, want: 120},
+		{name: "NODATA with the SOA TTL", qtype: dns.TypeA,
+			ns: []string{fmt.Sprintf(soa, 90, 3000)}, want: 90},
+		{name: "negative TTL raised to the minimum", qtype: dns.TypeA,
+			rcode: dns.RcodeNameError,
+			ns:    []string{fmt.Sprintf(soa, 900, 5)}, want: 60},
+		{name: "NXDOMAIN without a SOA", qtype: dns.TypeA,
+			rcode: dns.RcodeNameError, want: DefaultNegativeCacheTTL},
+		{name: "server failure", qtype: dns.TypeA,
+			rcode: dns.RcodeServerFailure, want: DefaultNegativeCacheTTL},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := new(dns.Msg)
+			msg.SetQuestion("a.example.", tt.qtype)
+			msg.Response = true
+			msg.Rcode = tt.rcode
+			msg.Answer = testRRs(t, tt.answer...)
+			msg.Ns = testRRs(t, tt.ns...)
+			orig := msg.Copy()
+			if got := ch.CacheTTL(msg); got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+			// the TTLs are covered by the DNSSEC signatures
+			if msg.String() != orig.String() {
+				t.Errorf("the records changed to %v", msg)
+			}
+		})
+	}
+}
+
+func TestVerifyCacheConfigTTL(t *testing.T) {
+	tests := []struct {
+		name     string
+		cacheTTL int64
+		minTTL   int64
+		maxTTL   int64
+		wantMin  int64
+		wantMax  int64
+		wantErr  bool
+	}{
+		{name: "defaults", wantMin: 0, wantMax: DefaultMaxTTL},
+		{name: "range", minTTL: 60, maxTTL: 600, wantMin: 60, wantMax: 600},
+		{name: "cacheTTL as equal bounds", cacheTTL: 300, wantMin: 300,
+			wantMax: 300},
+		{name: "cacheTTL capped", cacheTTL: 2 * DefaultMaxTTL,
+			wantMin: DefaultMaxTTL, wantMax: DefaultMaxTTL},
+		{name: "cacheTTL with minTTL", cacheTTL: 300, minTTL: 60,
+			wantErr: true},
+		{name: "inverted range", minTTL: 600, maxTTL: 60, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cc := &DNSCacheConfig{
+				CacheTTL:    tt.cacheTTL,
+				MinTTL:      tt.minTTL,
+				MaxTTL:      tt.maxTTL,
+				RecordTypes: []*RecordType{{Name: "A", Value: dns.TypeA}},
+			}
+			err := VerifyCacheConfig(cc)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got the error %v", err)
+			}
+			if err == nil && (cc.MinTTL != tt.wantMin ||
+				cc.MaxTTL != tt.wantMax) {
+				t.Errorf("got the range %d-%d, want %d-%d", cc.MinTTL,
+					cc.MaxTTL, tt.wantMin, tt.wantMax)
+			}
+		})
+	}
+}
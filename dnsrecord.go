@@ -8,9 +8,12 @@ import (
 type UnixTimestamp int64
 
 type DNSRecord struct {
-	session string
-	entry   *dns.Msg
-	expiry  UnixTimestamp
+	session    string
+	subnet     string
+	entry      *dns.Msg
+	validation ValidationState
+	cachedAt   UnixTimestamp
+	expiry     UnixTimestamp
 }
 
 func CurrentUnixTime() UnixTimestamp {
@@ -21,46 +24,32 @@ func NewExpiry(ttl int64) UnixTimestamp {
 	return CurrentUnixTime() + UnixTimestamp(ttl)
 }
 
-func (expiry UnixTimestamp) GetTTL() uint32 {
-	now := CurrentUnixTime()
-	diff := expiry - now
-	if diff <= 0 {
-		return 0
-	}
-	if diff > DefaultMaxTTL {
-		return DefaultMaxTTL
-	}
-	return uint32(diff)
-}
-
 func (r DNSRecord) IsExpired() bool {
 	return r.expiry <= CurrentUnixTime()
 }
 
+// TTLAdjustedEntry returns a copy of the cached response, with the TTL of
+// each record decremented by the time it has been cached. The cached one is
+// left as is, as it is shared by the concurrent queries.
 func (r DNSRecord) TTLAdjustedEntry() *dns.Msg {
-	newTTL := r.expiry.GetTTL()
-	if r.expiry <= 0 {
-		return nil
+	elapsed := CurrentUnixTime() - r.cachedAt
+	if elapsed < 0 {
+		elapsed = 0
 	}
-	for _, a := range r.entry.Answer {
-		updateTTL(a, newTTL)
+	msg := r.entry.Copy()
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			ttl := int64(rr.Header().Ttl) - int64(elapsed)
+			updateTTL(rr, uint32(max(ttl, 0)))
+		}
 	}
-	for _, ns := range r.entry.Ns {
-		updateTTL(ns, newTTL)
-	}
-	for _, x := range r.entry.Extra {
-		updateTTL(x, newTTL)
-	}
-	return r.entry
+	return msg
 }
 
 func updateTTL(record dns.RR, newTTL uint32) {
 	switch rr := record.(type) {
 	case *dns.OPT:
 		return
-	case *dns.SOA:
-		rr.Header().Ttl = newTTL
-		rr.Minttl = newTTL
 	default:
 		rr.Header().Ttl = newTTL
 	}
@@ -0,0 +1,940 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ValidationState is the DNSSEC security status of a response (RFC 4035
+// Section 4.3).
+type ValidationState int
+
+const (
+	// the response was not validated
+	Indeterminate ValidationState = iota
+	// the response is from an unsigned zone, or from a zone signed with no
+	// supported algorithm
+	Insecure
+	// every record of the response was verified from the trust anchors
+	Secure
+	// the signatures of the response are missing or fail to verify
+	Bogus
+)
+
+const ValidatorMinCacheTTL = 30
+const ValidatorMaxCacheTTL = 3600
+const ValidatorMaxCacheSize = 4096
+
+// RFC 9276 Section 3.2: zones with more iterations are treated as unsigned
+const MaxNSEC3Iterations = 150
+
+// RFC 5155 Section 3.1.2.1: the Opt-Out flag of NSEC3
+const NSEC3OptOut = 1
+
+// the kinds of denial of existence proven by NSEC or NSEC3 records
+const (
+	denialNone = iota
+	// the name exists, but not with the type
+	denialNoData
+	denialNXDomain
+	// the name is a delegation without DS, or may be one (Opt-Out)
+	denialInsecureDelegation
+)
+
+func (vs ValidationState) String() string {
+	switch vs {
+	case Insecure:
+		return "insecure"
+	case Secure:
+		return "secure"
+	case Bogus:
+		return "bogus"
+	default:
+		return "indeterminate"
+	}
+}
+
+// combine returns the state of a response made of parts in both states.
+func (vs ValidationState) combine(other ValidationState) ValidationState {
+	for _, weakest := range []ValidationState{Bogus, Indeterminate,
+		Insecure} {
+		if vs == weakest || other == weakest {
+			return weakest
+		}
+	}
+	return Secure
+}
+
+// Validator checks the DNSSEC signatures of the responses, following the
+// chain of DS and DNSKEY records from the root trust anchors (RFC 4035
+// Section 5). The records of the chain are queried through the client, with
+// the checking disabled so that bogus data is returned to be rejected here.
+type Validator struct {
+	client  DNSClient
+	anchors *TrustAnchors
+	lookups map[dns.Question]cachedLookup
+	zones   map[string]*zoneSecurity
+	sync.Mutex
+}
+
+type cachedLookup struct {
+	resp   *dns.Msg
+	expiry time.Time
+}
+
+// zoneSecurity is the validated DNSKEY set of a zone, or the reason there
+// is none.
+type zoneSecurity struct {
+	state  ValidationState
+	keys   []*dns.DNSKEY
+	err    error
+	expiry time.Time
+}
+
+// signedRRset is a set of records of the same owner, class and type, with
+// the signatures covering it.
+type signedRRset struct {
+	rrs  []dns.RR
+	sigs []*dns.RRSIG
+}
+
+// verifyFunc verifies the signatures of an RRset.
+type verifyFunc func(set *signedRRset) (*dns.RRSIG, ValidationState, error)
+
+func NewValidator(client DNSClient, anchors *TrustAnchors) *Validator {
+	return &Validator{
+		client:  client,
+		anchors: anchors,
+		lookups: make(map[dns.Question]cachedLookup),
+		zones:   make(map[string]*zoneSecurity),
+	}
+}
+
+// Validate returns the security status of the response, and the reason it
+// is not secure, if known.
+func (v *Validator) Validate(ctx context.Context, resp *dns.Msg) (
+	ValidationState, error) {
+	if resp == nil || len(resp.Question) != 1 ||
+		(resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError) {
+		return Indeterminate, nil
+	}
+	q := resp.Question[0]
+	// the signatures are not RRsets to verify on their own
+	if q.Qtype == dns.TypeRRSIG {
+		return Indeterminate, nil
+	}
+	verify := func(set *signedRRset) (*dns.RRSIG, ValidationState, error) {
+		return v.verifyRRset(ctx, set)
+	}
+	state := Secure
+	var reason error
+	sets := groupRRsets(resp.Answer)
+	for _, set := range sets {
+		if len(set.sigs) == 0 && isSynthesizedCNAME(sets, set) {
+			// RFC 6672 Section 5.3.1: it is covered by the signed DNAME
+			continue
+		}
+		st, err := v.verifyData(ctx, resp, set, verify)
+		state = state.combine(st)
+		if err != nil {
+			reason = err
+		}
+		if state == Bogus {
+			return Bogus, reason
+		}
+	}
+	if name := answerChainEnd(sets, q.Name, q.Qtype); name != "" {
+		st, err := v.verifyDenial(ctx, resp, name, q.Qtype, verify)
+		state = state.combine(st)
+		if err != nil {
+			reason = err
+		}
+	}
+	return state, reason
+}
+
+// verifyData verifies an RRset of the answer. Unsigned records are only
+// accepted from unsigned zones, and a record expanded from a wildcard needs
+// the proof that its name does not exist (RFC 4035 Section 5.3.4).
+func (v *Validator) verifyData(ctx context.Context, resp *dns.Msg,
+	set *signedRRset, verify verifyFunc) (ValidationState, error) {
+	if len(set.sigs) == 0 {
+		state, err := v.zoneState(ctx, set.name())
+		if state == Secure {
+			return Bogus, fmt.Errorf("no signature for %s in a signed zone",
+				set)
+		}
+		return state, err
+	}
+	sig, state, err := verify(set)
+	if state != Secure || !isWildcardExpansion(set.name(), sig) {
+		return state, err
+	}
+	nsecs, nsec3s, state, err := denialRecords(resp, verify)
+	if state != Secure {
+		return state, err
+	}
+	for _, nsec := range nsecs {
+		if nsecCovers(nsec, set.name()) {
+			return Secure, nil
+		}
+	}
+	closest := lastLabels(set.name(), int(sig.Labels))
+	nsec3 := nsec3Covering(nsec3s, childName(set.name(), closest))
+	if nsec3 != nil {
+		if nsec3.Flags&NSEC3OptOut != 0 {
+			return Insecure, nil
+		}
+		return Secure, nil
+	}
+	return Bogus, fmt.Errorf("no proof that %s does not exist for the "+
+		"wildcard answer", set.name())
+}
+
+// verifyDenial verifies that the name does not exist, or not with the type,
+// as the response says.
+func (v *Validator) verifyDenial(ctx context.Context, resp *dns.Msg,
+	name string, qtype uint16, verify verifyFunc) (ValidationState, error) {
+	if !hasSignatures(resp.Ns) {
+		state, err := v.zoneState(ctx, name)
+		if state == Secure {
+			return Bogus, fmt.Errorf(
+				"unsigned denial of existence for %s in a signed zone", name)
+		}
+		return state, err
+	}
+	proof, state, err := proveDenial(resp, name, qtype, verify)
+	switch {
+	case state != Secure:
+		return state, err
+	case proof == denialInsecureDelegation:
+		return Insecure, nil
+	case (proof == denialNXDomain) != (resp.Rcode == dns.RcodeNameError):
+		return Bogus, fmt.Errorf("the denial of existence for %s does not "+
+			"match %s", name, dns.RcodeToString[resp.Rcode])
+	}
+	return Secure, nil
+}
+
+// verifyRRset verifies the RRset with the keys of the zone that signed it.
+// It returns the signature that verified.
+func (v *Validator) verifyRRset(ctx context.Context, set *signedRRset) (
+	*dns.RRSIG, ValidationState, error) {
+	owner := set.name()
+	err := fmt.Errorf("no signature for %s", set)
+	for _, sig := range set.sigs {
+		signer := dns.CanonicalName(sig.SignerName)
+		// RFC 4035 Section 5.3.1: the DS records are signed by the parent
+		if !dns.IsSubDomain(signer, owner) ||
+			(set.rrtype() == dns.TypeDS && signer == owner) {
+			err = fmt.Errorf("%s signed by %s out of its zone", set, signer)
+			continue
+		}
+		zs := v.zoneKeys(ctx, signer)
+		switch zs.state {
+		case Secure:
+		case Bogus:
+			err = zs.err
+			continue
+		default:
+			return nil, zs.state, zs.err
+		}
+		if verr := verifySignature(set, sig, zs.keys); verr != nil {
+			err = verr
+			continue
+		}
+		return sig, Secure, nil
+	}
+	return nil, Bogus, err
+}
+
+// zoneKeys returns the validated DNSKEY set of the zone.
+func (v *Validator) zoneKeys(ctx context.Context, zone string) *zoneSecurity {
+	if zs := v.cachedZone(zone); zs != nil {
+		return zs
+	}
+	var zs *zoneSecurity
+	if zone == "." {
+		zs = v.rootKeys(ctx)
+	} else {
+		zs = v.delegatedKeys(ctx, zone)
+	}
+	v.storeZone(ctx, zone, zs)
+	return zs
+}
+
+// rootKeys validates the DNSKEY set of the root zone with the trust
+// anchors, and tracks its key signing keys for the rollover.
+func (v *Validator) rootKeys(ctx context.Context) *zoneSecurity {
+	resp, err := v.query(ctx, ".", dns.TypeDNSKEY)
+	if err != nil {
+		return bogusZone(err)
+	}
+	set := findRRset(groupRRsets(resp.Answer), ".", dns.TypeDNSKEY)
+	if set == nil {
+		return bogusZone(errors.New("no DNSKEY for the root zone"))
+	}
+	keys := set.dnskeys()
+	trusted := v.anchors.TrustedKeys(keys)
+	if len(trusted) == 0 {
+		return bogusZone(errors.New(
+			"no DNSKEY of the root zone matches the trust anchors"))
+	}
+	if err = verifyAnySignature(set, trusted); err != nil {
+		return bogusZone(fmt.Errorf("%s: %w", set, err))
+	}
+	v.anchors.Update(keys, set.sigs)
+	return secureZone(set)
+}
+
+// delegatedKeys validates the DNSKEY set of the zone from the DS records of
+// its parent. A zone without them is unsigned, if the parent proves it.
+func (v *Validator) delegatedKeys(ctx context.Context,
+	zone string) *zoneSecurity {
+	resp, err := v.query(ctx, zone, dns.TypeDS)
+	if err != nil {
+		return bogusZone(err)
+	}
+	ds := findRRset(groupRRsets(resp.Answer), zone, dns.TypeDS)
+	if ds == nil || len(ds.sigs) == 0 {
+		state, err := v.zoneState(ctx, zone)
+		if state == Secure {
+			err = fmt.Errorf("no signed DS for the signer %s", zone)
+			state = Bogus
+		}
+		return &zoneSecurity{state: state, err: err}
+	}
+	if _, state, err := v.verifyRRset(ctx, ds); state != Secure {
+		return &zoneSecurity{state: state, err: err}
+	}
+	return v.keysFromDS(ctx, zone, ds)
+}
+
+// keysFromDS validates the DNSKEY set of the zone with its validated DS
+// records. A zone with no DS of a supported algorithm is treated as
+// unsigned (RFC 4035 Section 5.2).
+func (v *Validator) keysFromDS(ctx context.Context, zone string,
+	ds *signedRRset) *zoneSecurity {
+	supported := make([]*dns.DS, 0, len(ds.rrs))
+	for _, rr := range ds.rrs {
+		if d, ok := rr.(*dns.DS); ok && isSupportedAlgorithm(d.Algorithm) &&
+			isSupportedDigest(d.DigestType) {
+			supported = append(supported, d)
+		}
+	}
+	if len(supported) == 0 {
+		return &zoneSecurity{state: Insecure,
+			expiry: cacheExpiry(ds.rrs)}
+	}
+	resp, err := v.query(ctx, zone, dns.TypeDNSKEY)
+	if err != nil {
+		return bogusZone(err)
+	}
+	set := findRRset(groupRRsets(resp.Answer), zone, dns.TypeDNSKEY)
+	if set == nil {
+		return bogusZone(fmt.Errorf("no DNSKEY for %s", zone))
+	}
+	sep := make([]*dns.DNSKEY, 0, len(supported))
+	for _, key := range set.dnskeys() {
+		for _, d := range supported {
+			if matchesDS(key, d) {
+				sep = append(sep, key)
+				break
+			}
+		}
+	}
+	if len(sep) == 0 {
+		return bogusZone(fmt.Errorf("no DNSKEY of %s matches its DS", zone))
+	}
+	if err = verifyAnySignature(set, sep); err != nil {
+		return bogusZone(fmt.Errorf("%s: %w", set, err))
+	}
+	return secureZone(set)
+}
+
+// zoneState returns the security status of the zone containing the name,
+// for the records that came without signatures. The zone cuts are found
+// from the root down by asking for the DS records of each ancestor of the
+// name, until a delegation is proven to be unsigned.
+func (v *Validator) zoneState(ctx context.Context, name string) (
+	ValidationState, error) {
+	zs := v.zoneKeys(ctx, ".")
+	if zs.state != Secure {
+		return zs.state, zs.err
+	}
+	zone := "."
+	verify := func(set *signedRRset) (*dns.RRSIG, ValidationState, error) {
+		for _, sig := range set.sigs {
+			// only the zone found so far is trusted for the step
+			if dns.CanonicalName(sig.SignerName) != zone {
+				continue
+			}
+			if err := verifySignature(set, sig, zs.keys); err == nil {
+				return sig, Secure, nil
+			}
+		}
+		return nil, Bogus, fmt.Errorf("no valid signature of %s by %s", set,
+			zone)
+	}
+	labels := dns.SplitDomainName(dns.CanonicalName(name))
+	for i := len(labels) - 1; i >= 0; i-- {
+		n := dns.Fqdn(strings.Join(labels[i:], "."))
+		resp, err := v.query(ctx, n, dns.TypeDS)
+		if err != nil {
+			return Bogus, err
+		}
+		sets := groupRRsets(resp.Answer)
+		if ds := findRRset(sets, n, dns.TypeDS); ds != nil {
+			if _, state, err := verify(ds); state != Secure {
+				return state, err
+			}
+			child := v.cachedZone(n)
+			if child == nil {
+				child = v.keysFromDS(ctx, n, ds)
+				v.storeZone(ctx, n, child)
+			}
+			if child.state != Secure {
+				return child.state, child.err
+			}
+			zone, zs = n, child
+			continue
+		}
+		// nothing can be delegated below an alias
+		if cname := findRRset(sets, n, dns.TypeCNAME); cname != nil {
+			_, state, err := verify(cname)
+			return state, err
+		}
+		proof, state, err := proveDenial(resp, n, dns.TypeDS, verify)
+		if state != Secure {
+			return state, err
+		}
+		switch proof {
+		case denialInsecureDelegation:
+			return Insecure, nil
+		case denialNXDomain:
+			return Secure, nil
+		}
+	}
+	return Secure, nil
+}
+
+// query sends the query for the records of the chain of trust, and caches
+// the response for the TTL of its records.
+func (v *Validator) query(ctx context.Context, name string, qtype uint16) (
+	*dns.Msg, error) {
+	q := dns.Question{Name: dns.CanonicalName(name), Qtype: qtype,
+		Qclass: dns.ClassINET}
+	v.Lock()
+	cached, ok := v.lookups[q]
+	v.Unlock()
+	if ok && time.Now().Before(cached.expiry) {
+		return cached.resp, nil
+	}
+	req := new(dns.Msg)
+	req.SetQuestion(q.Name, qtype)
+	req.SetEdns0(EDNS_BUFFER_SIZE, true)
+	req.CheckingDisabled = true
+	resp, err := v.client.ExchangeContext(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query %s %s: %w", q.Name,
+			dns.TypeToString[qtype], err)
+	}
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("%s for %s %s",
+			dns.RcodeToString[resp.Rcode], q.Name, dns.TypeToString[qtype])
+	}
+	expiry := cacheExpiry(append(CloneSlice(resp.Answer), resp.Ns...))
+	v.Lock()
+	if len(v.lookups) >= ValidatorMaxCacheSize {
+		v.lookups = make(map[dns.Question]cachedLookup)
+	}
+	v.lookups[q] = cachedLookup{resp: resp, expiry: expiry}
+	v.Unlock()
+	return resp, nil
+}
+
+func (v *Validator) cachedZone(zone string) *zoneSecurity {
+	v.Lock()
+	defer v.Unlock()
+	zs, ok := v.zones[zone]
+	if !ok || !time.Now().Before(zs.expiry) {
+		return nil
+	}
+	return zs
+}
+
+// storeZone caches the keys of the zone, unless they could not be found
+// because the query was cut short.
+func (v *Validator) storeZone(ctx context.Context, zone string,
+	zs *zoneSecurity) {
+	if ctx.Err() != nil {
+		return
+	}
+	if zs.expiry.IsZero() {
+		zs.expiry = time.Now().Add(ValidatorMinCacheTTL * time.Second)
+	}
+	v.Lock()
+	defer v.Unlock()
+	if len(v.zones) >= ValidatorMaxCacheSize {
+		v.zones = make(map[string]*zoneSecurity)
+	}
+	v.zones[zone] = zs
+}
+
+func secureZone(set *signedRRset) *zoneSecurity {
+	keys := make([]*dns.DNSKEY, 0, len(set.rrs))
+	for _, key := range set.dnskeys() {
+		if key.Flags&dns.ZONE != 0 && key.Flags&dns.REVOKE == 0 {
+			keys = append(keys, key)
+		}
+	}
+	return &zoneSecurity{state: Secure, keys: keys,
+		expiry: cacheExpiry(set.rrs)}
+}
+
+func bogusZone(err error) *zoneSecurity {
+	return &zoneSecurity{state: Bogus, err: err}
+}
+
+// cacheExpiry returns the expiry of the records of the chain of trust, by
+// their lowest TTL within the cache limits of the validator.
+func cacheExpiry(rrs []dns.RR) time.Time {
+	ttl := uint32(ValidatorMaxCacheTTL)
+	for _, rr := range rrs {
+		if rr.Header().Rrtype != dns.TypeOPT && rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+	if ttl < ValidatorMinCacheTTL {
+		ttl = ValidatorMinCacheTTL
+	}
+	return time.Now().Add(time.Duration(ttl) * time.Second)
+}
+
+// proveDenial checks the NSEC or NSEC3 records of the response for the
+// proof that the name does not exist, or not with the type.
+func proveDenial(resp *dns.Msg, name string, qtype uint16,
+	verify verifyFunc) (int, ValidationState, error) {
+	nsecs, nsec3s, state, err := denialRecords(resp, verify)
+	if state != Secure {
+		return denialNone, state, err
+	}
+	name = dns.CanonicalName(name)
+	switch {
+	case len(nsecs) > 0:
+		return proveNSECDenial(nsecs, name, qtype)
+	case len(nsec3s) > 0:
+		return proveNSEC3Denial(nsec3s, name, qtype)
+	}
+	return denialNone, Bogus, fmt.Errorf("no denial of existence for %s",
+		name)
+}
+
+// denialRecords returns the verified NSEC and NSEC3 records of the
+// authority section.
+func denialRecords(resp *dns.Msg, verify verifyFunc) ([]*dns.NSEC,
+	[]*dns.NSEC3, ValidationState, error) {
+	nsecs := make([]*dns.NSEC, 0)
+	nsec3s := make([]*dns.NSEC3, 0)
+	for _, set := range groupRRsets(resp.Ns) {
+		switch set.rrtype() {
+		case dns.TypeNSEC, dns.TypeNSEC3:
+		default:
+			continue
+		}
+		if _, state, err := verify(set); state != Secure {
+			return nil, nil, state, err
+		}
+		for _, rr := range set.rrs {
+			switch r := rr.(type) {
+			case *dns.NSEC:
+				nsecs = append(nsecs, r)
+			case *dns.NSEC3:
+				nsec3s = append(nsec3s, r)
+			}
+		}
+	}
+	return nsecs, nsec3s, Secure, nil
+}
+
+// proveNSECDenial follows RFC 4035 Section 5.4.
+func proveNSECDenial(nsecs []*dns.NSEC, name string, qtype uint16) (int,
+	ValidationState, error) {
+	for _, nsec := range nsecs {
+		if dns.CanonicalName(nsec.Hdr.Name) == name {
+			return bitmapDenial(nsec.TypeBitMap, name, qtype)
+		}
+	}
+	for _, nsec := range nsecs {
+		if !nsecCovers(nsec, name) {
+			continue
+		}
+		next := dns.CanonicalName(nsec.NextDomain)
+		// an empty non-terminal exists without any record
+		if next != name && dns.IsSubDomain(name, next) {
+			return denialNoData, Secure, nil
+		}
+		closest := lastLabels(name, max(
+			dns.CompareDomainName(name, nsec.Hdr.Name),
+			dns.CompareDomainName(name, next)))
+		wildcard := wildcardName(closest)
+		for _, w := range nsecs {
+			if dns.CanonicalName(w.Hdr.Name) == wildcard {
+				return bitmapDenial(w.TypeBitMap, wildcard, qtype)
+			}
+		}
+		for _, w := range nsecs {
+			if nsecCovers(w, wildcard) {
+				return denialNXDomain, Secure, nil
+			}
+		}
+		return denialNone, Bogus, fmt.Errorf(
+			"no NSEC proof that %s does not exist", wildcard)
+	}
+	return denialNone, Bogus, fmt.Errorf("no NSEC for %s", name)
+}
+
+// proveNSEC3Denial follows RFC 5155 Section 8.
+func proveNSEC3Denial(nsec3s []*dns.NSEC3, name string, qtype uint16) (int,
+	ValidationState, error) {
+	supported := make([]*dns.NSEC3, 0, len(nsec3s))
+	for _, nsec3 := range nsec3s {
+		if nsec3.Hash != dns.SHA1 {
+			continue
+		}
+		if nsec3.Iterations > MaxNSEC3Iterations {
+			return denialNone, Insecure, nil
+		}
+		supported = append(supported, nsec3)
+	}
+	if len(supported) == 0 {
+		return denialNone, Insecure, nil
+	}
+	if nsec3 := nsec3Matching(supported, name); nsec3 != nil {
+		return bitmapDenial(nsec3.TypeBitMap, name, qtype)
+	}
+	// the closest encloser proof (RFC 5155 Section 7.2.1)
+	closest := name
+	for closest != "." {
+		closest = parentName(closest)
+		if nsec3Matching(supported, closest) != nil {
+			break
+		}
+	}
+	if nsec3Matching(supported, closest) == nil {
+		return denialNone, Bogus, fmt.Errorf(
+			"no NSEC3 closest encloser of %s", name)
+	}
+	cover := nsec3Covering(supported, childName(name, closest))
+	if cover == nil {
+		return denialNone, Bogus, fmt.Errorf(
+			"no NSEC3 proof that %s does not exist", name)
+	}
+	optOut := cover.Flags&NSEC3OptOut != 0
+	// RFC 5155 Section 8.6: the name may be an unsigned delegation
+	if optOut && qtype == dns.TypeDS {
+		return denialInsecureDelegation, Secure, nil
+	}
+	wildcard := wildcardName(closest)
+	if nsec3 := nsec3Matching(supported, wildcard); nsec3 != nil {
+		return bitmapDenial(nsec3.TypeBitMap, wildcard, qtype)
+	}
+	if nsec3Covering(supported, wildcard) == nil {
+		return denialNone, Bogus, fmt.Errorf(
+			"no NSEC3 proof that %s does not exist", wildcard)
+	}
+	if optOut {
+		return denialNXDomain, Insecure, nil
+	}
+	return denialNXDomain, Secure, nil
+}
+
+// bitmapDenial checks the types of the name from the NSEC or NSEC3 record
+// matching it.
+func bitmapDenial(bitmap []uint16, name string, qtype uint16) (int,
+	ValidationState, error) {
+	if hasType(bitmap, qtype) || hasType(bitmap, dns.TypeCNAME) {
+		return denialNone, Bogus, fmt.Errorf("%s has the type %s", name,
+			dns.TypeToString[qtype])
+	}
+	// RFC 4035 Section 5.2: the parent side of a delegation without DS
+	if qtype == dns.TypeDS && hasType(bitmap, dns.TypeNS) &&
+		!hasType(bitmap, dns.TypeSOA) {
+		return denialInsecureDelegation, Secure, nil
+	}
+	return denialNoData, Secure, nil
+}
+
+// nsecCovers checks if the name falls between the owner and the next name
+// of the NSEC record, in the canonical order.
+func nsecCovers(nsec *dns.NSEC, name string) bool {
+	owner := dns.CanonicalName(nsec.Hdr.Name)
+	next := dns.CanonicalName(nsec.NextDomain)
+	name = dns.CanonicalName(name)
+	// RFC 6840 Section 4.1: a delegation proves nothing below it
+	if owner != name && dns.IsSubDomain(owner, name) &&
+		hasType(nsec.TypeBitMap, dns.TypeNS) &&
+		!hasType(nsec.TypeBitMap, dns.TypeSOA) {
+		return false
+	}
+	if canonicalCompare(owner, next) < 0 {
+		return canonicalCompare(owner, name) < 0 &&
+			canonicalCompare(name, next) < 0
+	}
+	// the last NSEC of the zone points back to its apex
+	return canonicalCompare(owner, name) < 0 && dns.IsSubDomain(next, name)
+}
+
+func nsec3Matching(nsec3s []*dns.NSEC3, name string) *dns.NSEC3 {
+	for _, nsec3 := range nsec3s {
+		if nsec3.Match(name) {
+			return nsec3
+		}
+	}
+	return nil
+}
+
+func nsec3Covering(nsec3s []*dns.NSEC3, name string) *dns.NSEC3 {
+	for _, nsec3 := range nsec3s {
+		if nsec3.Cover(name) {
+			return nsec3
+		}
+	}
+	return nil
+}
+
+// canonicalCompare orders the names as in RFC 4034 Section 6.1, comparing
+// their labels from the rightmost one.
+func canonicalCompare(a, b string) int {
+	la := dns.SplitDomainName(dns.CanonicalName(a))
+	lb := dns.SplitDomainName(dns.CanonicalName(b))
+	for i, j := len(la)-1, len(lb)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if c := strings.Compare(la[i], lb[j]); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+// verifySignature verifies the signature over the RRset with the keys of
+// its signer.
+func verifySignature(set *signedRRset, sig *dns.RRSIG,
+	keys []*dns.DNSKEY) error {
+	if int(sig.Labels) > dns.CountLabel(set.name()) {
+		return fmt.Errorf("invalid label count in the signature of %s", set)
+	}
+	if !sig.ValidityPeriod(time.Now()) {
+		return fmt.Errorf("the signature of %s is expired or not yet valid",
+			set)
+	}
+	err := fmt.Errorf("no DNSKEY %d of %s for %s", sig.KeyTag,
+		sig.SignerName, set)
+	for _, key := range keys {
+		if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm {
+			continue
+		}
+		if err = sig.Verify(key, set.rrs); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// verifyAnySignature verifies the RRset with any of the keys.
+func verifyAnySignature(set *signedRRset, keys []*dns.DNSKEY) error {
+	err := errors.New("no signature by a trusted key")
+	for _, sig := range set.sigs {
+		if err = verifySignature(set, sig, keys); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// isSignedBy checks if the RRset carries a valid signature by the key.
+func isSignedBy(rrset []dns.RR, sigs []*dns.RRSIG, key *dns.DNSKEY) bool {
+	set := &signedRRset{rrs: rrset, sigs: sigs}
+	return verifyAnySignature(set, []*dns.DNSKEY{key}) == nil
+}
+
+func isSupportedAlgorithm(alg uint8) bool {
+	switch alg {
+	case dns.RSASHA1, dns.RSASHA1NSEC3SHA1, dns.RSASHA256, dns.RSASHA512,
+		dns.ECDSAP256SHA256, dns.ECDSAP384SHA384, dns.ED25519:
+		return true
+	}
+	return false
+}
+
+func isSupportedDigest(digest uint8) bool {
+	switch digest {
+	case dns.SHA1, dns.SHA256, dns.SHA384:
+		return true
+	}
+	return false
+}
+
+// isWildcardExpansion checks if the signature was made over a wildcard the
+// name was expanded from (RFC 4035 Section 5.3.2).
+func isWildcardExpansion(name string, sig *dns.RRSIG) bool {
+	labels := dns.CountLabel(name)
+	if strings.HasPrefix(name, "*.") {
+		labels--
+	}
+	return int(sig.Labels) < labels
+}
+
+// groupRRsets splits the section into RRsets, in the order they appear.
+// Signatures without their RRset are dropped.
+func groupRRsets(section []dns.RR) []*signedRRset {
+	type rrsetKey struct {
+		name   string
+		rrtype uint16
+	}
+	byKey := make(map[rrsetKey]*signedRRset)
+	order := make([]rrsetKey, 0)
+	for _, rr := range section {
+		hdr := rr.Header()
+		k := rrsetKey{name: dns.CanonicalName(hdr.Name), rrtype: hdr.Rrtype}
+		sig, isSig := rr.(*dns.RRSIG)
+		if isSig {
+			k.rrtype = sig.TypeCovered
+		}
+		if hdr.Rrtype == dns.TypeOPT {
+			continue
+		}
+		set, ok := byKey[k]
+		if !ok {
+			set = &signedRRset{}
+			byKey[k] = set
+			order = append(order, k)
+		}
+		if isSig {
+			set.sigs = append(set.sigs, sig)
+		} else {
+			set.rrs = append(set.rrs, rr)
+		}
+	}
+	sets := make([]*signedRRset, 0, len(order))
+	for _, k := range order {
+		if set := byKey[k]; len(set.rrs) > 0 {
+			sets = append(sets, set)
+		}
+	}
+	return sets
+}
+
+func findRRset(sets []*signedRRset, name string,
+	rrtype uint16) *signedRRset {
+	name = dns.CanonicalName(name)
+	for _, set := range sets {
+		if set.name() == name && set.rrtype() == rrtype {
+			return set
+		}
+	}
+	return nil
+}
+
+// answerChainEnd follows the CNAME chain of the answer from the name, and
+// returns the name it ends with if it has no record of the type, or "" if
+// the answer is complete.
+func answerChainEnd(sets []*signedRRset, name string, qtype uint16) string {
+	name = dns.CanonicalName(name)
+	for i := 0; i <= RecursionMaxCNAMEs; i++ {
+		for _, set := range sets {
+			if set.name() == name &&
+				(set.rrtype() == qtype || qtype == dns.TypeANY) {
+				return ""
+			}
+		}
+		cname := findRRset(sets, name, dns.TypeCNAME)
+		if cname == nil {
+			return name
+		}
+		name = dns.CanonicalName(cname.rrs[0].(*dns.CNAME).Target)
+	}
+	return ""
+}
+
+// isSynthesizedCNAME checks if the CNAME was synthesized from a DNAME of
+// the answer (RFC 6672 Section 2.2).
+func isSynthesizedCNAME(sets []*signedRRset, set *signedRRset) bool {
+	if set.rrtype() != dns.TypeCNAME {
+		return false
+	}
+	target := dns.CanonicalName(set.rrs[0].(*dns.CNAME).Target)
+	for _, s := range sets {
+		if s.rrtype() != dns.TypeDNAME || len(s.sigs) == 0 ||
+			s.name() == set.name() || !dns.IsSubDomain(s.name(), set.name()) {
+			continue
+		}
+		dname := dns.CanonicalName(s.rrs[0].(*dns.DNAME).Target)
+		prefix := strings.TrimSuffix(set.name(), s.name())
+		if target == dns.CanonicalName(prefix+dname) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasSignatures(section []dns.RR) bool {
+	for _, rr := range section {
+		if rr.Header().Rrtype == dns.TypeRRSIG {
+			return true
+		}
+	}
+	return false
+}
+
+func hasType(bitmap []uint16, rrtype uint16) bool {
+	for _, t := range bitmap {
+		if t == rrtype {
+			return true
+		}
+	}
+	return false
+}
+
+// lastLabels returns the ancestor of the name with the given number of
+// labels.
+func lastLabels(name string, n int) string {
+	labels := dns.SplitDomainName(name)
+	if n <= 0 || len(labels) == 0 {
+		return "."
+	}
+	return dns.Fqdn(strings.Join(labels[len(labels)-n:], "."))
+}
+
+func wildcardName(name string) string {
+	if name == "." {
+		return "*."
+	}
+	return "*." + name
+}
+
+func (set *signedRRset) name() string {
+	return dns.CanonicalName(set.rrs[0].Header().Name)
+}
+
+func (set *signedRRset) rrtype() uint16 {
+	return set.rrs[0].Header().Rrtype
+}
+
+func (set *signedRRset) dnskeys() []*dns.DNSKEY {
+	keys := make([]*dns.DNSKEY, 0, len(set.rrs))
+	for _, rr := range set.rrs {
+		if key, ok := rr.(*dns.DNSKEY); ok {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func (set *signedRRset) String() string {
+	return set.name() + " " + dns.TypeToString[set.rrtype()]
+}
@@ -0,0 +1,565 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"fmt"
+	"github.com/miekg/dns"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testSigner is a DNSSEC key with its private key.
+type testSigner struct {
+	key  *dns.DNSKEY
+	priv crypto.Signer
+}
+
+func newTestSigner(t *testing.T, zone string, flags uint16) *testSigner {
+	t.Helper()
+	key := &dns.DNSKEY{
+		Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY,
+			Class: dns.ClassINET, Ttl: 3600},
+		Flags:     flags,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testSigner{key: key, priv: priv.(crypto.Signer)}
+}
+
+func (s *testSigner) sign(t *testing.T, rrset []dns.RR) *dns.RRSIG {
+	t.Helper()
+	now := time.Now()
+	sig := &dns.RRSIG{
+		Hdr: dns.RR_Header{Name: rrset[0].Header().Name,
+			Rrtype: dns.TypeRRSIG, Class: dns.ClassINET,
+			Ttl: rrset[0].Header().Ttl},
+		KeyTag:     s.key.KeyTag(),
+		SignerName: s.key.Hdr.Name,
+		Algorithm:  s.key.Algorithm,
+		Inception:  uint32(now.Add(-time.Hour).Unix()),
+		Expiration: uint32(now.Add(time.Hour).Unix()),
+	}
+	if err := sig.Sign(s.priv, rrset); err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
+
+// testZone is a zone signed in-process, or unsigned if it has no keys. The
+// DNSKEY set is signed by every key signing key, the rest by the zone
+// signing key.
+type testZone struct {
+	name    string
+	ksks    []*testSigner
+	zsk     *testSigner
+	nsec3   bool
+	records map[string][]dns.RR
+}
+
+func newTestZone(t *testing.T, name string, signed bool) *testZone {
+	t.Helper()
+	z := &testZone{name: name, records: make(map[string][]dns.RR)}
+	// the names under the root have no label to prepend a dot to
+	suffix := strings.TrimPrefix(name, ".")
+	z.add(t, fmt.Sprintf("%s 300 IN SOA ns.%s host.%s 1 2 3 4 300", name,
+		suffix, suffix))
+	if signed {
+		z.ksks = []*testSigner{newTestSigner(t, name, dns.ZONE|dns.SEP)}
+		z.zsk = newTestSigner(t, name, dns.ZONE)
+		z.addRR(z.ksks[0].key)
+		z.addRR(z.zsk.key)
+	}
+	return z
+}
+
+func testRRKey(name string, rrtype uint16) string {
+	return dns.CanonicalName(name) + " " + dns.TypeToString[rrtype]
+}
+
+func (z *testZone) add(t *testing.T, s string) {
+	t.Helper()
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	z.addRR(rr)
+}
+
+func (z *testZone) addRR(rr dns.RR) {
+	k := testRRKey(rr.Header().Name, rr.Header().Rrtype)
+	z.records[k] = append(z.records[k], rr)
+}
+
+// delegate adds the NS records of the child, and its DS record if signed.
+func (z *testZone) delegate(t *testing.T, child *testZone) {
+	t.Helper()
+	z.add(t, child.name+" 300 IN NS ns."+child.name)
+	if len(child.ksks) > 0 {
+		ds := child.ksks[0].key.ToDS(dns.SHA256)
+		ds.Hdr.Ttl = 300
+		z.addRR(ds)
+	}
+}
+
+func (z *testZone) signed() bool {
+	return z.zsk != nil
+}
+
+func (z *testZone) signRRset(t *testing.T, rrset []dns.RR) []dns.RR {
+	t.Helper()
+	if !z.signed() {
+		return rrset
+	}
+	signed := CloneSlice(rrset)
+	if rrset[0].Header().Rrtype != dns.TypeDNSKEY {
+		return append(signed, z.zsk.sign(t, rrset))
+	}
+	for _, ksk := range z.ksks {
+		signed = append(signed, ksk.sign(t, rrset))
+	}
+	return signed
+}
+
+// names returns the owner names of the zone in the canonical order.
+func (z *testZone) names() []string {
+	seen := make(map[string]struct{})
+	names := make([]string, 0, len(z.records))
+	for k := range z.records {
+		name, _, _ := strings.Cut(k, " ")
+		if _, ok := seen[name]; !ok {
+			seen[name] = struct{}{}
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return canonicalCompare(names[i], names[j]) < 0
+	})
+	return names
+}
+
+func (z *testZone) types(name string) []uint16 {
+	var types []uint16
+	for k, rrset := range z.records {
+		if owner, _, _ := strings.Cut(k, " "); owner == name {
+			types = append(types, rrset[0].Header().Rrtype)
+		}
+	}
+	types = append(types, dns.TypeRRSIG)
+	if !z.nsec3 {
+		types = append(types, dns.TypeNSEC)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	return types
+}
+
+// denialRecords returns the NSEC or NSEC3 chain of the zone.
+func (z *testZone) denialRecords() []dns.RR {
+	names := z.names()
+	chain := make([]dns.RR, 0, len(names))
+	if !z.nsec3 {
+		for i, name := range names {
+			chain = append(chain, &dns.NSEC{
+				Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC,
+					Class: dns.ClassINET, Ttl: 300},
+				NextDomain: names[(i+1)%len(names)],
+				TypeBitMap: z.types(name),
+			})
+		}
+		return chain
+	}
+	hashes := make([]string, len(names))
+	byHash := make(map[string]string, len(names))
+	for i, name := range names {
+		hashes[i] = dns.HashName(name, dns.SHA1, 1, "AB")
+		byHash[hashes[i]] = name
+	}
+	sort.Strings(hashes)
+	for i, hash := range hashes {
+		chain = append(chain, &dns.NSEC3{
+			Hdr: dns.RR_Header{Name: strings.ToLower(hash) + "." + z.name,
+				Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 300},
+			Hash:       dns.SHA1,
+			Iterations: 1,
+			SaltLength: 1,
+			Salt:       "AB",
+			HashLength: 20,
+			NextDomain: hashes[(i+1)%len(hashes)],
+			TypeBitMap: z.types(byHash[hash]),
+		})
+	}
+	return chain
+}
+
+// testZoneClient answers the queries from the zones, as an upstream
+// resolver with the checking disabled would.
+type testZoneClient struct {
+	t     *testing.T
+	zones []*testZone
+	// changes the responses before they are returned
+	tamper func(c *testZoneClient, q dns.Question, resp *dns.Msg)
+}
+
+func (c *testZoneClient) ExchangeContext(ctx context.Context,
+	req *dns.Msg) (*dns.Msg, error) {
+	q := req.Question[0]
+	resp := c.answer(req)
+	if c.tamper != nil {
+		c.tamper(c, q, resp)
+	}
+	return resp, nil
+}
+
+// zone returns the zone answering for the name. A DS record is answered by
+// the parent zone.
+func (c *testZoneClient) zone(name string, qtype uint16) *testZone {
+	var best *testZone
+	for _, z := range c.zones {
+		if !dns.IsSubDomain(z.name, name) ||
+			(qtype == dns.TypeDS && z.name == name && name != ".") {
+			continue
+		}
+		if best == nil ||
+			dns.CountLabel(z.name) > dns.CountLabel(best.name) {
+			best = z
+		}
+	}
+	return best
+}
+
+func (c *testZoneClient) answer(req *dns.Msg) *dns.Msg {
+	q := req.Question[0]
+	name := dns.CanonicalName(q.Name)
+	z := c.zone(name, q.Qtype)
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	if rrset, ok := z.records[testRRKey(name, q.Qtype)]; ok {
+		resp.Answer = z.signRRset(c.t, rrset)
+		return resp
+	}
+	if rrset, ok := z.records[testRRKey(name, dns.TypeCNAME)]; ok {
+		resp.Answer = z.signRRset(c.t, rrset)
+		return resp
+	}
+	exists := false
+	for k := range z.records {
+		if strings.HasPrefix(k, name+" ") {
+			exists = true
+		}
+	}
+	wildcard := z.records[testRRKey(wildcardName(parentName(name)),
+		q.Qtype)]
+	if !exists && len(wildcard) > 0 {
+		for _, rr := range z.signRRset(c.t, wildcard) {
+			rr = dns.Copy(rr)
+			rr.Header().Name = name
+			resp.Answer = append(resp.Answer, rr)
+		}
+		// the proof that the name itself does not exist
+		for _, rr := range z.denialRecords() {
+			if nsec, ok := rr.(*dns.NSEC); ok && nsecCovers(nsec, name) {
+				resp.Ns = append(resp.Ns,
+					z.signRRset(c.t, []dns.RR{rr})...)
+			}
+		}
+		return resp
+	}
+	if !exists {
+		resp.Rcode = dns.RcodeNameError
+	}
+	resp.Ns = z.signRRset(c.t, z.records[testRRKey(z.name, dns.TypeSOA)])
+	// the whole chain, from which the validator picks the proof
+	if z.signed() {
+		for _, rr := range z.denialRecords() {
+			resp.Ns = append(resp.Ns, z.signRRset(c.t, []dns.RR{rr})...)
+		}
+	}
+	return resp
+}
+
+// newTestZoneClient sets up a signed root with a signed example. zone using
+// NSEC, a signed n3. zone using NSEC3, and an unsigned insecure. zone. The
+// returned anchors trust the root key signing key.
+func newTestZoneClient(t *testing.T) (*testZoneClient, *TrustAnchors) {
+	root := newTestZone(t, ".", true)
+	example := newTestZone(t, "example.", true)
+	n3 := newTestZone(t, "n3.", true)
+	n3.nsec3 = true
+	insecure := newTestZone(t, "insecure.", false)
+	for _, z := range []*testZone{example, n3, insecure} {
+		root.delegate(t, z)
+	}
+	example.add(t, "example. 300 IN A 192.0.2.1")
+	example.add(t, "www.example. 300 IN CNAME example.")
+	example.add(t, "*.wild.example. 300 IN A 192.0.2.9")
+	n3.add(t, "a.n3. 300 IN A 192.0.2.3")
+	insecure.add(t, "www.insecure. 300 IN A 192.0.2.2")
+	c := &testZoneClient{t: t, zones: []*testZone{root, example, n3,
+		insecure}}
+	return c, newTestTrustAnchors(t, root.ksks[0].key.ToDS(dns.SHA256))
+}
+
+func newTestTrustAnchors(t *testing.T, ds *dns.DS) *TrustAnchors {
+	t.Helper()
+	cfg := &DNSSECConfig{TrustAnchors: []string{ds.String()}}
+	if err := VerifyDNSSECConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	anchors, err := NewTrustAnchors(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return anchors
+}
+
+// validate queries the client as a resolver would, following a CNAME, and
+// validates the response.
+func validate(t *testing.T, c *testZoneClient, v *Validator, name string,
+	qtype uint16) (ValidationState, error) {
+	t.Helper()
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	req.SetEdns0(EDNS_BUFFER_SIZE, true)
+	resp, _ := c.ExchangeContext(context.Background(), req)
+	if len(resp.Answer) > 0 && qtype != dns.TypeCNAME {
+		if cname, ok := resp.Answer[0].(*dns.CNAME); ok {
+			req.SetQuestion(cname.Target, qtype)
+			target, _ := c.ExchangeContext(context.Background(), req)
+			resp.Answer = append(resp.Answer, target.Answer...)
+			resp.Ns, resp.Rcode = target.Ns, target.Rcode
+		}
+	}
+	return v.Validate(context.Background(), resp)
+}
+
+func TestValidatorChain(t *testing.T) {
+	tests := []struct {
+		name   string
+		qname  string
+		qtype  uint16
+		tamper func(c *testZoneClient, q dns.Question, resp *dns.Msg)
+		want   ValidationState
+	}{
+		{name: "signed address", qname: "example.", qtype: dns.TypeA,
+			want: Secure},
+		{name: "mixed case name", qname: "eXaMpLe.", qtype: dns.TypeA,
+			want: Secure},
+		{name: "CNAME chain", qname: "www.example.", qtype: dns.TypeA,
+			want: Secure},
+		{name: "DNSKEY set", qname: "example.", qtype: dns.TypeDNSKEY,
+			want: Secure},
+		{name: "DS set", qname: "example.", qtype: dns.TypeDS,
+			want: Secure},
+		{name: "insecure delegation", qname: "www.insecure.",
+			qtype: dns.TypeA, want: Insecure},
+		{name: "modified address", qname: "example.", qtype: dns.TypeA,
+			tamper: func(c *testZoneClient, q dns.Question, resp *dns.Msg) {
+				if q.Qtype == dns.TypeA {
+					resp.Answer[0].(*dns.A).A = []byte{192, 0, 2, 66}
+				}
+			},
+			want: Bogus},
+		{name: "stripped signature", qname: "example.", qtype: dns.TypeA,
+			tamper: func(c *testZoneClient, q dns.Question, resp *dns.Msg) {
+				if q.Qtype == dns.TypeA {
+					resp.Answer = resp.Answer[:1]
+				}
+			},
+			want: Bogus},
+		{name: "stripped DS of a signed zone", qname: "example.",
+			qtype: dns.TypeA,
+			tamper: func(c *testZoneClient, q dns.Question, resp *dns.Msg) {
+				if q.Qtype == dns.TypeDS {
+					resp.Answer = nil
+				}
+			},
+			want: Bogus},
+		{name: "DNSKEY set signed by an unknown key", qname: "example.",
+			qtype: dns.TypeA,
+			tamper: func(c *testZoneClient, q dns.Question, resp *dns.Msg) {
+				if q.Name == "." && q.Qtype == dns.TypeDNSKEY {
+					ksk := newTestSigner(c.t, ".", dns.ZONE|dns.SEP)
+					resp.Answer = []dns.RR{ksk.key,
+						ksk.sign(c.t, []dns.RR{ksk.key})}
+				}
+			},
+			want: Bogus},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, anchors := newTestZoneClient(t)
+			c.tamper = tt.tamper
+			v := NewValidator(c, anchors)
+			got, err := validate(t, c, v, tt.qname, tt.qtype)
+			if got != tt.want {
+				t.Errorf("got %s (%v), want %s", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidatorDenial(t *testing.T) {
+	tests := []struct {
+		name   string
+		qname  string
+		qtype  uint16
+		tamper func(c *testZoneClient, q dns.Question, resp *dns.Msg)
+		want   ValidationState
+		rcode  int
+	}{
+		{name: "NSEC NXDOMAIN", qname: "nx.example.", qtype: dns.TypeA,
+			want: Secure, rcode: dns.RcodeNameError},
+		{name: "NSEC NODATA", qname: "example.", qtype: dns.TypeMX,
+			want: Secure},
+		{name: "NSEC wildcard expansion", qname: "a.wild.example.",
+			qtype: dns.TypeA, want: Secure},
+		{name: "NSEC NXDOMAIN in the root", qname: "nx.", qtype: dns.TypeA,
+			want: Secure, rcode: dns.RcodeNameError},
+		{name: "NSEC3 NXDOMAIN", qname: "b.n3.", qtype: dns.TypeA,
+			want: Secure, rcode: dns.RcodeNameError},
+		{name: "NSEC3 NODATA", qname: "a.n3.", qtype: dns.TypeMX,
+			want: Secure},
+		{name: "unsigned NXDOMAIN", qname: "nx.insecure.", qtype: dns.TypeA,
+			want: Insecure, rcode: dns.RcodeNameError},
+		{name: "NSEC NXDOMAIN for an existing name", qname: "example.",
+			qtype: dns.TypeA,
+			tamper: func(c *testZoneClient, q dns.Question, resp *dns.Msg) {
+				if q.Qtype == dns.TypeA {
+					req := new(dns.Msg)
+					req.SetQuestion("nx.example.", dns.TypeA)
+					resp.Answer = nil
+					resp.Ns = c.answer(req).Ns
+					resp.Rcode = dns.RcodeNameError
+				}
+			},
+			want: Bogus, rcode: dns.RcodeNameError},
+		{name: "NSEC NODATA for an existing type", qname: "example.",
+			qtype: dns.TypeA,
+			tamper: func(c *testZoneClient, q dns.Question, resp *dns.Msg) {
+				if q.Qtype == dns.TypeA {
+					req := new(dns.Msg)
+					req.SetQuestion(q.Name, dns.TypeMX)
+					resp.Answer = nil
+					resp.Ns = c.answer(req).Ns
+				}
+			},
+			want: Bogus},
+		{name: "NSEC3 NXDOMAIN for an existing name", qname: "a.n3.",
+			qtype: dns.TypeA,
+			tamper: func(c *testZoneClient, q dns.Question, resp *dns.Msg) {
+				if q.Qtype == dns.TypeA {
+					req := new(dns.Msg)
+					req.SetQuestion("b.n3.", dns.TypeA)
+					resp.Answer = nil
+					resp.Ns = c.answer(req).Ns
+					resp.Rcode = dns.RcodeNameError
+				}
+			},
+			want: Bogus, rcode: dns.RcodeNameError},
+		{name: "wildcard expansion without the proof",
+			qname: "a.wild.example.", qtype: dns.TypeA,
+			tamper: func(c *testZoneClient, q dns.Question, resp *dns.Msg) {
+				if q.Qtype == dns.TypeA {
+					resp.Ns = nil
+				}
+			},
+			want: Bogus},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, anchors := newTestZoneClient(t)
+			c.tamper = tt.tamper
+			v := NewValidator(c, anchors)
+			got, err := validate(t, c, v, tt.qname, tt.qtype)
+			if got != tt.want {
+				t.Errorf("got %s (%v), want %s", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrustAnchorRollover(t *testing.T) {
+	c, anchors := newTestZoneClient(t)
+	anchors.file = filepath.Join(t.TempDir(), "anchors.json")
+	root := c.zones[0]
+	oldKSK := root.ksks[0]
+	newKSK := newTestSigner(t, ".", dns.ZONE|dns.SEP)
+	revoked := dns.Copy(oldKSK.key).(*dns.DNSKEY)
+	revoked.Flags |= dns.REVOKE
+	steps := []struct {
+		name    string
+		change  func()
+		key     *dns.DNSKEY
+		state   string
+		trusted bool
+	}{
+		{name: "configured key is valid", change: func() {},
+			key: oldKSK.key, state: AnchorValid, trusted: true},
+		{name: "new key is pending",
+			change: func() {
+				root.ksks = append(root.ksks, newKSK)
+				root.addRR(newKSK.key)
+			},
+			key: newKSK.key, state: AnchorAddPend},
+		{name: "pending key before the hold-down",
+			change: func() {
+				anchors.tracked[anchorKeyID(newKSK.key)].FirstSeen =
+					time.Now().Add(-29 * 24 * time.Hour)
+			},
+			key: newKSK.key, state: AnchorAddPend},
+		{name: "pending key after the hold-down",
+			change: func() {
+				anchors.tracked[anchorKeyID(newKSK.key)].FirstSeen =
+					time.Now().Add(-31 * 24 * time.Hour)
+			},
+			key: newKSK.key, state: AnchorValid, trusted: true},
+		{name: "self-signed revocation",
+			change: func() {
+				root.ksks[0] = &testSigner{key: revoked, priv: oldKSK.priv}
+				k := testRRKey(".", dns.TypeDNSKEY)
+				for i, rr := range root.records[k] {
+					if rr == oldKSK.key {
+						root.records[k][i] = revoked
+					}
+				}
+			},
+			key: oldKSK.key, state: AnchorRevoked},
+	}
+	for _, step := range steps {
+		step.change()
+		// a new validator does not have the root DNSKEY set cached
+		got, err := validate(t, c, NewValidator(c, anchors), "example.",
+			dns.TypeA)
+		if got != Secure {
+			t.Fatalf("%s: got %s (%v), want secure", step.name, got, err)
+		}
+		ak := anchors.tracked[anchorKeyID(step.key)]
+		if ak == nil || ak.State != step.state {
+			t.Fatalf("%s: got %v, want %s", step.name, ak, step.state)
+		}
+		trusted := len(anchors.TrustedKeys([]*dns.DNSKEY{step.key})) > 0
+		if trusted != step.trusted {
+			t.Fatalf("%s: trusted %t, want %t", step.name, trusted,
+				step.trusted)
+		}
+	}
+	// the keys learned through the rollover are kept in the file
+	saved, err := NewTrustAnchors(&DNSSECConfig{
+		TrustAnchorFile: anchors.file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved.TrustedKeys([]*dns.DNSKEY{newKSK.key})) != 1 {
+		t.Error("the new key is not trusted after reloading the file")
+	}
+	if len(saved.TrustedKeys([]*dns.DNSKEY{oldKSK.key})) != 0 {
+		t.Error("the revoked key is trusted after reloading the file")
+	}
+}
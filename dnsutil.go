@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/rand"
 	"fmt"
 	"github.com/miekg/dns"
 	"log"
@@ -53,11 +54,7 @@ func CreateServFailResp(req *dns.Msg) *dns.Msg {
 	}
 	resp := new(dns.Msg)
 	resp.SetRcode(req, dns.RcodeServerFailure)
-	if opt := req.IsEdns0(); opt != nil {
-		resp.SetEdns0(opt.UDPSize(), opt.Do())
-	} else {
-		resp.SetEdns0(EDNS_BUFFER_SIZE, true)
-	}
+	SetRespEdns0(req, resp)
 	return resp
 }
 
@@ -67,11 +64,7 @@ func CreateNXResp(req *dns.Msg) *dns.Msg {
 	}
 	resp := new(dns.Msg)
 	resp.SetRcode(req, dns.RcodeNameError)
-	if opt := req.IsEdns0(); opt != nil {
-		resp.SetEdns0(opt.UDPSize(), opt.Do())
-	} else {
-		resp.SetEdns0(EDNS_BUFFER_SIZE, true)
-	}
+	SetRespEdns0(req, resp)
 	return resp
 }
 
@@ -88,17 +81,29 @@ func CreateRespFromResp(req *dns.Msg, origResp *dns.Msg) *dns.Msg {
 	resp.Compress = true
 	resp.Answer = CloneSlice(origResp.Answer)
 	resp.Ns = CloneSlice(origResp.Ns)
-	resp.Extra = CloneSlice(origResp.Extra)
-	if opt := origResp.IsEdns0(); opt != nil {
-		resp.SetEdns0(opt.UDPSize(), opt.Do())
-	} else if opt = req.IsEdns0(); opt != nil {
-		resp.SetEdns0(opt.UDPSize(), opt.Do())
-	} else {
-		resp.SetEdns0(EDNS_BUFFER_SIZE, true)
+	// RFC 6840 Section 5.8: AD only for the clients asking for it
+	reqOpt := req.IsEdns0()
+	resp.AuthenticatedData = origResp.AuthenticatedData &&
+		(req.AuthenticatedData || (reqOpt != nil && reqOpt.Do()))
+	// RFC 6891: OPT is hop-by-hop, so only its flags are carried over
+	resp.Extra = make([]dns.RR, 0, len(origResp.Extra)+1)
+	for _, rr := range origResp.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			resp.Extra = append(resp.Extra, rr)
+		}
 	}
+	SetRespEdns0(req, resp)
 	return resp
 }
 
+// SetRespEdns0 adds OPT to the response if the query has one (RFC 6891
+// Section 7), with our buffer size and the DO bit of the query.
+func SetRespEdns0(req *dns.Msg, resp *dns.Msg) {
+	if opt := req.IsEdns0(); opt != nil {
+		resp.SetEdns0(EDNS_BUFFER_SIZE, opt.Do())
+	}
+}
+
 func CreateRespWithAnswer(req *dns.Msg, answer dns.RR) *dns.Msg {
 	if req == nil {
 		return nil
@@ -108,27 +113,98 @@ func CreateRespWithAnswer(req *dns.Msg, answer dns.RR) *dns.Msg {
 	resp.Answer = make([]dns.RR, 0, 1)
 	resp.Answer = append(resp.Answer, answer)
 	resp.Extra = make([]dns.RR, 0, 1)
-	if opt := req.IsEdns0(); opt != nil {
-		resp.SetEdns0(opt.UDPSize(), opt.Do())
-	} else {
-		resp.SetEdns0(EDNS_BUFFER_SIZE, true)
-	}
+	SetRespEdns0(req, resp)
 	return resp
 }
 
-func CreateUpstreamRequest(req *dns.Msg) *dns.Msg {
+// CreateUpstreamRequest creates the query to send upstream for the request,
+// with the ECS option if given. The upstream is left to check the DNSSEC
+// signatures, unless they are validated locally.
+func CreateUpstreamRequest(req *dns.Msg, ecs *dns.EDNS0_SUBNET) *dns.Msg {
 	uReq := new(dns.Msg)
 	uReq.Id = dns.Id()
 	uReq.Opcode = req.Opcode
 	uReq.Question = CloneSlice(req.Question)
 	uReq.Extra = make([]dns.RR, 0, 1)
 	uReq.SetEdns0(EDNS_BUFFER_SIZE, true)
+	if ecs != nil {
+		opt := uReq.IsEdns0()
+		opt.Option = append(opt.Option, ecs)
+	}
 	uReq.AuthenticatedData = true
 	uReq.RecursionDesired = true
-	uReq.CheckingDisabled = true
 	return uReq
 }
 
+// RandomizeCase flips the case of the letters in the name at random (DNS
+// 0x20 encoding), adding a bit of entropy per letter against spoofing.
+func RandomizeCase(name string) string {
+	bits := make([]byte, len(name))
+	if _, err := rand.Read(bits); err != nil {
+		return name
+	}
+	mixed := []byte(name)
+	for i, ch := range mixed {
+		if ('a' <= ch && ch <= 'z') || ('A' <= ch && ch <= 'Z') {
+			if bits[i]&1 == 1 {
+				mixed[i] = ch ^ 0x20
+			}
+		}
+	}
+	return string(mixed)
+}
+
+// RestoreCase sets the question name back to the given casing, along with
+// the names at or below it in the records, which the server may have
+// copied from the question, such as CNAME targets and RRSIG signer names.
+func RestoreCase(resp *dns.Msg, name string) {
+	for i := range resp.Question {
+		resp.Question[i].Name = name
+	}
+	for _, section := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range section {
+			hdr := rr.Header()
+			hdr.Name = restoreNameCase(hdr.Name, name)
+			switch rr := rr.(type) {
+			case *dns.CNAME:
+				rr.Target = restoreNameCase(rr.Target, name)
+			case *dns.DNAME:
+				rr.Target = restoreNameCase(rr.Target, name)
+			case *dns.RRSIG:
+				rr.SignerName = restoreNameCase(rr.SignerName, name)
+			case *dns.NSEC:
+				rr.NextDomain = restoreNameCase(rr.NextDomain, name)
+			case *dns.NS:
+				rr.Ns = restoreNameCase(rr.Ns, name)
+			case *dns.SOA:
+				rr.Ns = restoreNameCase(rr.Ns, name)
+				rr.Mbox = restoreNameCase(rr.Mbox, name)
+			case *dns.MX:
+				rr.Mx = restoreNameCase(rr.Mx, name)
+			case *dns.SRV:
+				rr.Target = restoreNameCase(rr.Target, name)
+			case *dns.PTR:
+				rr.Ptr = restoreNameCase(rr.Ptr, name)
+			}
+		}
+	}
+}
+
+// restoreNameCase sets the part of the domain name matching the given name,
+// if it is at or below it, back to the casing of the name.
+func restoreNameCase(domain string, name string) string {
+	if len(domain) < len(name) {
+		return domain
+	}
+	cut := len(domain) - len(name)
+	prefix := domain[:cut]
+	if !strings.EqualFold(domain[cut:], name) ||
+		(prefix != "" && name != "." && !strings.HasSuffix(prefix, ".")) {
+		return domain
+	}
+	return prefix + name
+}
+
 func CreateBlockedResp(req *dns.Msg) *dns.Msg {
 	switch req.Question[0].Qtype {
 	case dns.TypeA:
@@ -253,3 +329,18 @@ CheckIP:
 	}
 	return false
 }
+
+// RemoveEDNSOption removes the EDNS options with the code from the message.
+func RemoveEDNSOption(msg *dns.Msg, code uint16) {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return
+	}
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if o.Option() != code {
+			options = append(options, o)
+		}
+	}
+	opt.Option = options
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"testing"
+)
+
+func TestRestoreCase(t *testing.T) {
+	const name = "www.Example.com."
+	resp := new(dns.Msg)
+	resp.SetQuestion("wWw.ExAmPlE.cOm.", dns.TypeA)
+	resp.Answer = testRRs(t,
+		"wWw.ExAmPlE.cOm. 300 IN CNAME cdn.wWw.ExAmPlE.cOm.",
+		"cdn.wWw.ExAmPlE.cOm. 300 IN A 192.0.2.1",
+		"cdn.wWw.ExAmPlE.cOm. 300 IN RRSIG A 13 4 300 20300101000000 "+
+			"20200101000000 12345 wWw.ExAmPlE.cOm. AAAA",
+		// names outside of the question are left as the server sent them
+		"aWww.ExAmPlE.cOm. 300 IN A 192.0.2.2",
+		"ExAmPlE.cOm. 300 IN NS ns.ExAmPlE.cOm.",
+	)
+	RestoreCase(resp, name)
+	want := []string{
+		"www.Example.com.\t300\tIN\tCNAME\tcdn.www.Example.com.",
+		"cdn.www.Example.com.\t300\tIN\tA\t192.0.2.1",
+		"cdn.www.Example.com.\t300\tIN\tRRSIG\tA 13 4 300 20300101000000 " +
+			"20200101000000 12345 www.Example.com. AAAA",
+		"aWww.ExAmPlE.cOm.\t300\tIN\tA\t192.0.2.2",
+		"ExAmPlE.cOm.\t300\tIN\tNS\tns.ExAmPlE.cOm.",
+	}
+	if resp.Question[0].Name != name {
+		t.Errorf("got the question %s, want %s", resp.Question[0].Name, name)
+	}
+	for i, rr := range resp.Answer {
+		if rr.String() != want[i] {
+			t.Errorf("got %s, want %s", rr.String(), want[i])
+		}
+	}
+}
+
+func TestRestoreNameCase(t *testing.T) {
+	tests := []struct {
+		domain string
+		name   string
+		want   string
+	}{
+		{domain: "ExAmPlE.", name: "example.", want: "example."},
+		{domain: "A.ExAmPlE.", name: "example.", want: "A.example."},
+		{domain: "aExAmPlE.", name: "example.", want: "aExAmPlE."},
+		{domain: "ExAmPlE.", name: "a.example.", want: "ExAmPlE."},
+		{domain: "ExAmPlE.", name: ".", want: "ExAmPlE."},
+	}
+	for _, tt := range tests {
+		if got := restoreNameCase(tt.domain, tt.name); got != tt.want {
+			t.Errorf("%s under %s: got %s, want %s", tt.domain, tt.name, got,
+				tt.want)
+		}
+	}
+}
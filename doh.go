@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+const DoHMediaType = "application/dns-message"
+const DoHDefaultPath = "/dns-query"
+const DoHQueryParam = "dns"
+const DoHMaxMsgSize = 65535
+const DoHReadTimeoutMillis = 5000
+const DoHIdleTimeoutMillis = 120000
+
+// DoHServer serves DNS-over-HTTPS (RFC 8484) queries over HTTP/2. Without a
+// certificate, it serves cleartext HTTP/2 (h2c) for use behind a proxy.
+type DoHServer struct {
+	server *http.Server
+	tlsCfg *tls.Config
+}
+
+// DoHHandler decodes DNS-over-HTTPS requests and feeds them to a dns.Handler.
+type DoHHandler struct {
+	handler        dns.Handler
+	trustedProxies []netip.Prefix
+}
+
+func NewDoHServer(lc *ServerConfig, handler dns.Handler) (*DoHServer,
+	error) {
+	addr := net.TCPAddr{IP: lc.IP, Port: int(lc.Port)}
+	path := lc.Path
+	if path == "" {
+		path = DoHDefaultPath
+	}
+	mux := http.NewServeMux()
+	mux.Handle(path, &DoHHandler{
+		handler:        handler,
+		trustedProxies: lc.TrustedProxies,
+	})
+	ds := &DoHServer{
+		server: &http.Server{
+			Addr:        addr.String(),
+			ReadTimeout: DoHReadTimeoutMillis * time.Millisecond,
+			IdleTimeout: DoHIdleTimeoutMillis * time.Millisecond,
+		},
+	}
+	if lc.CertFile == "" {
+		ds.server.Handler = h2c.NewHandler(mux, &http2.Server{})
+		return ds, nil
+	}
+	cr, err := NewCertReloader(lc.CertFile, lc.KeyFile,
+		lc.GenerateCert, CertHosts(lc))
+	if err != nil {
+		return nil, err
+	}
+	ds.tlsCfg = cr.TLSConfig()
+	ds.server.Handler = mux
+	ds.server.TLSConfig = ds.tlsCfg
+	return ds, nil
+}
+
+func (ds *DoHServer) ListenAndServe(notifyStarted func()) error {
+	ln, err := net.Listen(TCPProto, ds.server.Addr)
+	if err != nil {
+		return err
+	}
+	notifyStarted()
+	if ds.tlsCfg != nil {
+		err = ds.server.ServeTLS(ln, "", "")
+	} else {
+		err = ds.server.Serve(ln)
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+func (ds *DoHServer) Shutdown(ctx context.Context) error {
+	return ds.server.Shutdown(ctx)
+}
+
+func (ds *DoHServer) String() string {
+	if ds.tlsCfg != nil {
+		return fmt.Sprintf("%s server at %s", HTTPSProto, ds.server.Addr)
+	}
+	return fmt.Sprintf("h2c server at %s", ds.server.Addr)
+}
+
+func (dh *DoHHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	req, status, err := ParseDoHRequest(r)
+	if err != nil {
+		http.Error(rw, err.Error(), status)
+		return
+	}
+	w := &bufferedResponseWriter{
+		ctx:        r.Context(),
+		localAddr:  localAddrFromRequest(r),
+		remoteAddr: dh.ClientAddr(r),
+	}
+	dh.handler.ServeDNS(w, req)
+	if w.resp == nil {
+		http.Error(rw, "no DNS response", http.StatusInternalServerError)
+		return
+	}
+	// the h2c server is not encrypted
+	if r.TLS != nil {
+		PadResponse(req, w.resp)
+	}
+	packed, err := w.resp.Pack()
+	if err != nil {
+		log.Printf("Unable to pack DoH response for %s: %s",
+			req.Question[0].String(), err.Error())
+		http.Error(rw, "invalid DNS response", http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", DoHMediaType)
+	rw.Header().Set("Cache-Control",
+		fmt.Sprintf("max-age=%d", MinMsgTTL(w.resp)))
+	if _, err = rw.Write(packed); err != nil {
+		log.Printf("Error while writing DoH response for %s: %s",
+			req.Question[0].String(), err.Error())
+	}
+}
+
+// ParseDoHRequest decodes the DNS query from a GET or POST request. On
+// failure, it also returns the HTTP status code to respond with.
+func ParseDoHRequest(r *http.Request) (*dns.Msg, int, error) {
+	var packed []byte
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		encoded := r.URL.Query().Get(DoHQueryParam)
+		if encoded == "" {
+			return nil, http.StatusBadRequest,
+				fmt.Errorf("missing %s query parameter", DoHQueryParam)
+		}
+		packed, err = base64.RawURLEncoding.DecodeString(
+			strings.TrimRight(encoded, "="))
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+	case http.MethodPost:
+		mediaType, _, perr := mime.ParseMediaType(
+			r.Header.Get("Content-Type"))
+		if perr != nil || mediaType != DoHMediaType {
+			return nil, http.StatusUnsupportedMediaType,
+				fmt.Errorf("unsupported content type")
+		}
+		packed, err = io.ReadAll(io.LimitReader(r.Body, DoHMaxMsgSize+1))
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		if len(packed) > DoHMaxMsgSize {
+			return nil, http.StatusRequestEntityTooLarge,
+				fmt.Errorf("DNS message too large")
+		}
+	default:
+		return nil, http.StatusMethodNotAllowed,
+			fmt.Errorf("unsupported method %s", r.Method)
+	}
+	req := new(dns.Msg)
+	if err = req.Unpack(packed); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	if len(req.Question) != 1 {
+		return nil, http.StatusBadRequest,
+			fmt.Errorf("%w: %d", InvalidQuestionError, len(req.Question))
+	}
+	return req, http.StatusOK, nil
+}
+
+// ClientAddr returns the address of the DoH client. If the peer is a trusted
+// proxy, the rightmost untrusted address in X-Forwarded-For is used instead.
+func (dh *DoHHandler) ClientAddr(r *http.Request) net.Addr {
+	peer, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	if !dh.isTrustedProxy(peer.Addr()) {
+		return net.TCPAddrFromAddrPort(peer)
+	}
+	forwarded := strings.Split(
+		strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr, perr := netip.ParseAddr(strings.TrimSpace(forwarded[i]))
+		if perr != nil {
+			break
+		}
+		if !dh.isTrustedProxy(addr) {
+			return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, 0))
+		}
+	}
+	return net.TCPAddrFromAddrPort(peer)
+}
+
+func (dh *DoHHandler) isTrustedProxy(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range dh.trustedProxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func localAddrFromRequest(r *http.Request) net.Addr {
+	if addr, ok := r.Context().Value(
+		http.LocalAddrContextKey).(net.Addr); ok {
+		return addr
+	}
+	return &net.TCPAddr{}
+}
+
+// MinMsgTTL returns the smallest TTL among the records of a message.
+func MinMsgTTL(msg *dns.Msg) uint32 {
+	var minTTL uint32 = DefaultMaxTTL
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if ttl := rr.Header().Ttl; ttl < minTTL {
+				minTTL = ttl
+			}
+		}
+	}
+	if len(msg.Answer) == 0 && len(msg.Ns) == 0 {
+		return DefaultNegativeCacheTTL
+	}
+	return minTTL
+}
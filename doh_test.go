@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"github.com/miekg/dns"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestParseDoHRequest(t *testing.T) {
+	query := new(dns.Msg)
+	query.SetQuestion("example.", dns.TypeA)
+	packed, _ := query.Pack()
+	twoQuestions := query.Copy()
+	twoQuestions.Question = append(twoQuestions.Question,
+		dns.Question{Name: "example.", Qtype: dns.TypeAAAA,
+			Qclass: dns.ClassINET})
+	packedTwo, _ := twoQuestions.Pack()
+	encoded := base64.RawURLEncoding.EncodeToString(packed)
+	tests := []struct {
+		name        string
+		method      string
+		target      string
+		contentType string
+		body        []byte
+		want        int
+	}{
+		{name: "GET", method: http.MethodGet,
+			target: "/dns-query?dns=" + encoded, want: http.StatusOK},
+		{name: "GET with base64 padding", method: http.MethodGet,
+			target: "/dns-query?dns=" +
+				base64.URLEncoding.EncodeToString(packed),
+			want: http.StatusOK},
+		{name: "GET without the parameter", method: http.MethodGet,
+			target: "/dns-query", want: http.StatusBadRequest},
+		{name: "GET with invalid base64", method: http.MethodGet,
+			target: "/dns-query?dns=%21%21", want: http.StatusBadRequest},
+		{name: "POST", method: http.MethodPost, target: "/dns-query",
+			contentType: DoHMediaType, body: packed, want: http.StatusOK},
+		{name: "POST with another content type", method: http.MethodPost,
+			target: "/dns-query", contentType: "text/plain", body: packed,
+			want: http.StatusUnsupportedMediaType},
+		{name: "POST too large", method: http.MethodPost,
+			target: "/dns-query", contentType: DoHMediaType,
+			body: make([]byte, DoHMaxMsgSize+1),
+			want: http.StatusRequestEntityTooLarge},
+		{name: "POST not a DNS message", method: http.MethodPost,
+			target: "/dns-query", contentType: DoHMediaType,
+			body: []byte{1, 2, 3}, want: http.StatusBadRequest},
+		{name: "POST with two questions", method: http.MethodPost,
+			target: "/dns-query", contentType: DoHMediaType,
+			body: packedTwo, want: http.StatusBadRequest},
+		{name: "PUT", method: http.MethodPut, target: "/dns-query",
+			contentType: DoHMediaType, body: packed,
+			want: http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.target,
+				bytes.NewReader(tt.body))
+			if tt.contentType != "" {
+				r.Header.Set("Content-Type", tt.contentType)
+			}
+			req, status, err := ParseDoHRequest(r)
+			if status != tt.want {
+				t.Fatalf("got %d (%v), want %d", status, err, tt.want)
+			}
+			if status == http.StatusOK &&
+				(req.Question[0] != query.Question[0] || req.Id != query.Id) {
+				t.Errorf("got the query %v, want %v", req, query)
+			}
+		})
+	}
+}
+
+func TestDoHClientAddr(t *testing.T) {
+	dh := &DoHHandler{trustedProxies: []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("fd00::/8"),
+	}}
+	tests := []struct {
+		name      string
+		peer      string
+		forwarded []string
+		want      string
+	}{
+		{name: "untrusted peer", peer: "198.51.100.7:4000",
+			forwarded: []string{"203.0.113.9"}, want: "198.51.100.7"},
+		{name: "trusted proxy", peer: "10.0.0.1:4000",
+			forwarded: []string{"203.0.113.9"}, want: "203.0.113.9"},
+		{name: "trusted proxy over IPv6", peer: "[fd00::1]:4000",
+			forwarded: []string{"2001:db8::9"}, want: "2001:db8::9"},
+		{name: "rightmost untrusted address", peer: "10.0.0.1:4000",
+			forwarded: []string{"192.0.2.66, 203.0.113.9, 10.0.0.2"},
+			want:      "203.0.113.9"},
+		{name: "several headers", peer: "10.0.0.1:4000",
+			forwarded: []string{"192.0.2.66", "203.0.113.9"},
+			want:      "203.0.113.9"},
+		{name: "invalid address", peer: "10.0.0.1:4000",
+			forwarded: []string{"203.0.113.9, unknown, 10.0.0.2"},
+			want:      "10.0.0.1"},
+		{name: "trusted proxies only", peer: "10.0.0.1:4000",
+			forwarded: []string{"10.0.0.2"}, want: "10.0.0.1"},
+		{name: "no header", peer: "10.0.0.1:4000", want: "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/dns-query", nil)
+			r.RemoteAddr = tt.peer
+			for _, f := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", f)
+			}
+			addr := dh.ClientAddr(r).(*net.TCPAddr)
+			if got := addr.AddrPort().Addr().Unmap().String(); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDoHHandler(t *testing.T) {
+	var remote net.Addr
+	dh := &DoHHandler{
+		handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			remote = w.RemoteAddr()
+			resp := new(dns.Msg)
+			resp.SetReply(req)
+			resp.Answer = testRRs(t, "example. 300 IN A 192.0.2.1",
+				"example. 120 IN A 192.0.2.2")
+			_ = w.WriteMsg(resp)
+		}),
+		trustedProxies: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+	}
+	query := new(dns.Msg)
+	query.SetQuestion("example.", dns.TypeA)
+	packed, _ := query.Pack()
+	r := httptest.NewRequest(http.MethodPost, "/dns-query",
+		bytes.NewReader(packed))
+	r.RemoteAddr = "10.0.0.1:4000"
+	r.Header.Set("Content-Type", DoHMediaType)
+	r.Header.Set("X-Forwarded-For", "203.0.113.9")
+	rec := httptest.NewRecorder()
+	dh.ServeHTTP(rec, r)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body.String())
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != DoHMediaType {
+		t.Errorf("got the content type %s", ct)
+	}
+	// RFC 8484 Section 5.1: fresh for the lowest TTL
+	if cc := rec.Header().Get("Cache-Control"); cc != "max-age=120" {
+		t.Errorf("got the cache control %s, want max-age=120", cc)
+	}
+	resp := new(dns.Msg)
+	if err := resp.Unpack(rec.Body.Bytes()); err != nil ||
+		len(resp.Answer) != 2 {
+		t.Errorf("got the response %v (%v)", resp, err)
+	}
+	if remote == nil || !strings.HasPrefix(remote.String(), "203.0.113.9:") {
+		t.Errorf("the handler got the client %v, want 203.0.113.9", remote)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"github.com/miekg/dns"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DoHDefaultPort = 443
+const DoHIdleConnTimeoutMillis = 90000
+
+// DoHClient is a DNSClient querying a DNS-over-HTTPS (RFC 8484) server.
+// The underlying transport keeps the HTTP/2 connections alive for reuse.
+type DoHClient struct {
+	client    *http.Client
+	serverURL string
+	useGET    bool
+	bootstrap *Bootstrapper
+}
+
+// NewDoHClient creates a DoH client for the URL template of the server. If
+// the server IP is given, connections go to the IP instead of resolving the
+// host name in the URL, which is resolved through the bootstrap servers if
+// there are any. They go through the proxy of the server if any, which
+// resolves the host name itself.
+func NewDoHClient(server *ServerConfig) DNSClient {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// the proxy of the environment would bypass the dialer below
+	transport.Proxy = nil
+	transport.ForceAttemptHTTP2 = true
+	transport.IdleConnTimeout = DoHIdleConnTimeoutMillis * time.Millisecond
+	transport.TLSClientConfig = server.UpstreamTLSConfig()
+	var dialer ContextDialer = &net.Dialer{}
+	if server.proxyDialer != nil {
+		dialer = server.proxyDialer
+	}
+	serverAddr := ""
+	if server.IP != nil {
+		serverAddr = server.String()
+	}
+	var bootstrap *Bootstrapper
+	if serverAddr == "" && server.proxyDialer == nil &&
+		len(server.bootstrapServers) > 0 {
+		bootstrap = NewBootstrapper(server.bootstrapServers)
+	}
+	transport.DialContext = func(ctx context.Context,
+		network, addr string) (net.Conn, error) {
+		if serverAddr != "" {
+			addr = serverAddr
+		} else if bootstrap != nil {
+			return bootstrap.DialContext(ctx, dialer, network, addr)
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}
+	return &DoHClient{
+		client: &http.Client{
+			Transport: transport,
+		},
+		serverURL: DoHURLFromTemplate(server.URL),
+		useGET:    strings.EqualFold(server.Method, http.MethodGet),
+		bootstrap: bootstrap,
+	}
+}
+
+// Close closes the idle connections, and the clients of the bootstrap
+// servers.
+func (c *DoHClient) Close() error {
+	c.client.CloseIdleConnections()
+	if c.bootstrap != nil {
+		c.bootstrap.Close()
+	}
+	return nil
+}
+
+// DoHURLFromTemplate strips the URI template variables, e.g.
+// "https://dns.example/dns-query{?dns}" -> "https://dns.example/dns-query"
+func DoHURLFromTemplate(template string) string {
+	if i := strings.Index(template, "{"); i >= 0 {
+		return template[:i]
+	}
+	return template
+}
+
+func (c *DoHClient) ExchangeContext(ctx context.Context,
+	req *dns.Msg) (*dns.Msg, error) {
+	if c == nil {
+		return nil, fmt.Errorf(
+			"attempted to use uninitialized DNS client")
+	}
+	// RFC 8484: the DNS ID SHOULD be 0 for HTTP cache friendliness.
+	dohReq := req.Copy()
+	dohReq.Id = 0
+	PadMsg(dohReq, QueryPaddingBlock)
+	packed, err := dohReq.Pack()
+	if err != nil {
+		return nil, err
+	}
+	var httpReq *http.Request
+	if c.useGET {
+		u, perr := url.Parse(c.serverURL)
+		if perr != nil {
+			return nil, perr
+		}
+		query := u.Query()
+		query.Set(DoHQueryParam, base64.RawURLEncoding.EncodeToString(packed))
+		u.RawQuery = query.Encode()
+		httpReq, err = http.NewRequestWithContext(ctx, http.MethodGet,
+			u.String(), nil)
+	} else {
+		httpReq, err = http.NewRequestWithContext(ctx, http.MethodPost,
+			c.serverURL, bytes.NewReader(packed))
+		if err == nil {
+			httpReq.Header.Set("Content-Type", DoHMediaType)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Accept", DoHMediaType)
+	httpResp, err := c.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = httpResp.Body.Close()
+	}()
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, NewHTTPFailureError(httpReq.Method, c.serverURL,
+			httpResp.StatusCode)
+	}
+	mediaType, _, err := mime.ParseMediaType(
+		httpResp.Header.Get("Content-Type"))
+	if err != nil || mediaType != DoHMediaType {
+		return nil, fmt.Errorf("invalid DoH response content type from %s",
+			c.serverURL)
+	}
+	body, err := io.ReadAll(io.LimitReader(httpResp.Body, DoHMaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+	resp := new(dns.Msg)
+	if err = resp.Unpack(body); err != nil {
+		return nil, err
+	}
+	resp.Id = req.Id
+	StripPadding(resp)
+	if maxAge, ok := DoHFreshness(httpResp.Header); ok {
+		ClampMsgTTL(resp, maxAge)
+	}
+	return resp, nil
+}
+
+// DoHFreshness returns the remaining freshness lifetime of a DoH response
+// from its Cache-Control max-age and Age headers.
+func DoHFreshness(header http.Header) (uint32, bool) {
+	var maxAge int64 = -1
+	for _, directive := range strings.Split(
+		header.Get("Cache-Control"), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		if !strings.EqualFold(name, "max-age") {
+			continue
+		}
+		v, err := strconv.ParseInt(strings.Trim(value, "\""), 10, 64)
+		if err != nil || v < 0 {
+			return 0, false
+		}
+		maxAge = v
+	}
+	if maxAge < 0 {
+		return 0, false
+	}
+	if age, err := strconv.ParseInt(header.Get("Age"), 10, 64); err == nil {
+		maxAge -= age
+	}
+	if maxAge < 0 {
+		maxAge = 0
+	}
+	if maxAge > DefaultMaxTTL {
+		maxAge = DefaultMaxTTL
+	}
+	return uint32(maxAge), true
+}
+
+// ClampMsgTTL lowers the TTL of every record in the message to at most
+// maxTTL.
+func ClampMsgTTL(msg *dns.Msg, maxTTL uint32) {
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if rr.Header().Ttl > maxTTL {
+				rr.Header().Ttl = maxTTL
+			}
+		}
+	}
+}
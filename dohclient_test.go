@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/pem"
+	"github.com/miekg/dns"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startBootstrapTestServer serves DNS over UDP on a local port, answering
+// the A queries for the host with the loopback address. It keeps the names
+// it was asked.
+func startBootstrapTestServer(t *testing.T, host string) (*ServerConfig,
+	func() []string) {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var names []string
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(
+		func(w dns.ResponseWriter, req *dns.Msg) {
+			q := req.Question[0]
+			mu.Lock()
+			names = append(names, q.Name)
+			mu.Unlock()
+			resp := new(dns.Msg)
+			resp.SetReply(req)
+			if q.Name != dns.Fqdn(host) {
+				resp.Rcode = dns.RcodeNameError
+			} else if q.Qtype == dns.TypeA {
+				resp.Answer = []dns.RR{&dns.A{
+					Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA,
+						Class: dns.ClassINET, Ttl: 300},
+					A: net.IPv4(127, 0, 0, 1),
+				}}
+			}
+			_ = w.WriteMsg(resp)
+		})}
+	go func() { _ = srv.ActivateAndServe() }()
+	t.Cleanup(func() { _ = srv.Shutdown() })
+	server := &ServerConfig{IP: net.IPv4(127, 0, 0, 1),
+		Port: uint16(pc.LocalAddr().(*net.UDPAddr).Port)}
+	if err = VerifyServerConfig(server, "bootstrap server"); err != nil {
+		t.Fatal(err)
+	}
+	return server, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return CloneSlice(names)
+	}
+}
+
+func TestDoHBootstrap(t *testing.T) {
+	// a proxy nobody configured for the DoH upstream is not used
+	t.Setenv("HTTPS_PROXY", "http://127.0.0.1:1")
+	const host = "doh.test"
+	bootstrap, asked := startBootstrapTestServer(t, host)
+	ts := httptest.NewUnstartedServer(&DoHHandler{
+		handler: &doqTestHandler{}})
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+	port := ts.Listener.Addr().(*net.TCPAddr).Port
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE",
+		Bytes: ts.Certificate().Raw})
+	if err := os.WriteFile(caFile, certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	config := &LiteDNSConfig{
+		UpstreamServers: []*ServerConfig{{Proto: HTTPSProto,
+			URL: "https://" + net.JoinHostPort(host, strconv.Itoa(port)) +
+				DoHDefaultPath + "{?dns}",
+			// the name in the certificate of the test server
+			TLSServerName: "example.com", CAFile: caFile}},
+		BootstrapServers: []*ServerConfig{bootstrap},
+	}
+	server := config.UpstreamServers[0]
+	if err := VerifyServerConfig(server, "upstream server"); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyBootstrapServers(config); err != nil {
+		t.Fatal(err)
+	}
+	client := NewDNSClient(server)
+	defer closeClient(client)
+	req := new(dns.Msg)
+	req.SetQuestion("example.", dns.TypeA)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := client.ExchangeContext(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Id != req.Id || len(resp.Answer) != 1 {
+		t.Errorf("unexpected response %v", resp)
+	}
+	// the host in the URL is resolved through the bootstrap server
+	if names := asked(); len(names) == 0 || names[0] != host+"." {
+		t.Errorf("the bootstrap server was asked %v, want %s.", names, host)
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const DoQALPN = "doq"
+const DoQTimeoutMillis = 5000
+const DoQIdleTimeoutMillis = 30000
+
+// RFC 9250 Section 4.3: DoQ error codes
+const (
+	DoQNoError          quic.ApplicationErrorCode = 0x0
+	DoQInternalError    quic.ApplicationErrorCode = 0x1
+	DoQProtocolError    quic.ApplicationErrorCode = 0x2
+	DoQRequestCancelled quic.StreamErrorCode      = 0x3
+)
+
+// DoQClient is a DNSClient querying a DNS-over-QUIC (RFC 9250) server.
+// Every query is sent on its own stream of a shared connection, so a slow
+// response does not hold up the others.
+type DoQClient struct {
+	conn       quic.EarlyConnection
+	tlsCfg     *tls.Config
+	quicCfg    *quic.Config
+	serverAddr string
+	sync.Mutex
+}
+
+// DoQServer serves DNS-over-QUIC queries.
+type DoQServer struct {
+	addr     string
+	handler  dns.Handler
+	tlsCfg   *tls.Config
+	listener *quic.EarlyListener
+	closed   bool
+	sync.Mutex
+}
+
+func NewDoQClient(server *ServerConfig) DNSClient {
+	tlsCfg := server.UpstreamTLSConfig()
+	tlsCfg.NextProtos = []string{DoQALPN}
+	tlsCfg.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	return &DoQClient{
+		tlsCfg: tlsCfg,
+		quicCfg: &quic.Config{
+			MaxIdleTimeout: DoQIdleTimeoutMillis * time.Millisecond,
+		},
+		serverAddr: server.String(),
+	}
+}
+
+func (qc *DoQClient) ExchangeContext(ctx context.Context,
+	req *dns.Msg) (*dns.Msg, error) {
+	if qc == nil {
+		return nil, fmt.Errorf(
+			"attempted to use uninitialized DNS client")
+	}
+	// RFC 9250 Section 4.2.1: the DNS Message ID MUST be set to 0.
+	doqReq := req.Copy()
+	doqReq.Id = 0
+	PadMsg(doqReq, QueryPaddingBlock)
+	packed, err := doqReq.Pack()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := qc.GetOrCreateConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := qc.exchangeOnStream(ctx, conn, packed)
+	if err != nil && conn.Context().Err() != nil {
+		// the connection was closed (e.g. idle timeout); retry on a new one
+		qc.DropConn(conn)
+		if conn, err = qc.GetOrCreateConn(ctx); err != nil {
+			return nil, err
+		}
+		resp, err = qc.exchangeOnStream(ctx, conn, packed)
+	}
+	if err != nil {
+		return nil, err
+	}
+	resp.Id = req.Id
+	StripPadding(resp)
+	return resp, nil
+}
+
+func (qc *DoQClient) exchangeOnStream(ctx context.Context,
+	conn quic.EarlyConnection, packed []byte) (*dns.Msg, error) {
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = stream.SetDeadline(deadline)
+	}
+	if err = WriteLengthPrefixed(stream, packed); err != nil {
+		stream.CancelRead(DoQRequestCancelled)
+		return nil, err
+	}
+	// The client MUST indicate through the STREAM FIN that no further data
+	// will be sent on the stream.
+	if err = stream.Close(); err != nil {
+		stream.CancelRead(DoQRequestCancelled)
+		return nil, err
+	}
+	respBytes, err := ReadLengthPrefixed(stream)
+	if err != nil {
+		stream.CancelRead(DoQRequestCancelled)
+		return nil, err
+	}
+	resp := new(dns.Msg)
+	if err = resp.Unpack(respBytes); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// GetOrCreateConn returns the current connection, or dials a new one.
+// Session resumption allows the new connection to send queries in 0-RTT.
+func (qc *DoQClient) GetOrCreateConn(ctx context.Context) (
+	quic.EarlyConnection, error) {
+	qc.Lock()
+	defer qc.Unlock()
+	if qc.conn != nil && qc.conn.Context().Err() == nil {
+		return qc.conn, nil
+	}
+	conn, err := quic.DialAddrEarly(ctx, qc.serverAddr, qc.tlsCfg,
+		qc.quicCfg)
+	if err != nil {
+		return nil, fmt.Errorf("%w %s: %w", ConnectionError, qc.serverAddr,
+			err)
+	}
+	qc.conn = conn
+	return conn, nil
+}
+
+// DropConn closes the connection if it is still the current one.
+func (qc *DoQClient) DropConn(conn quic.EarlyConnection) {
+	qc.Lock()
+	defer qc.Unlock()
+	if qc.conn == conn {
+		_ = qc.conn.CloseWithError(DoQNoError, "")
+		qc.conn = nil
+	}
+}
+
+// Close closes the connection along with its UDP socket. A later query
+// dials a new one.
+func (qc *DoQClient) Close() error {
+	qc.Lock()
+	defer qc.Unlock()
+	if qc.conn != nil {
+		_ = qc.conn.CloseWithError(DoQNoError, "")
+		qc.conn = nil
+	}
+	return nil
+}
+
+func NewDoQServer(lc *ServerConfig, handler dns.Handler) (*DoQServer,
+	error) {
+	addr := net.UDPAddr{IP: lc.IP, Port: int(lc.Port)}
+	cr, err := NewCertReloader(lc.CertFile, lc.KeyFile,
+		lc.GenerateCert, CertHosts(lc))
+	if err != nil {
+		return nil, err
+	}
+	tlsCfg := cr.TLSConfig()
+	tlsCfg.MinVersion = tls.VersionTLS13
+	tlsCfg.NextProtos = []string{DoQALPN}
+	return &DoQServer{
+		addr:    addr.String(),
+		handler: handler,
+		tlsCfg:  tlsCfg,
+	}, nil
+}
+
+func (qs *DoQServer) ListenAndServe(notifyStarted func()) error {
+	listener, err := quic.ListenAddrEarly(qs.addr, qs.tlsCfg, &quic.Config{
+		MaxIdleTimeout: DoQIdleTimeoutMillis * time.Millisecond,
+		Allow0RTT:      true,
+	})
+	if err != nil {
+		return err
+	}
+	qs.Lock()
+	if qs.closed {
+		qs.Unlock()
+		return listener.Close()
+	}
+	qs.listener = listener
+	qs.Unlock()
+	notifyStarted()
+	for {
+		conn, aerr := listener.Accept(context.Background())
+		if aerr != nil {
+			qs.Lock()
+			closed := qs.closed
+			qs.Unlock()
+			if closed {
+				return nil
+			}
+			return aerr
+		}
+		go qs.serveConn(conn)
+	}
+}
+
+func (qs *DoQServer) serveConn(conn quic.EarlyConnection) {
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		go qs.serveStream(conn, stream)
+	}
+}
+
+func (qs *DoQServer) serveStream(conn quic.EarlyConnection,
+	stream quic.Stream) {
+	_ = stream.SetDeadline(time.Now().Add(
+		DoQTimeoutMillis * time.Millisecond))
+	packed, err := ReadLengthPrefixed(stream)
+	if err != nil {
+		stream.CancelRead(DoQRequestCancelled)
+		stream.CancelWrite(DoQRequestCancelled)
+		return
+	}
+	req := new(dns.Msg)
+	if err = req.Unpack(packed); err != nil || req.Id != 0 {
+		_ = conn.CloseWithError(DoQProtocolError, "invalid DoQ query")
+		return
+	}
+	w := &bufferedResponseWriter{
+		ctx:        stream.Context(),
+		localAddr:  conn.LocalAddr(),
+		remoteAddr: conn.RemoteAddr(),
+	}
+	qs.handler.ServeDNS(w, req)
+	if w.resp == nil {
+		stream.CancelWrite(quic.StreamErrorCode(DoQInternalError))
+		return
+	}
+	PadResponse(req, w.resp)
+	resp, err := w.resp.Pack()
+	if err != nil {
+		log.Printf("Unable to pack DoQ response for %s: %s",
+			req.Question[0].String(), err.Error())
+		stream.CancelWrite(quic.StreamErrorCode(DoQInternalError))
+		return
+	}
+	if err = WriteLengthPrefixed(stream, resp); err != nil {
+		log.Printf("Error while writing DoQ response for %s: %s",
+			req.Question[0].String(), err.Error())
+		stream.CancelWrite(quic.StreamErrorCode(DoQInternalError))
+		return
+	}
+	_ = stream.Close()
+}
+
+func (qs *DoQServer) Shutdown(context.Context) error {
+	qs.Lock()
+	defer qs.Unlock()
+	qs.closed = true
+	if qs.listener == nil {
+		return nil
+	}
+	return qs.listener.Close()
+}
+
+func (qs *DoQServer) String() string {
+	return fmt.Sprintf("%s server at %s", QUICProto, qs.addr)
+}
+
+// WriteLengthPrefixed writes a DNS message with the 2-byte length prefix
+// used by DNS over stream transports.
+func WriteLengthPrefixed(w io.Writer, packed []byte) error {
+	if len(packed) > dns.MaxMsgSize {
+		return errors.New("DNS message too large")
+	}
+	buf := make([]byte, 2, len(packed)+2)
+	binary.BigEndian.PutUint16(buf, uint16(len(packed)))
+	_, err := w.Write(append(buf, packed...))
+	return err
+}
+
+// ReadLengthPrefixed reads a DNS message with the 2-byte length prefix.
+func ReadLengthPrefixed(r io.Reader) ([]byte, error) {
+	var msgLen uint16
+	if err := binary.Read(r, binary.BigEndian, &msgLen); err != nil {
+		return nil, err
+	}
+	packed := make([]byte, msgLen)
+	if _, err := io.ReadFull(r, packed); err != nil {
+		return nil, err
+	}
+	return packed, nil
+}
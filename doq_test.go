@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startDoQServer serves the handler over DNS-over-QUIC on a local port with
+// a self-signed certificate, and returns the upstream config to query it.
+func startDoQServer(t *testing.T, handler dns.Handler) *ServerConfig {
+	t.Helper()
+	dir := t.TempDir()
+	lc := &ServerConfig{
+		IP:           net.IPv4(127, 0, 0, 1),
+		Proto:        QUICProto,
+		CertFile:     filepath.Join(dir, "cert.pem"),
+		KeyFile:      filepath.Join(dir, "key.pem"),
+		GenerateCert: true,
+	}
+	qs, err := NewDoQServer(lc, handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	go func() {
+		if err := qs.ListenAndServe(func() { close(started) }); err != nil {
+			t.Error(err)
+		}
+	}()
+	<-started
+	t.Cleanup(func() { _ = qs.Shutdown(context.Background()) })
+	server := &ServerConfig{
+		IP:     lc.IP,
+		Port:   uint16(qs.listener.Addr().(*net.UDPAddr).Port),
+		Proto:  QUICProto,
+		CAFile: lc.CertFile,
+	}
+	if err = VerifyUpstreamTLS(server, "upstream server"); err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+// doqTestHandler answers every query with an address, and keeps the
+// queries it received.
+type doqTestHandler struct {
+	queries []*dns.Msg
+	sync.Mutex
+}
+
+func (h *doqTestHandler) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	h.Lock()
+	h.queries = append(h.queries, req)
+	h.Unlock()
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA,
+			Class: dns.ClassINET, Ttl: 300},
+		A: net.IPv4(192, 0, 2, 1),
+	}}
+	if opt := req.IsEdns0(); opt != nil {
+		resp.SetEdns0(opt.UDPSize(), opt.Do())
+	}
+	_ = w.WriteMsg(resp)
+}
+
+func TestDoQExchange(t *testing.T) {
+	handler := &doqTestHandler{}
+	client := NewDoQClient(startDoQServer(t, handler)).(*DoQClient)
+	names := []string{"a.example.", "b.example.", "c.example.",
+		"d.example."}
+	var wg sync.WaitGroup
+	for i, name := range names {
+		i, name := i, name
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := new(dns.Msg)
+			req.SetQuestion(name, dns.TypeA)
+			req.Id = uint16(i + 1)
+			req.SetEdns0(EDNS_BUFFER_SIZE, false)
+			ctx, cancel := context.WithTimeout(context.Background(),
+				5*time.Second)
+			defer cancel()
+			resp, err := client.ExchangeContext(ctx, req)
+			if err != nil {
+				t.Errorf("%s: %s", name, err)
+				return
+			}
+			if resp.Id != req.Id || len(resp.Answer) != 1 ||
+				resp.Answer[0].Header().Name != name {
+				t.Errorf("%s: unexpected response %v", name, resp)
+			}
+			if hasEDNSOption(resp, dns.EDNS0PADDING) {
+				t.Errorf("%s: padding left in the response", name)
+			}
+		}()
+	}
+	wg.Wait()
+	handler.Lock()
+	defer handler.Unlock()
+	if len(handler.queries) != len(names) {
+		t.Fatalf("got %d queries, want %d", len(handler.queries),
+			len(names))
+	}
+	for _, req := range handler.queries {
+		// RFC 9250 Section 4.2.1 and RFC 8467 Section 4.1
+		if req.Id != 0 {
+			t.Errorf("query %s sent with the ID %d", req.Question[0].Name,
+				req.Id)
+		}
+		if req.Len()%QueryPaddingBlock != 0 {
+			t.Errorf("query %s not padded: %d bytes",
+				req.Question[0].Name, req.Len())
+		}
+	}
+}
+
+func TestDoQReconnect(t *testing.T) {
+	client := NewDoQClient(startDoQServer(t, &doqTestHandler{}))
+	qc := client.(*DoQClient)
+	req := new(dns.Msg)
+	req.SetQuestion("example.", dns.TypeA)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := client.ExchangeContext(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+	// the connection closed under the client, as by an idle timeout
+	conn := qc.conn
+	_ = conn.CloseWithError(DoQNoError, "")
+	if _, err := client.ExchangeContext(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+	if qc.conn == conn {
+		t.Error("the closed connection is still used")
+	}
+}
+
+func TestDoQClose(t *testing.T) {
+	client := NewDoQClient(startDoQServer(t, &doqTestHandler{}))
+	qc := client.(*DoQClient)
+	req := new(dns.Msg)
+	req.SetQuestion("example.", dns.TypeA)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := client.ExchangeContext(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+	conn := qc.conn
+	closeClient(client)
+	if qc.conn != nil || conn.Context().Err() == nil {
+		t.Error("the connection is still open after Close")
+	}
+	// closing twice is harmless
+	closeClient(client)
+}
+
+func TestDoQServerRejectsID(t *testing.T) {
+	server := startDoQServer(t, &doqTestHandler{})
+	tlsCfg := server.UpstreamTLSConfig()
+	tlsCfg.NextProtos = []string{DoQALPN}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := quic.DialAddr(ctx, server.String(), tlsCfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.CloseWithError(DoQNoError, "")
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := new(dns.Msg)
+	req.SetQuestion("example.", dns.TypeA)
+	req.Id = 1
+	packed, _ := req.Pack()
+	if err = WriteLengthPrefixed(stream, packed); err != nil {
+		t.Fatal(err)
+	}
+	_ = stream.Close()
+	// RFC 9250 Section 4.2.1: a non-zero ID is a protocol error
+	_, err = ReadLengthPrefixed(stream)
+	var appErr *quic.ApplicationError
+	if !errors.As(err, &appErr) || appErr.ErrorCode != DoQProtocolError {
+		t.Fatalf("got %v, want the DoQ protocol error", err)
+	}
+}
+
+func hasEDNSOption(msg *dns.Msg, code uint16) bool {
+	if opt := msg.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if o.Option() == code {
+				return true
+			}
+		}
+	}
+	return false
+}
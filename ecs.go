@@ -0,0 +1,170 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"net/netip"
+)
+
+// ECS policies: what EDNS Client Subnet option (RFC 7871) is sent upstream
+const (
+	// no option is sent, and the options of the clients are dropped
+	ECSStrip = "strip"
+	// the option of the client is sent, truncated to the prefix lengths
+	ECSForward = "forward"
+	// an option is made from the address of the client, truncated to the
+	// prefix lengths
+	ECSSynthesize = "synthesize"
+)
+
+const DefaultECSPrefix4 = 24
+const DefaultECSPrefix6 = 56
+
+// RFC 7871 Section 6: address families of the ECS option
+const (
+	ECSFamilyIPv4 = 1
+	ECSFamilyIPv6 = 2
+)
+
+// ClientSubnet returns the ECS option to send upstream for the query of the
+// client, or nil if none is to be sent.
+func ClientSubnet(cfg *ECSConfig, w dns.ResponseWriter,
+	req *dns.Msg) *dns.EDNS0_SUBNET {
+	if cfg == nil {
+		return nil
+	}
+	switch cfg.Policy {
+	case ECSForward:
+		prefix, ok := subnetPrefix(FindClientSubnet(req))
+		if !ok {
+			return nil
+		}
+		return cfg.truncate(prefix.Addr(), prefix.Bits())
+	case ECSSynthesize:
+		// RFC 7871 Section 7.1.2: a source prefix length of 0 opts out
+		if ecs := FindClientSubnet(req); ecs != nil && ecs.SourceNetmask == 0 {
+			return nil
+		}
+		addrPort, err := netip.ParseAddrPort(w.RemoteAddr().String())
+		if err != nil {
+			return nil
+		}
+		addr := addrPort.Addr().Unmap()
+		// the subnet of a private address tells nothing to the upstream
+		if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+			return nil
+		}
+		return cfg.truncate(addr, addr.BitLen())
+	default:
+		return nil
+	}
+}
+
+// truncate makes an ECS option for the address, keeping at most the
+// configured prefix length of its family.
+func (cfg *ECSConfig) truncate(addr netip.Addr, bits int) *dns.EDNS0_SUBNET {
+	maxBits := int(cfg.IPv6Prefix)
+	if addr.Is4() {
+		maxBits = int(cfg.IPv4Prefix)
+	}
+	if bits > maxBits {
+		bits = maxBits
+	}
+	prefix := netip.PrefixFrom(addr, bits).Masked()
+	ecs := &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        ECSFamilyIPv6,
+		SourceNetmask: uint8(bits),
+		Address:       net.IP(prefix.Addr().AsSlice()),
+	}
+	if addr.Is4() {
+		ecs.Family = ECSFamilyIPv4
+	}
+	return ecs
+}
+
+// FindClientSubnet returns the ECS option of the message, if any.
+func FindClientSubnet(msg *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if ecs, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return ecs
+		}
+	}
+	return nil
+}
+
+// subnetPrefix returns the source prefix of the ECS option.
+func subnetPrefix(ecs *dns.EDNS0_SUBNET) (netip.Prefix, bool) {
+	if ecs == nil {
+		return netip.Prefix{}, false
+	}
+	addr, ok := netip.AddrFromSlice(ecs.Address)
+	if !ok {
+		return netip.Prefix{}, false
+	}
+	switch ecs.Family {
+	case ECSFamilyIPv4:
+		addr = addr.Unmap()
+		if !addr.Is4() || ecs.SourceNetmask > 32 {
+			return netip.Prefix{}, false
+		}
+	case ECSFamilyIPv6:
+		if !addr.Is6() || ecs.SourceNetmask > 128 {
+			return netip.Prefix{}, false
+		}
+	default:
+		return netip.Prefix{}, false
+	}
+	return netip.PrefixFrom(addr, int(ecs.SourceNetmask)).Masked(), true
+}
+
+// ECSCacheSubnets returns the subnets under which a response to the query
+// may be cached, from the most specific one down to "" for the responses
+// valid for every client.
+func ECSCacheSubnets(q *dns.Msg) []string {
+	prefix, ok := subnetPrefix(FindClientSubnet(q))
+	if !ok {
+		return []string{""}
+	}
+	subnets := make([]string, 0, prefix.Bits()+1)
+	for bits := prefix.Bits(); bits > 0; bits-- {
+		subnets = append(subnets,
+			netip.PrefixFrom(prefix.Addr(), bits).Masked().String())
+	}
+	return append(subnets, "")
+}
+
+// ECSCacheSubnet returns the subnet the response is valid for, as set by
+// the scope prefix length of its ECS option. A response without one is
+// valid for every client (RFC 7871 Section 7.3.1).
+func ECSCacheSubnet(resp *dns.Msg) string {
+	ecs := FindClientSubnet(resp)
+	prefix, ok := subnetPrefix(ecs)
+	if !ok || ecs.SourceScope == 0 {
+		return ""
+	}
+	// a scope longer than the source cannot be told apart from the source
+	bits := int(ecs.SourceScope)
+	if bits > prefix.Bits() {
+		bits = prefix.Bits()
+	}
+	return netip.PrefixFrom(prefix.Addr(), bits).Masked().String()
+}
+
+// EchoClientSubnet adds the ECS option of the query to the response
+// (RFC 7871 Section 7.2.2). Its scope is the source prefix length, so that
+// no cache downstream shares the answer more widely than allowed.
+func EchoClientSubnet(req, resp *dns.Msg) {
+	ecs := FindClientSubnet(req)
+	opt := resp.IsEdns0()
+	if ecs == nil || opt == nil {
+		return
+	}
+	echo := *ecs
+	echo.SourceScope = ecs.SourceNetmask
+	opt.Option = append(opt.Option, &echo)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+// ecsTestQuery makes a query with the ECS option of the subnet, if given.
+func ecsTestQuery(t *testing.T, subnet string, scope uint8) *dns.Msg {
+	t.Helper()
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.", dns.TypeA)
+	msg.SetEdns0(EDNS_BUFFER_SIZE, false)
+	if subnet == "" {
+		return msg
+	}
+	prefix := netip.MustParsePrefix(subnet)
+	ecs := &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        ECSFamilyIPv6,
+		SourceNetmask: uint8(prefix.Bits()),
+		SourceScope:   scope,
+		Address:       net.IP(prefix.Addr().AsSlice()),
+	}
+	if prefix.Addr().Is4() {
+		ecs.Family = ECSFamilyIPv4
+	}
+	opt := msg.IsEdns0()
+	opt.Option = append(opt.Option, ecs)
+	return msg
+}
+
+// ecsString formats the ECS option as a prefix, or "" for none.
+func ecsString(ecs *dns.EDNS0_SUBNET) string {
+	if ecs == nil {
+		return ""
+	}
+	addr, _ := netip.AddrFromSlice(ecs.Address)
+	if ecs.Family == ECSFamilyIPv4 {
+		addr = addr.Unmap()
+	}
+	return netip.PrefixFrom(addr, int(ecs.SourceNetmask)).String()
+}
+
+func TestClientSubnet(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		remote string
+		subnet string
+		want   string
+	}{
+		{name: "stripped", policy: ECSStrip, remote: "198.51.100.7",
+			subnet: "198.51.100.0/24"},
+		{name: "forwarded", policy: ECSForward, remote: "192.0.2.1",
+			subnet: "198.51.96.0/20", want: "198.51.96.0/20"},
+		{name: "forwarded truncated", policy: ECSForward,
+			remote: "192.0.2.1", subnet: "198.51.100.7/32",
+			want: "198.51.100.0/24"},
+		{name: "forwarded IPv6 truncated", policy: ECSForward,
+			remote: "192.0.2.1", subnet: "2001:db8:1:2:3::/80",
+			want: "2001:db8:1::/56"},
+		{name: "forwarded opt-out", policy: ECSForward,
+			remote: "192.0.2.1", subnet: "198.51.100.7/0",
+			want: "0.0.0.0/0"},
+		{name: "nothing to forward", policy: ECSForward,
+			remote: "198.51.100.7"},
+		{name: "synthesized", policy: ECSSynthesize, remote: "198.51.100.7",
+			want: "198.51.100.0/24"},
+		{name: "synthesized from a mapped address", policy: ECSSynthesize,
+			remote: "::ffff:198.51.100.7", want: "198.51.100.0/24"},
+		{name: "synthesized IPv6", policy: ECSSynthesize,
+			remote: "2001:db8:1:2::7", want: "2001:db8:1::/56"},
+		{name: "synthesis opted out", policy: ECSSynthesize,
+			remote: "198.51.100.7", subnet: "198.51.100.7/0"},
+		{name: "private address", policy: ECSSynthesize,
+			remote: "192.168.1.7"},
+		{name: "loopback address", policy: ECSSynthesize,
+			remote: "127.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &ECSConfig{Policy: tt.policy}
+			if err := VerifyECSConfig(cfg); err != nil {
+				t.Fatal(err)
+			}
+			w := &bufferedResponseWriter{remoteAddr: &net.UDPAddr{
+				IP: net.ParseIP(tt.remote), Port: 53}}
+			got := ecsString(ClientSubnet(cfg, w,
+				ecsTestQuery(t, tt.subnet, 0)))
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestECSCacheSubnets(t *testing.T) {
+	subnets := ECSCacheSubnets(ecsTestQuery(t, "198.51.100.0/24", 0))
+	if len(subnets) != 25 || subnets[0] != "198.51.100.0/24" ||
+		subnets[1] != "198.51.100.0/23" || subnets[23] != "128.0.0.0/1" ||
+		subnets[24] != "" {
+		t.Errorf("got %v, want from 198.51.100.0/24 down to \"\"", subnets)
+	}
+	if subnets = ECSCacheSubnets(ecsTestQuery(t, "", 0)); len(subnets) != 1 ||
+		subnets[0] != "" {
+		t.Errorf("got %v without ECS, want only \"\"", subnets)
+	}
+}
+
+func TestECSCacheSubnet(t *testing.T) {
+	tests := []struct {
+		subnet string
+		scope  uint8
+		want   string
+	}{
+		{subnet: "", want: ""},
+		{subnet: "198.51.100.0/24", scope: 0, want: ""},
+		{subnet: "198.51.100.0/24", scope: 16, want: "198.51.0.0/16"},
+		{subnet: "198.51.100.0/24", scope: 24, want: "198.51.100.0/24"},
+		{subnet: "198.51.100.0/24", scope: 32, want: "198.51.100.0/24"},
+	}
+	for _, tt := range tests {
+		resp := ecsTestQuery(t, tt.subnet, tt.scope)
+		if got := ECSCacheSubnet(resp); got != tt.want {
+			t.Errorf("%s with the scope %d: got %q, want %q", tt.subnet,
+				tt.scope, got, tt.want)
+		}
+	}
+}
+
+func TestCacheClientSubnet(t *testing.T) {
+	cfg := &DNSCacheConfig{CacheSize: 16,
+		RecordTypes: []*RecordType{{Name: "A", Value: dns.TypeA}}}
+	if err := VerifyCacheConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	ch := NewDNSCache(cfg).(*DNSMapCache)
+	defer ch.Close()
+	cache := func(subnet string, scope uint8, addr string) {
+		resp := ecsTestQuery(t, subnet, scope)
+		resp.Response = true
+		resp.Answer = testRRs(t, "example. 300 IN A "+addr)
+		if err := ch.Update(resp, "", Indeterminate); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cache("198.51.100.0/24", 16, "192.0.2.16")
+	cache("198.51.100.0/24", 24, "192.0.2.24")
+	cache("203.0.113.0/24", 0, "192.0.2.0")
+	tests := []struct {
+		subnet string
+		want   string
+	}{
+		// the most specific subnet first
+		{subnet: "198.51.100.0/24", want: "192.0.2.24"},
+		{subnet: "198.51.100.7/32", want: "192.0.2.24"},
+		{subnet: "198.51.7.0/24", want: "192.0.2.16"},
+		// the response valid for every client
+		{subnet: "192.0.2.0/24", want: "192.0.2.0"},
+		{subnet: "", want: "192.0.2.0"},
+	}
+	for _, tt := range tests {
+		resp, err := ch.Query(ecsTestQuery(t, tt.subnet, 0), "")
+		if err != nil || resp == nil || len(resp.Answer) != 1 {
+			t.Errorf("%q: got %v (%v)", tt.subnet, resp, err)
+			continue
+		}
+		if got := resp.Answer[0].(*dns.A).A.String(); got != tt.want {
+			t.Errorf("%q: got %s, want %s", tt.subnet, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// EDNSTimeoutThreshold is the number of consecutive timeouts before the
+// EDNS buffer size of an upstream is lowered.
+const EDNSTimeoutThreshold = 3
+
+// EDNSReprobeInterval is the seconds before a lowered EDNS buffer size is
+// raised back to the configured one.
+const EDNSReprobeInterval = 3600
+
+// EDNSClient is a DNSClient negotiating EDNS with a cleartext upstream. The
+// buffer size starts at the configured one, and is lowered to 1232 and then
+// 512 bytes after consecutive timeouts, as large responses may be lost to
+// fragmentation. EDNS is dropped for an upstream answering FORMERR without
+// it (RFC 6891 Section 7). The size that works, or the lack of EDNS, is kept
+// until the configured size is probed again, as a single FORMERR may come
+// from a middlebox or a spoofed packet.
+type EDNSClient struct {
+	client   DNSClient
+	name     string
+	maxSize  uint16
+	size     uint16
+	noEDNS   bool
+	timeouts int
+	probeAt  time.Time
+	now      func() time.Time
+	sync.Mutex
+}
+
+func NewEDNSClient(client DNSClient, server *ServerConfig) DNSClient {
+	size := server.EDNSBufferSize
+	if size == 0 {
+		size = EDNS_BUFFER_SIZE
+	}
+	return &EDNSClient{
+		client:  client,
+		name:    server.String(),
+		maxSize: size,
+		size:    size,
+		now:     time.Now,
+	}
+}
+
+func (ec *EDNSClient) ExchangeContext(ctx context.Context,
+	msg *dns.Msg) (*dns.Msg, error) {
+	if ec == nil {
+		return nil, fmt.Errorf(
+			"attempted to use uninitialized DNS client")
+	}
+	size, noEDNS := ec.bufferSize()
+	query := EDNSQuery(msg, size, noEDNS)
+	resp, err := ec.client.ExchangeContext(ctx, query)
+	switch {
+	// the read deadline of the connection may pass before the context
+	case err != nil && (errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, os.ErrDeadlineExceeded)):
+		if query.IsEdns0() != nil && size > dns.MinMsgSize {
+			ec.reportTimeout(size)
+		}
+	case err != nil:
+	case resp.Rcode == dns.RcodeFormatError && query.IsEdns0() != nil &&
+		resp.IsEdns0() == nil:
+		ec.disableEDNS()
+		return ec.client.ExchangeContext(ctx, EDNSQuery(msg, 0, true))
+	default:
+		ec.reportSuccess()
+	}
+	return resp, err
+}
+
+// bufferSize returns the EDNS buffer size to query with, and whether EDNS
+// is dropped, raising the size back and enabling EDNS again once the
+// reprobe interval is over.
+func (ec *EDNSClient) bufferSize() (uint16, bool) {
+	ec.Lock()
+	defer ec.Unlock()
+	if (ec.size < ec.maxSize || ec.noEDNS) && ec.now().After(ec.probeAt) {
+		log.Printf("Probing the EDNS buffer size %d of upstream %s again",
+			ec.maxSize, ec.name)
+		ec.size = ec.maxSize
+		ec.noEDNS = false
+		ec.timeouts = 0
+	}
+	return ec.size, ec.noEDNS
+}
+
+func (ec *EDNSClient) reportTimeout(size uint16) {
+	ec.Lock()
+	defer ec.Unlock()
+	// another query may have lowered the size already
+	if size != ec.size {
+		return
+	}
+	ec.timeouts++
+	if ec.timeouts < EDNSTimeoutThreshold {
+		return
+	}
+	ec.size = dns.MinMsgSize
+	if size > EDNS_BUFFER_SIZE {
+		ec.size = EDNS_BUFFER_SIZE
+	}
+	ec.timeouts = 0
+	ec.probeAt = ec.now().Add(EDNSReprobeInterval * time.Second)
+	log.Printf("Lowered the EDNS buffer size of upstream %s to %d after %d "+
+		"timeouts", ec.name, ec.size, EDNSTimeoutThreshold)
+}
+
+func (ec *EDNSClient) reportSuccess() {
+	ec.Lock()
+	defer ec.Unlock()
+	ec.timeouts = 0
+}
+
+func (ec *EDNSClient) disableEDNS() {
+	ec.Lock()
+	defer ec.Unlock()
+	if ec.noEDNS {
+		return
+	}
+	ec.noEDNS = true
+	ec.probeAt = ec.now().Add(EDNSReprobeInterval * time.Second)
+	log.Printf("Upstream %s does not support EDNS, querying it without",
+		ec.name)
+}
+
+// Close closes the connections of the wrapped client.
+func (ec *EDNSClient) Close() error {
+	closeClient(ec.client)
+	return nil
+}
+
+// NumSpoofed returns the number of responses the wrapped client dropped as
+// suspected spoofing.
+func (ec *EDNSClient) NumSpoofed() int64 {
+	return NumSpoofed(ec.client)
+}
+
+// EDNSQuery returns the query with the EDNS buffer size, or without EDNS.
+// The query is copied if it has to change, as it may be shared.
+func EDNSQuery(msg *dns.Msg, size uint16, noEDNS bool) *dns.Msg {
+	opt := msg.IsEdns0()
+	if opt == nil || (!noEDNS && opt.UDPSize() == size) {
+		return msg
+	}
+	query := msg.Copy()
+	if noEDNS {
+		extra := query.Extra[:0]
+		for _, rr := range query.Extra {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				extra = append(extra, rr)
+			}
+		}
+		query.Extra = extra
+		return query
+	}
+	query.IsEdns0().SetUDPSize(size)
+	return query
+}
+
+// TruncatingHandler truncates the responses of a handler serving UDP to the
+// buffer size of the client (RFC 6891 Section 7), capped at our own. The TC
+// bit tells the client to retry over TCP.
+type TruncatingHandler struct {
+	handler dns.Handler
+}
+
+func (th *TruncatingHandler) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	th.handler.ServeDNS(&truncatingResponseWriter{ResponseWriter: w,
+		req: req}, req)
+}
+
+// truncatingResponseWriter truncates the responses it writes to the query.
+type truncatingResponseWriter struct {
+	dns.ResponseWriter
+	req *dns.Msg
+}
+
+func (w *truncatingResponseWriter) WriteMsg(msg *dns.Msg) error {
+	if msg != nil {
+		size := dns.MinMsgSize
+		if opt := w.req.IsEdns0(); opt != nil {
+			size = min(max(int(opt.UDPSize()), dns.MinMsgSize),
+				EDNS_BUFFER_SIZE)
+		}
+		msg.Truncate(size)
+	}
+	return w.ResponseWriter.WriteMsg(msg)
+}
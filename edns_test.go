@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"testing"
+	"time"
+)
+
+// ednsTestClient answers the queries with the reply function, and keeps
+// the EDNS buffer size of each query, or 0 for a query without EDNS.
+type ednsTestClient struct {
+	reply func(req *dns.Msg) (*dns.Msg, error)
+	sizes []uint16
+}
+
+func (c *ednsTestClient) ExchangeContext(_ context.Context,
+	req *dns.Msg) (*dns.Msg, error) {
+	var size uint16
+	if opt := req.IsEdns0(); opt != nil {
+		size = opt.UDPSize()
+	}
+	c.sizes = append(c.sizes, size)
+	return c.reply(req)
+}
+
+func (c *ednsTestClient) takeSizes() []uint16 {
+	sizes := c.sizes
+	c.sizes = nil
+	return sizes
+}
+
+// ednsTestReply answers with an empty response, echoing EDNS if asked.
+func ednsTestReply(req *dns.Msg) (*dns.Msg, error) {
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	if opt := req.IsEdns0(); opt != nil {
+		resp.SetEdns0(opt.UDPSize(), false)
+	}
+	return resp, nil
+}
+
+// ednsTestFormErr answers a query with EDNS with FORMERR without EDNS, as
+// a server not supporting it.
+func ednsTestFormErr(req *dns.Msg) (*dns.Msg, error) {
+	if req.IsEdns0() == nil {
+		return ednsTestReply(req)
+	}
+	resp := new(dns.Msg)
+	resp.SetRcode(req, dns.RcodeFormatError)
+	return resp, nil
+}
+
+func ednsTestTimeout(*dns.Msg) (*dns.Msg, error) {
+	return nil, context.DeadlineExceeded
+}
+
+func TestEDNSClient(t *testing.T) {
+	type step struct {
+		// the time passed since the start
+		at    time.Duration
+		reply func(req *dns.Msg) (*dns.Msg, error)
+		// the buffer sizes of the queries sent, 0 without EDNS
+		want []uint16
+	}
+	timeouts := func(size uint16) []step {
+		steps := make([]step, EDNSTimeoutThreshold)
+		for i := range steps {
+			steps[i] = step{reply: ednsTestTimeout, want: []uint16{size}}
+		}
+		return steps
+	}
+	reprobe := EDNSReprobeInterval*time.Second + time.Second
+	tests := []struct {
+		name    string
+		maxSize uint16
+		steps   []step
+	}{
+		{name: "lowered to 1232 and then 512 bytes", maxSize: 4096,
+			steps: append(append(append(timeouts(4096), timeouts(1232)...),
+				timeouts(dns.MinMsgSize)...),
+				step{reply: ednsTestReply, want: []uint16{dns.MinMsgSize}})},
+		{name: "lowered to 512 bytes from 1232", maxSize: EDNS_BUFFER_SIZE,
+			steps: append(timeouts(EDNS_BUFFER_SIZE),
+				step{reply: ednsTestReply, want: []uint16{dns.MinMsgSize}})},
+		{name: "kept after a success", maxSize: 4096,
+			steps: append(append(timeouts(4096)[1:],
+				step{reply: ednsTestReply, want: []uint16{4096}}),
+				timeouts(4096)[1:]...)},
+		{name: "probed again after the interval", maxSize: 4096,
+			steps: append(timeouts(4096),
+				step{at: reprobe - 2*time.Second, reply: ednsTestReply,
+					want: []uint16{1232}},
+				step{at: reprobe, reply: ednsTestReply,
+					want: []uint16{4096}})},
+		{name: "dropped after FORMERR", maxSize: 4096,
+			steps: []step{
+				{reply: ednsTestFormErr, want: []uint16{4096, 0}},
+				{reply: ednsTestReply, want: []uint16{0}},
+			}},
+		{name: "enabled again after the interval", maxSize: 4096,
+			steps: []step{
+				{reply: ednsTestFormErr, want: []uint16{4096, 0}},
+				{at: reprobe, reply: ednsTestReply,
+					want: []uint16{4096}},
+				{at: reprobe, reply: ednsTestReply,
+					want: []uint16{4096}},
+			}},
+		{name: "dropped again if still unsupported", maxSize: 4096,
+			steps: []step{
+				{reply: ednsTestFormErr, want: []uint16{4096, 0}},
+				{at: reprobe, reply: ednsTestFormErr,
+					want: []uint16{4096, 0}},
+				{at: reprobe, reply: ednsTestReply, want: []uint16{0}},
+			}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			now := start
+			client := &ednsTestClient{}
+			ec := NewEDNSClient(client, &ServerConfig{
+				IP:             []byte{127, 0, 0, 1},
+				Port:           53,
+				EDNSBufferSize: tt.maxSize,
+			}).(*EDNSClient)
+			ec.now = func() time.Time { return now }
+			for i, s := range tt.steps {
+				now = start.Add(s.at)
+				client.reply = s.reply
+				req := new(dns.Msg)
+				req.SetQuestion("example.", dns.TypeA)
+				req.SetEdns0(EDNS_BUFFER_SIZE, false)
+				_, _ = ec.ExchangeContext(context.Background(), req)
+				sizes := client.takeSizes()
+				if len(sizes) != len(s.want) {
+					t.Fatalf("query %d: sent %v, want %v", i, sizes, s.want)
+				}
+				for j := range sizes {
+					if sizes[j] != s.want[j] {
+						t.Fatalf("query %d: sent %v, want %v", i, sizes,
+							s.want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestEDNSQuery(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("example.", dns.TypeA)
+	req.SetEdns0(EDNS_BUFFER_SIZE, true)
+	if q := EDNSQuery(req, EDNS_BUFFER_SIZE, false); q != req {
+		t.Error("copied a query that did not change")
+	}
+	q := EDNSQuery(req, dns.MinMsgSize, false)
+	if q.IsEdns0().UDPSize() != dns.MinMsgSize || !q.IsEdns0().Do() {
+		t.Errorf("got %v, want the buffer size %d", q, dns.MinMsgSize)
+	}
+	if q = EDNSQuery(req, 0, true); q.IsEdns0() != nil {
+		t.Errorf("got %v, want no EDNS", q)
+	}
+	// the shared query is left as is
+	if req.IsEdns0() == nil || req.IsEdns0().UDPSize() != EDNS_BUFFER_SIZE {
+		t.Errorf("the query changed to %v", req)
+	}
+}
@@ -19,6 +19,10 @@ var DomainBlockedError = errors.New(
 	"the requested domain name is blocked")
 var InvalidDomainNameError = errors.New(
 	"invalid domain name provided")
+var ConnectionError = errors.New(
+	"unable to connect to the server")
+var CircuitOpenError = errors.New(
+	"the circuit of the upstream is open")
 
 func NewABPSyntaxError(lineNum int, lineStr string) error {
 	return fmt.Errorf("invalid abp syntax at line %d: %s", lineNum, lineStr)
@@ -1,11 +1,16 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"github.com/miekg/dns"
 	"log"
+	"sync/atomic"
+	"time"
 )
 
+const UpstreamMaxAttempts = 3
+
 func ServeResponse(w dns.ResponseWriter, msg *dns.Msg) {
 	err := w.WriteMsg(msg)
 	if err != nil {
@@ -15,49 +20,62 @@ func ServeResponse(w dns.ResponseWriter, msg *dns.Msg) {
 }
 
 type MainHandler struct {
-	cache              DNSCache
-	adBlocker          AdBlocker
-	inflightMgr        *InflightManager
-	upstreamClients    *DNSClientPool
-	localResolvClients *DNSClientPool
+	state       atomic.Pointer[HandlerState]
+	inflightMgr *InflightManager
 }
 
-func NewDNSHandler(cache DNSCache, adBlocker AdBlocker,
-	upstreamClients, localResolvClients *DNSClientPool) dns.Handler {
+func NewDNSHandler(state *HandlerState) *MainHandler {
 	h := &MainHandler{
-		cache:              cache,
-		adBlocker:          adBlocker,
-		inflightMgr:        NewInflightManager(),
-		upstreamClients:    upstreamClients,
-		localResolvClients: localResolvClients,
+		inflightMgr: NewInflightManager(),
 	}
+	h.state.Store(state)
 	return h
 }
 
-func (h *MainHandler) QueryWithClient(req *dns.Msg) *dns.Msg {
-	client := <-h.upstreamClients.C
-	resp, err := client.Exchange(req)
-	if err != nil {
-		return nil
+// State returns the components currently serving the queries.
+func (h *MainHandler) State() *HandlerState {
+	return h.state.Load()
+}
+
+// SwapState atomically replaces the components serving the queries, and
+// returns the old ones. Queries already being served keep the old state.
+func (h *MainHandler) SwapState(state *HandlerState) *HandlerState {
+	return h.state.Swap(state)
+}
+
+// Drain waits until the in-flight queries are answered, or the context is
+// done.
+func (h *MainHandler) Drain(ctx context.Context) error {
+	return h.inflightMgr.Drain(ctx)
+}
+
+func (h *MainHandler) QueryWithClient(ctx context.Context,
+	req *dns.Msg) *dns.Msg {
+	return h.MakeQueryRequest(ctx, h.State().upstreamClients,
+		CreateUpstreamRequest(req, nil))
+}
+
+// RequestContext returns the context of the downstream request, which is
+// done once the client goes away, if the transport tracks it.
+func RequestContext(w dns.ResponseWriter) context.Context {
+	if cw, ok := w.(interface{ Context() context.Context }); ok {
+		if ctx := cw.Context(); ctx != nil {
+			return ctx
+		}
 	}
-	return resp
+	return context.Background()
 }
 
 func (h *MainHandler) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 	logRequest, logEntry := StartLogEntry()
 	var resp *dns.Msg
-	defer func() {
-		if err := w.Close(); err != nil {
-			log.Printf("Error while closing the connection: %s",
-				err.Error())
-		}
-	}()
 	if h == nil {
 		log.Panicf("Attempted to use uninitialized DNS request handler")
 	}
 	if req == nil {
 		log.Panicf("Attempted to handle nil DNS request")
 	}
+	st := h.State()
 	if req.Response {
 		resp = CreateServFailResp(req)
 		ServeResponse(w, resp)
@@ -82,14 +100,19 @@ func (h *MainHandler) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 		logRequest(logEntry)
 		return
 	}
-	var client DNSClient
-	if logEntry.isLocalReq = IsLocalQuery(req); logEntry.isLocalReq {
-		client = <-h.localResolvClients.C
-	} else {
-		client = <-h.upstreamClients.C
+	// forwarding rules take precedence over the local/upstream split
+	pool := st.ForwardingPool(req.Question[0].Name)
+	switch {
+	case pool != nil:
+		logEntry.isForwardedReq = true
+	case IsLocalQuery(req):
+		logEntry.isLocalReq = true
+		pool = st.localResolvClients
+	default:
+		pool = st.upstreamClients
 	}
 	cname := dns.CanonicalName(req.Question[0].Name)
-	if h.adBlocker.IsBlocked(cname) {
+	if st.adBlocker.IsBlocked(cname) {
 		resp = CreateBlockedResp(req)
 		ServeResponse(w, resp)
 		logEntry.cacheStatus = BlockedDomain
@@ -98,16 +121,28 @@ func (h *MainHandler) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 		return
 	}
 
+	ctx, cancel := context.WithTimeout(RequestContext(w),
+		time.Duration(st.config.QueryTimeout)*time.Millisecond)
+	defer cancel()
 	sessionKey := InflightSessionKey(w, req)
 	session, isFirst := h.inflightMgr.ReserveSession(sessionKey)
 	defer h.inflightMgr.ReleaseSession(sessionKey)
+	if isFirst {
+		// wake up the duplicate requests waiting on this session, whichever
+		// way it ends
+		defer close(session.Wait)
+	}
 
+	// the cache is keyed by the client subnet sent upstream, if any
+	uReq := CreateUpstreamRequest(req, ClientSubnet(st.config.ECS, w, req))
+	uReq.CheckingDisabled = st.IsValidated(pool)
 	var shouldCacheResult bool
-	cachedResp, err := h.cache.Query(req, sessionKey)
+	cachedResp, err := st.cache.Query(uReq, sessionKey)
 	switch {
 	case err == nil:
 		if cachedResp != nil {
-			resp = CreateRespFromResp(req, cachedResp)
+			session.Cached = cachedResp
+			resp = st.CreateClientResp(req, cachedResp)
 			ServeResponse(w, resp)
 			logEntry.cacheStatus = CacheHit
 			PopulateLogEntry(logEntry, resp)
@@ -132,75 +167,124 @@ func (h *MainHandler) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 	}
 
 	if !isFirst {
-		<-session.Wait
-		resp = CreateRespFromResp(req, session.Cached)
+		select {
+		case <-session.Wait:
+			if session.Cached != nil {
+				resp = st.CreateClientResp(req, session.Cached)
+			}
+		case <-ctx.Done():
+		}
+		if resp == nil {
+			resp = CreateServFailResp(req)
+		}
 		ServeResponse(w, resp)
 		PopulateLogEntry(logEntry, resp)
 		logRequest(logEntry)
 		return
 	}
-	session.Cached = h.MakeQueryRequest(client, req)
-	if session.Cached == nil {
+	if logEntry.isLocalReq {
+		// validated as from the upstream servers if it fell back to them
+		session.Cached, pool = st.ResolveLocal(ctx, req, uReq)
+	} else {
+		session.Cached = h.MakeQueryRequest(ctx, pool, uReq)
+	}
+	// the SERVFAIL answered when no server did is not cached, or it would
+	// outlast the outage
+	synthesized := session.Cached == nil
+	if synthesized {
 		session.Cached = CreateServFailResp(req)
 	}
-	if h.ContainsBlockedTarget(session.Cached) {
-		if berr := h.adBlocker.Block(cname); berr != nil {
+	var validation ValidationState
+	session.Cached, validation = st.Validate(ctx, pool, req, session.Cached)
+	if st.ContainsBlockedTarget(session.Cached) {
+		if berr := st.adBlocker.Block(cname); berr != nil {
 			log.Printf("Failed to block req %v: %v", req.String(), berr)
 		}
 		session.Cached = CreateBlockedResp(req)
+		validation = Indeterminate
 	}
-	if shouldCacheResult {
-		if cerr := h.cache.Update(session.Cached, sessionKey); cerr != nil {
-			log.Printf("Unable to cache upstream resp: %s", err.Error())
+	session.Cached.AuthenticatedData = validation == Secure
+	// a response cut short by the query deadline is not worth caching
+	if shouldCacheResult && !synthesized && ctx.Err() == nil {
+		if cerr := st.cache.Update(session.Cached, sessionKey,
+			validation); cerr != nil {
+			log.Printf("Unable to cache upstream resp: %s", cerr.Error())
 		}
 	}
-	resp = CreateRespFromResp(req, session.Cached)
+	resp = st.CreateClientResp(req, session.Cached)
 	ServeResponse(w, resp)
 	PopulateLogEntry(logEntry, resp)
 	logRequest(logEntry)
 }
 
-func (h *MainHandler) MakeQueryRequest(client DNSClient, req *dns.Msg) *dns.Msg {
-	uReq := CreateUpstreamRequest(req)
+// CreateClientResp creates the response to the client from the upstream or
+// cached one, echoing the client subnet if it was forwarded upstream.
+func (st *HandlerState) CreateClientResp(req *dns.Msg,
+	origResp *dns.Msg) *dns.Msg {
+	resp := CreateRespFromResp(req, origResp)
+	if resp != nil && st.config.ECS != nil &&
+		st.config.ECS.Policy == ECSForward {
+		EchoClientSubnet(req, resp)
+	}
+	return resp
+}
 
-	resp, err := client.Exchange(uReq)
-	if err != nil {
-		return nil
+// IsValidated checks if the DNSSEC signatures of the responses from the
+// pool are validated locally. The local and forwarding servers are trusted.
+func (st *HandlerState) IsValidated(pool *DNSClientPool) bool {
+	return st.validator != nil && pool == st.upstreamClients
+}
+
+// Validate checks the DNSSEC signatures of the response, and replaces a
+// bogus one with SERVFAIL (RFC 4035 Section 5.5).
+func (st *HandlerState) Validate(ctx context.Context, pool *DNSClientPool,
+	req *dns.Msg, resp *dns.Msg) (*dns.Msg, ValidationState) {
+	if !st.IsValidated(pool) {
+		return resp, Indeterminate
 	}
-	if resp == nil {
-		resp = new(dns.Msg)
-		resp.SetRcode(req, dns.RcodeServerFailure)
-		return resp
+	validation, err := st.validator.Validate(ctx, resp)
+	if validation == Bogus {
+		log.Printf("Bogus DNSSEC response for %s: %v",
+			req.Question[0].String(), err)
+		return CreateServFailResp(req), Bogus
 	}
+	return resp, validation
+}
+
+// MakeQueryRequest sends the upstream request through the pool, and returns
+// the last response received, if any.
+func (h *MainHandler) MakeQueryRequest(ctx context.Context,
+	pool *DNSClientPool, uReq *dns.Msg) *dns.Msg {
+	resp, _ := pool.ExchangeContext(ctx, uReq)
 	return resp
 }
 
-func (h *MainHandler) ContainsBlockedTarget(resp *dns.Msg) bool {
+func (st *HandlerState) ContainsBlockedTarget(resp *dns.Msg) bool {
 	if resp == nil {
 		return false
 	}
 	switch resp.Question[0].Qtype {
 	case dns.TypeCNAME:
 		for _, rr := range resp.Answer {
-			if h.adBlocker.IsBlocked(rr.(*dns.CNAME).Target) {
+			if st.adBlocker.IsBlocked(rr.(*dns.CNAME).Target) {
 				return true
 			}
 		}
 	case dns.TypeDNAME:
 		for _, rr := range resp.Answer {
-			if h.adBlocker.IsBlocked(rr.(*dns.DNAME).Target) {
+			if st.adBlocker.IsBlocked(rr.(*dns.DNAME).Target) {
 				return true
 			}
 		}
 	case dns.TypeSRV:
 		for _, rr := range resp.Answer {
-			if h.adBlocker.IsBlocked(rr.(*dns.SRV).Target) {
+			if st.adBlocker.IsBlocked(rr.(*dns.SRV).Target) {
 				return true
 			}
 		}
 	case dns.TypePTR:
 		for _, rr := range resp.Answer {
-			if h.adBlocker.IsBlocked(rr.(*dns.PTR).Ptr) {
+			if st.adBlocker.IsBlocked(rr.(*dns.PTR).Ptr) {
 				return true
 			}
 		}
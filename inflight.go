@@ -1,13 +1,19 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"github.com/miekg/dns"
 	"net/netip"
 	"strings"
 	"sync"
+	"time"
 )
 
-// InflightSession represents the bundle of ongoing duplicate requests.
+const DrainPollMillis = 10
+
+// InflightSession represents the bundle of ongoing duplicate requests. The
+// response is set, or left nil on failure, before Wait is closed.
 type InflightSession struct {
 	Cached *dns.Msg
 	Wait   chan struct{}
@@ -30,7 +36,7 @@ func NewInflightManager() *InflightManager {
 }
 
 // InflightSessionKey generates the session key based on the server IP address,
-// client IP address, and DNS query.
+// client IP address, DNS query, and the client subnet of the query if any.
 func InflightSessionKey(w dns.ResponseWriter, req *dns.Msg) string {
 	var localAddr, remoteAddr string
 	localAddr = w.LocalAddr().String()
@@ -48,6 +54,9 @@ func InflightSessionKey(w dns.ResponseWriter, req *dns.Msg) string {
 		dns.Class(q.Qclass).String(),
 		dns.Type(q.Qtype).String(),
 	}
+	if ecs := FindClientSubnet(req); ecs != nil {
+		key = append(key, ecs.String())
+	}
 	return strings.Join(key, "\t")
 }
 
@@ -60,8 +69,7 @@ func (im *InflightManager) ReserveSession(k string) (*InflightSession, bool) {
 	if !found {
 		im.requestCount[k] = 1
 		im.sessions[k] = &InflightSession{
-			Cached: new(dns.Msg),
-			Wait:   make(chan struct{}, 0),
+			Wait: make(chan struct{}, 0),
 		}
 		return im.sessions[k], true
 	}
@@ -84,3 +92,23 @@ func (im *InflightManager) ReleaseSession(k string) bool {
 	delete(im.sessions, k)
 	return false
 }
+
+// Drain waits until every session has been released, or the context is done.
+func (im *InflightManager) Drain(ctx context.Context) error {
+	pollT := time.NewTicker(DrainPollMillis * time.Millisecond)
+	defer pollT.Stop()
+	for {
+		im.Lock()
+		n := len(im.sessions)
+		im.Unlock()
+		if n == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%d sessions still in flight: %w",
+				n, ctx.Err())
+		case <-pollT.C:
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"math"
+	"time"
+)
+
+// RFC 7828 Section 3.1: the idle timeout is in units of 100 milliseconds
+const TCPKeepaliveUnit = 100 * time.Millisecond
+
+// AddTCPKeepalive asks the server of a TCP query for its idle timeout. The
+// option sent by a client has no timeout (RFC 7828 Section 3.2.1).
+func AddTCPKeepalive(msg *dns.Msg) {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return
+	}
+	RemoveEDNSOption(msg, dns.EDNS0TCPKEEPALIVE)
+	opt.Option = append(opt.Option,
+		&dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE})
+}
+
+// TCPKeepaliveTimeout returns the idle timeout sent by the server in the
+// response, if any.
+func TCPKeepaliveTimeout(msg *dns.Msg) (time.Duration, bool) {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return 0, false
+	}
+	for _, o := range opt.Option {
+		if ka, ok := o.(*dns.EDNS0_TCP_KEEPALIVE); ok {
+			return time.Duration(ka.Timeout) * TCPKeepaliveUnit, true
+		}
+	}
+	return 0, false
+}
+
+// KeepaliveHandler tells the clients of a TCP or DNS-over-TLS listener how
+// long their idle connections are kept open (RFC 7828 Section 3.3.2).
+type KeepaliveHandler struct {
+	handler     dns.Handler
+	idleTimeout time.Duration
+}
+
+func (kh *KeepaliveHandler) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	kh.handler.ServeDNS(&keepaliveResponseWriter{ResponseWriter: w,
+		req: req, idleTimeout: kh.idleTimeout}, req)
+}
+
+// keepaliveResponseWriter adds the idle timeout to the responses to the
+// queries with EDNS.
+type keepaliveResponseWriter struct {
+	dns.ResponseWriter
+	req         *dns.Msg
+	idleTimeout time.Duration
+}
+
+func (w *keepaliveResponseWriter) WriteMsg(msg *dns.Msg) error {
+	if msg != nil && w.req.IsEdns0() != nil {
+		if opt := msg.IsEdns0(); opt != nil {
+			RemoveEDNSOption(msg, dns.EDNS0TCPKEEPALIVE)
+			timeout := min(w.idleTimeout/TCPKeepaliveUnit, math.MaxUint16)
+			opt.Option = append(opt.Option, &dns.EDNS0_TCP_KEEPALIVE{
+				Code: dns.EDNS0TCPKEEPALIVE, Timeout: uint16(timeout)})
+		}
+	}
+	return w.ResponseWriter.WriteMsg(msg)
+}
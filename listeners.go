@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"golang.org/x/net/netutil"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Listener is the interface that wraps a local server accepting queries.
+// ListenAndServe calls notifyStarted once the server is accepting queries,
+// and Shutdown stops accepting new ones.
+type Listener interface {
+	ListenAndServe(notifyStarted func()) error
+	Shutdown(context.Context) error
+	String() string
+}
+
+// DNSListener is a Listener serving plain DNS or DNS-over-TLS. Over TCP,
+// at most maxConns client connections are accepted at once, if set.
+type DNSListener struct {
+	*dns.Server
+	maxConns int
+}
+
+func (dl *DNSListener) ListenAndServe(notifyStarted func()) error {
+	dl.NotifyStartedFunc = notifyStarted
+	if dl.maxConns <= 0 || dl.Net == UDPProto {
+		return dl.Server.ListenAndServe()
+	}
+	l, err := net.Listen(TCPProto, dl.Addr)
+	if err != nil {
+		return err
+	}
+	// the connections over the limit wait in the backlog
+	l = netutil.LimitListener(l, dl.maxConns)
+	if dl.Net == TLSProto {
+		l = tls.NewListener(l, dl.TLSConfig)
+	}
+	dl.Listener = l
+	return dl.Server.ActivateAndServe()
+}
+
+func (dl *DNSListener) Shutdown(ctx context.Context) error {
+	return dl.ShutdownContext(ctx)
+}
+
+func (dl *DNSListener) String() string {
+	return fmt.Sprintf("%s server at %s", dl.Net, dl.Addr)
+}
+
+// StartListeners starts all listeners concurrently. The returned channel is
+// closed once every listener is accepting queries, and listener failures
+// are sent to the error channel.
+func StartListeners(listeners []Listener) (<-chan struct{}, <-chan error) {
+	ready := make(chan struct{})
+	errC := make(chan error, len(listeners))
+	var startWG sync.WaitGroup
+	startWG.Add(len(listeners))
+	for _, l := range listeners {
+		log.Printf("Starting %s\n", l.String())
+		go func(l Listener) {
+			var once sync.Once
+			err := l.ListenAndServe(func() {
+				once.Do(func() {
+					log.Printf("Listening: %s\n", l.String())
+					startWG.Done()
+				})
+			})
+			if err != nil {
+				errC <- fmt.Errorf("%s: %w", l.String(), err)
+			}
+		}(l)
+	}
+	go func() {
+		startWG.Wait()
+		close(ready)
+	}()
+	return ready, errC
+}
+
+// ShutdownListeners stops all listeners from accepting new queries.
+func ShutdownListeners(ctx context.Context, listeners []Listener) error {
+	errs := make([]error, 0)
+	for _, l := range listeners {
+		if err := l.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", l.String(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// bufferedResponseWriter is the dns.ResponseWriter for a single query that
+// arrived over a transport not handled by dns.Server. The response is kept
+// for the listener to send, and ctx is done once the client goes away.
+type bufferedResponseWriter struct {
+	ctx        context.Context
+	localAddr  net.Addr
+	remoteAddr net.Addr
+	resp       *dns.Msg
+}
+
+// NewListeners creates the servers for a listener config. The default
+// protocol listens on both UDP and TCP.
+func NewListeners(lc *ServerConfig, handler dns.Handler) ([]Listener,
+	error) {
+	addr := net.TCPAddr{IP: lc.IP, Port: int(lc.Port)}
+	switch lc.Proto {
+	case DefaultProto:
+		return []Listener{
+			&DNSListener{Server: &dns.Server{
+				Addr: addr.String(), Net: UDPProto,
+				Handler: &TruncatingHandler{handler: handler},
+			}},
+			NewTCPListener(lc, TCPProto, handler),
+		}, nil
+	case UDPProto:
+		return []Listener{
+			&DNSListener{Server: &dns.Server{
+				Addr: addr.String(), Net: lc.Proto,
+				Handler: &TruncatingHandler{handler: handler},
+			}},
+		}, nil
+	case TCPProto:
+		return []Listener{NewTCPListener(lc, TCPProto, handler)}, nil
+	case TLSProto:
+		cr, err := NewCertReloader(lc.CertFile, lc.KeyFile,
+			lc.GenerateCert, CertHosts(lc))
+		if err != nil {
+			return nil, err
+		}
+		dl := NewTCPListener(lc, TLSProto, handler)
+		dl.TLSConfig = cr.TLSConfig()
+		// the padding goes last, around the keepalive option
+		dl.Handler = &PaddingHandler{handler: dl.Handler}
+		return []Listener{dl}, nil
+	case HTTPSProto:
+		ds, err := NewDoHServer(lc, handler)
+		if err != nil {
+			return nil, err
+		}
+		return []Listener{ds}, nil
+	case QUICProto:
+		qs, err := NewDoQServer(lc, handler)
+		if err != nil {
+			return nil, err
+		}
+		return []Listener{qs}, nil
+	default:
+		return nil, fmt.Errorf("invalid protocol %s for the local server %s",
+			lc.Proto, lc.String())
+	}
+}
+
+// NewTCPListener creates a TCP or DNS-over-TLS server closing the client
+// connections after the idle timeout of the listener, and telling the
+// clients about it (RFC 7828).
+func NewTCPListener(lc *ServerConfig, proto string,
+	handler dns.Handler) *DNSListener {
+	addr := net.TCPAddr{IP: lc.IP, Port: int(lc.Port)}
+	idleTimeout := time.Duration(lc.IdleTimeout) * time.Second
+	return &DNSListener{
+		Server: &dns.Server{
+			Addr: addr.String(),
+			Net:  proto,
+			Handler: &KeepaliveHandler{handler: handler,
+				idleTimeout: idleTimeout},
+			IdleTimeout: func() time.Duration { return idleTimeout },
+		},
+		maxConns: lc.MaxConns,
+	}
+}
+
+// CertHosts returns the host names and addresses a self-signed certificate
+// for the listener should be valid for.
+func CertHosts(lc *ServerConfig) []string {
+	hosts := make([]string, 0, 2)
+	if hostname, err := os.Hostname(); err == nil {
+		hosts = append(hosts, hostname)
+	}
+	if lc.IP != nil && !lc.IP.IsUnspecified() {
+		hosts = append(hosts, lc.IP.String())
+	}
+	return hosts
+}
+
+func (w *bufferedResponseWriter) Context() context.Context {
+	return w.ctx
+}
+
+func (w *bufferedResponseWriter) LocalAddr() net.Addr {
+	return w.localAddr
+}
+
+func (w *bufferedResponseWriter) RemoteAddr() net.Addr {
+	return w.remoteAddr
+}
+
+func (w *bufferedResponseWriter) WriteMsg(msg *dns.Msg) error {
+	if msg == nil {
+		return fmt.Errorf("%w: *bufferedResponseWriter.WriteMsg()",
+			NilArgumentError)
+	}
+	w.resp = msg
+	return nil
+}
+
+func (w *bufferedResponseWriter) Write(b []byte) (int, error) {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(b); err != nil {
+		return 0, err
+	}
+	w.resp = msg
+	return len(b), nil
+}
+
+func (w *bufferedResponseWriter) Close() error {
+	return nil
+}
+
+func (w *bufferedResponseWriter) TsigStatus() error {
+	return nil
+}
+
+func (w *bufferedResponseWriter) TsigTimersOnly(bool) {}
+
+func (w *bufferedResponseWriter) Hijack() {}
@@ -1,33 +1,49 @@
 package main
 
 import (
-	"github.com/miekg/dns"
+	"context"
 	"log"
 	"net"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
-var GlobalConfig *LiteDNSConfig
+// GlobalConfig is the active config, swapped in by the reloads
+var GlobalConfig atomic.Pointer[LiteDNSConfig]
 var OfficialTLDs map[string]struct{}
 
 const CONFIG_FILENAME = "litedns.conf"
 const STAT_PRINT_INTERVAL = 900
 
+// Process exit codes
+const (
+	ExitOK              = 0
+	ExitStartupFailure  = 1
+	ExitServerFailure   = 2
+	ExitShutdownTimeout = 3
+)
+
 func main() {
-	Run()
+	os.Exit(Run())
 }
 
-func Run() {
-	if cfg, err := LoadConfig(CONFIG_FILENAME); err != nil {
-		log.Fatalf("Unable to load config: %s\n", err.Error())
-	} else {
-		log.Printf("Loaded LiteDNS config from %s",
-			CONFIG_FILENAME)
-		GlobalConfig = cfg
+// Run starts LiteDNS, and blocks until it is shut down by a signal or a
+// server failure. It returns the process exit code.
+func Run() int {
+	cfg, err := LoadConfig(CONFIG_FILENAME)
+	if err != nil {
+		log.Printf("Unable to load config: %s\n", err.Error())
+		return ExitStartupFailure
 	}
+	log.Printf("Loaded LiteDNS config from %s", CONFIG_FILENAME)
+	GlobalConfig.Store(cfg)
 
-	if tlds, err := LatestTLDs(GlobalConfig.UpstreamServers); err != nil {
-		log.Fatalf("Unable to load IANA TLD list: %s\n", err.Error())
+	if tlds, err := LatestTLDs(cfg.HTTPResolvers()); err != nil {
+		log.Printf("Unable to load IANA TLD list: %s\n", err.Error())
+		return ExitStartupFailure
 	} else {
 		log.Printf("Loaded IANA TLD list, total %d", len(tlds))
 		OfficialTLDs = tlds
@@ -38,7 +54,8 @@ func Run() {
 		tldUpdateT := time.NewTimer(tldUpdateInterval)
 		for {
 			<-tldUpdateT.C
-			tlds, err := LatestTLDs(GlobalConfig.UpstreamServers)
+			// the config may have been reloaded since
+			tlds, err := LatestTLDs(GlobalConfig.Load().HTTPResolvers())
 			if err != nil {
 				log.Printf("Unable to load IANA TLD list: %s\n",
 					err.Error())
@@ -49,60 +66,107 @@ func Run() {
 		}
 	}()
 
-	cache := NewDNSCache(GlobalConfig.CacheConfig)
-	adb := NewAdBlockerHTTP(GlobalConfig.UpstreamServers,
-		GlobalConfig.AdBlocker.ABPFilterURL)
-	uPool := NewDNSClientPool(GlobalConfig.UpstreamServers)
-	lPool := NewDNSClientPool(GlobalConfig.LocalNameServers)
-
-	handler := NewDNSHandler(cache, adb, uPool, lPool)
-
-	dns.Handle(".", handler)
+	state, err := NewHandlerState(cfg, nil)
+	if err != nil {
+		log.Printf("Unable to initialize LiteDNS: %s\n", err.Error())
+		return ExitStartupFailure
+	}
+	handler := NewDNSHandler(state)
 
-	listenAddr := GlobalConfig.ListenerConfig.IP
-	listenPort := GlobalConfig.ListenerConfig.Port
+	reloader := NewConfigReloader(CONFIG_FILENAME, handler)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go reloader.Watch(hup)
 
-	udpAddr := net.TCPAddr{IP: listenAddr, Port: int(listenPort)}
-	tcpAddr := net.TCPAddr{IP: listenAddr, Port: int(listenPort)}
-	// start server
-	udpServer := &dns.Server{Addr: udpAddr.String(), Net: UDPProto}
-	log.Printf("Starting UDP server at %v\n", udpAddr.String())
-	tcpServer := &dns.Server{Addr: tcpAddr.String(), Net: TCPProto}
-	log.Printf("Starting TCP server at %v\n", tcpAddr.String())
-	udperr := udpServer.ListenAndServe()
-	tcperr := tcpServer.ListenAndServe()
+	servers := make([]Listener, 0, len(cfg.ListenerConfig))
+	for _, lc := range cfg.ListenerConfig {
+		srvs, err := NewListeners(lc, handler)
+		if err != nil {
+			log.Printf("Unable to create the server at %s: %s\n",
+				lc.String(), err.Error())
+			return ExitStartupFailure
+		}
+		servers = append(servers, srvs...)
+	}
 
 	go func() {
 		StatTimer := time.NewTicker(STAT_PRINT_INTERVAL * time.Second)
 		for {
 			<-StatTimer.C
 			PrintStat()
+			PrintUpstreamStat(handler.State().upstreamClients)
+			PrintUpstreamStat(handler.State().localResolvClients)
+			for _, pool := range handler.State().forwardingClients {
+				PrintUpstreamStat(pool)
+			}
 		}
 	}()
 
-	defer func(udpSrv, tcpSrv *dns.Server) {
-		sderr1 := udpSrv.Shutdown()
-		sderr2 := tcpSrv.Shutdown()
-		if sderr1 != nil {
-			if sderr2 != nil {
-				log.Printf("Error while shutting down the TCP server: %s\n ",
-					sderr2.Error())
-			}
-			log.Fatalf("Error while shutting down the UDP server: %s\n",
-				sderr1.Error())
-		}
-		if sderr2 != nil {
-			log.Fatalf("Error while shutting down the TCP server: %s\n",
-				sderr1.Error())
+	// start server
+	ctx, stop := signal.NotifyContext(context.Background(),
+		syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	ready, srvErr := StartListeners(servers)
+	exitCode := ExitOK
+	select {
+	case <-ready:
+		log.Printf("LiteDNS is ready with %d listeners\n", len(servers))
+		NotifySystemd("READY=1")
+		select {
+		case <-ctx.Done():
+			log.Printf("Received signal, shutting down\n")
+		case err := <-srvErr:
+			log.Printf("Server failure: %s\n", err.Error())
+			exitCode = ExitServerFailure
 		}
-	}(udpServer, tcpServer)
-	if udperr != nil {
-		if tcperr != nil {
-			log.Printf("Failed to start TCP server: %s\n", tcperr.Error())
+	case <-ctx.Done():
+		log.Printf("Received signal during startup, shutting down\n")
+	case err := <-srvErr:
+		log.Printf("Failed to start server: %s\n", err.Error())
+		exitCode = ExitServerFailure
+	}
+	// a second signal terminates immediately
+	stop()
+	NotifySystemd("STOPPING=1")
+
+	timeout := time.Duration(GlobalConfig.Load().ShutdownTimeout) *
+		time.Second
+	sdCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := ShutdownListeners(sdCtx, servers); err != nil {
+		log.Printf("Error while shutting down the servers: %s\n",
+			err.Error())
+	}
+	if err := handler.Drain(sdCtx); err != nil {
+		log.Printf("Unable to finish in-flight queries: %s\n", err.Error())
+		if exitCode == ExitOK {
+			exitCode = ExitShutdownTimeout
 		}
-		log.Fatalf("Failed to start UDP server: %s\n", udperr.Error())
 	}
-	if tcperr != nil {
-		log.Fatalf("Failed to start TCP server: %s\n", tcperr.Error())
+	PrintStat()
+	PrintUpstreamStat(handler.State().upstreamClients)
+	PrintUpstreamStat(handler.State().localResolvClients)
+	log.Printf("LiteDNS stopped\n")
+	_ = os.Stderr.Sync()
+	return exitCode
+}
+
+// NotifySystemd sends a state update to the service manager if LiteDNS was
+// started as a systemd notify service.
+func NotifySystemd(state string) {
+	socketAddr := os.Getenv("NOTIFY_SOCKET")
+	if socketAddr == "" {
+		return
+	}
+	conn, err := net.Dial("unixgram", socketAddr)
+	if err != nil {
+		log.Printf("Unable to notify systemd: %s\n", err.Error())
+		return
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	if _, err = conn.Write([]byte(state)); err != nil {
+		log.Printf("Unable to notify systemd: %s\n", err.Error())
 	}
 }
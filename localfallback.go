@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"log"
+	"strings"
+)
+
+// Fallback actions for the local queries the local name servers do not
+// answer
+const (
+	// the query is sent to the upstream servers
+	FallbackUpstream = "upstream"
+	// NXDOMAIN is synthesized, or NODATA for the apex of a private reverse
+	// zone
+	FallbackNXDomain = "nxdomain"
+	// NODATA is synthesized
+	FallbackNoData = "nodata"
+	// SERVFAIL is returned
+	FallbackServFail = "servfail"
+)
+
+// RFC 6303 Section 4 and RFC 6598: the reverse zones of the private and
+// special addresses, which are never sent upstream
+var PrivateReverseZones = func() map[string]struct{} {
+	zones := []string{
+		"0.in-addr.arpa.", "10.in-addr.arpa.", "127.in-addr.arpa.",
+		"254.169.in-addr.arpa.", "168.192.in-addr.arpa.",
+		"2.0.192.in-addr.arpa.", "100.51.198.in-addr.arpa.",
+		"113.0.203.in-addr.arpa.", "255.255.255.255.in-addr.arpa.",
+		"d.f.ip6.arpa.", "8.e.f.ip6.arpa.", "9.e.f.ip6.arpa.",
+		"a.e.f.ip6.arpa.", "b.e.f.ip6.arpa.", "8.b.d.0.1.0.0.2.ip6.arpa.",
+		strings.Repeat("0.", 32) + "ip6.arpa.",
+		"1." + strings.Repeat("0.", 31) + "ip6.arpa.",
+	}
+	for i := 16; i < 32; i++ {
+		zones = append(zones, fmt.Sprintf("%d.172.in-addr.arpa.", i))
+	}
+	for i := 64; i < 128; i++ {
+		zones = append(zones, fmt.Sprintf("%d.100.in-addr.arpa.", i))
+	}
+	m := make(map[string]struct{}, len(zones))
+	for _, z := range zones {
+		m[z] = struct{}{}
+	}
+	return m
+}()
+
+// PrivateReverseZone returns the private reverse zone the name is in.
+func PrivateReverseZone(name string) (string, bool) {
+	cname := dns.CanonicalName(name)
+	for off, end := 0, false; !end; off, end = dns.NextLabel(cname, off) {
+		if _, ok := PrivateReverseZones[cname[off:]]; ok {
+			return cname[off:], true
+		}
+	}
+	return "", false
+}
+
+// ResolveLocal sends a local query to the local name servers, and goes down
+// the fallback chain of the name if there are none, or they fail to answer.
+// The private reverse zones have a chain of their own, as they must not be
+// leaked upstream. It returns nil if there is no response to give, and the
+// pool the response came from, whose DNSSEC policy applies to it.
+func (st *HandlerState) ResolveLocal(ctx context.Context, req *dns.Msg,
+	uReq *dns.Msg) (*dns.Msg, *DNSClientPool) {
+	var resp *dns.Msg
+	var reason error
+	pool := st.localResolvClients
+	if st.localResolvClients.Len() == 0 {
+		reason = errors.New("no local name server")
+	} else {
+		resp, reason = st.localResolvClients.ExchangeContext(ctx, uReq)
+		if reason == nil && !IsServerFailure(resp) {
+			return resp, pool
+		}
+		if reason == nil {
+			reason = fmt.Errorf("%s from the local name servers",
+				dns.RcodeToString[resp.Rcode])
+		}
+	}
+	q := req.Question[0]
+	zone, isPrivate := PrivateReverseZone(q.Name)
+	chain := st.config.LocalFallback.Names
+	if isPrivate {
+		chain = st.config.LocalFallback.PrivateReverseZones
+	}
+	for _, action := range chain {
+		log.Printf("Falling back to %s for the local query %s: %s", action,
+			q.String(), reason.Error())
+		switch action {
+		case FallbackUpstream:
+			// the upstream responses are validated here as the others
+			upstreamReq := uReq
+			if st.IsValidated(st.upstreamClients) && !uReq.CheckingDisabled {
+				upstreamReq = uReq.Copy()
+				upstreamReq.CheckingDisabled = true
+			}
+			uResp, err := st.upstreamClients.ExchangeContext(ctx,
+				upstreamReq)
+			if err == nil && !IsServerFailure(uResp) {
+				return uResp, st.upstreamClients
+			}
+			if err == nil {
+				err = fmt.Errorf("%s from the upstream servers",
+					dns.RcodeToString[uResp.Rcode])
+			}
+			reason, resp, pool = err, uResp, st.upstreamClients
+		case FallbackNXDomain:
+			// the apex of a zone exists even if nothing else does
+			if isPrivate && dns.CanonicalName(q.Name) == zone {
+				return CreateLocalNegativeResp(req, zone,
+					dns.RcodeSuccess), st.localResolvClients
+			}
+			return CreateLocalNegativeResp(req, zone, dns.RcodeNameError),
+				st.localResolvClients
+		case FallbackNoData:
+			return CreateLocalNegativeResp(req, zone, dns.RcodeSuccess),
+				st.localResolvClients
+		case FallbackServFail:
+			// answered with SERVFAIL by the handler, which does not cache it
+			return nil, st.localResolvClients
+		}
+	}
+	log.Printf("No fallback left for the local query %s: %s", q.String(),
+		reason.Error())
+	return resp, pool
+}
+
+// IsServerFailure checks if the response tells that the server could not
+// answer, rather than that the name does not exist.
+func IsServerFailure(resp *dns.Msg) bool {
+	return resp == nil || resp.Rcode == dns.RcodeServerFailure ||
+		resp.Rcode == dns.RcodeRefused
+}
+
+// CreateLocalNegativeResp creates an NXDOMAIN or NODATA response with the
+// SOA record of the zone in the authority section (RFC 6303 Section 3), if
+// the zone is given.
+func CreateLocalNegativeResp(req *dns.Msg, zone string, rcode int) *dns.Msg {
+	resp := CreateNXResp(req)
+	resp.Rcode = rcode
+	resp.Authoritative = zone != ""
+	if zone != "" {
+		resp.Ns = []dns.RR{&dns.SOA{
+			Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA,
+				Class: dns.ClassINET, Ttl: DefaultNegativeCacheTTL},
+			Ns:      zone,
+			Mbox:    "nobody.invalid.",
+			Serial:  1,
+			Refresh: 3600,
+			Retry:   1200,
+			Expire:  604800,
+			Minttl:  DefaultNegativeCacheTTL,
+		}}
+	}
+	return resp
+}
@@ -78,6 +78,7 @@ func (c *LRUCache[T]) Add(x T) (int, bool, T) {
 		c.unused = c.unused.next
 		node.next = nil
 		c.data[node.idx].value = x
+		c.data[node.idx].node = node
 		c.size++
 	} else {
 		node = &dlNode{idx: len(c.data)}
@@ -124,13 +125,11 @@ func (c *LRUCache[T]) Purge(shouldDelete func(T) bool) []T {
 	defer c.mutex.Unlock()
 	purged = make([]T, 0)
 	for i := 0; i < len(c.data); i++ {
-		if !shouldDelete(c.data[i].value) {
+		// a deleted entry is left in place until its slot is reused
+		if c.data[i].node == nil || !shouldDelete(c.data[i].value) {
 			continue
 		}
 		purged = append(purged, c.data[i].value)
-		if c.data[i].node == nil {
-			continue
-		}
 		node := c.data[i].node.extract()
 		c.data[i].node = nil
 		node.next = c.unused
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+)
+
+// RFC 8467 Section 4.1: the block lengths messages are padded to
+const QueryPaddingBlock = 128
+const ResponsePaddingBlock = 468
+
+// PadMsg adds an EDNS padding option (RFC 7830) to the message, so that
+// its length is a multiple of the block length. Messages without EDNS are
+// left as is, as are messages the padding would grow past the limit.
+func PadMsg(msg *dns.Msg, block int) {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return
+	}
+	StripPadding(msg)
+	// the option code and length take 4 bytes
+	n := msg.Len() + 4
+	padLen := (block - n%block) % block
+	if n+padLen > dns.MaxMsgSize {
+		return
+	}
+	opt.Option = append(opt.Option,
+		&dns.EDNS0_PADDING{Padding: make([]byte, padLen)})
+}
+
+// StripPadding removes the EDNS padding options from the message.
+func StripPadding(msg *dns.Msg) {
+	RemoveEDNSOption(msg, dns.EDNS0PADDING)
+}
+
+// PadResponse pads the response to a query over an encrypted transport.
+// RFC 7830 Section 4: a response is padded only if the query has EDNS.
+func PadResponse(req *dns.Msg, resp *dns.Msg) {
+	if req.IsEdns0() == nil {
+		return
+	}
+	PadMsg(resp, ResponsePaddingBlock)
+}
+
+// PaddingHandler pads the responses of a handler serving DNS-over-TLS.
+type PaddingHandler struct {
+	handler dns.Handler
+}
+
+func (ph *PaddingHandler) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	ph.handler.ServeDNS(&paddingResponseWriter{ResponseWriter: w, req: req},
+		req)
+}
+
+// paddingResponseWriter pads the responses it writes to the query.
+type paddingResponseWriter struct {
+	dns.ResponseWriter
+	req *dns.Msg
+}
+
+func (w *paddingResponseWriter) WriteMsg(msg *dns.Msg) error {
+	if msg != nil {
+		PadResponse(w.req, msg)
+	}
+	return w.ResponseWriter.WriteMsg(msg)
+}
@@ -0,0 +1,613 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Upstream selection strategies
+const (
+	StrategyRoundRobin = "roundrobin"
+	StrategyFastest    = "fastest"
+	StrategyWeighted   = "weighted"
+	StrategyRandom     = "random"
+	StrategySequential = "sequential"
+)
+
+// RTTSmoothingFactor is the weight of a new sample in the RTT moving average.
+const RTTSmoothingFactor = 0.2
+
+// FastestExploreRate is the share of the queries the fastest strategy sends
+// to another upstream than the fastest, so that their RTTs stay current.
+const FastestExploreRate = 0.05
+
+// Upstream is a member of DNSClientPool: the client for an upstream server,
+// and the health state of the server.
+type Upstream struct {
+	Client        DNSClient
+	Name          string
+	weight        int
+	currentWeight int
+	healthy       bool
+	failures      int
+	successes     int
+	rtt           time.Duration
+	numQueries    int64
+	numFailures   int64
+	numWins       int64
+	sync.Mutex
+}
+
+// UpstreamStat is a snapshot of the statistics of an Upstream.
+type UpstreamStat struct {
+	Name        string
+	Healthy     bool
+	RTT         time.Duration
+	NumQueries  int64
+	NumFailures int64
+	NumWins     int64
+	NumSpoofed  int64
+	Circuit     string
+}
+
+// DNSClientPool represents a pool of clients, each querying a different
+// upstream DNS server. Servers failing consecutively are taken out of the
+// rotation until the health probes succeed again, and their circuit
+// breakers fail the queries right away until a trial query succeeds. A
+// server given by its host name has an upstream for each of its addresses,
+// which are resolved again when their TTL expires.
+type DNSClientPool struct {
+	servers      []*ServerConfig
+	upstreams    []*Upstream
+	bootstrap    *Bootstrapper
+	strategy     string
+	healthCfg    *HealthCheckConfig
+	breakerCfg   *CircuitBreakerConfig
+	racing       *RacingConfig
+	queryTimeout time.Duration
+	next         atomic.Uint32
+	done         chan struct{}
+	sync.Mutex
+}
+
+// NewDNSClientPool creates a pool of clients picked by the configured
+// strategy, and starts probing the servers periodically.
+func NewDNSClientPool(servers []*ServerConfig,
+	cfg *LiteDNSConfig) *DNSClientPool {
+	healthCfg := cfg.HealthCheck
+	cp := &DNSClientPool{
+		servers:      servers,
+		strategy:     cfg.UpstreamStrategy,
+		healthCfg:    healthCfg,
+		breakerCfg:   cfg.CircuitBreaker,
+		racing:       cfg.Racing,
+		queryTimeout: time.Duration(cfg.QueryTimeout) * time.Millisecond,
+		done:         make(chan struct{}),
+	}
+	addrs := make(map[*ServerConfig][]net.IP)
+	if NeedsBootstrap(servers) {
+		cp.bootstrap = NewBootstrapper(cfg.BootstrapServers)
+		var next time.Duration
+		addrs, next = cp.resolveHosts(addrs)
+		go cp.refreshHosts(addrs, next)
+	}
+	cp.setMembers(addrs)
+	if len(servers) > 0 && healthCfg.Interval > 0 {
+		go func() {
+			probeInterval := time.Duration(healthCfg.Interval) * time.Second
+			probeT := time.NewTicker(probeInterval)
+			defer probeT.Stop()
+			for {
+				select {
+				case <-cp.done:
+					return
+				case <-probeT.C:
+					cp.ProbeAll()
+				}
+			}
+		}()
+	}
+	return cp
+}
+
+// NeedsBootstrap checks if any of the servers is given by its host name.
+func NeedsBootstrap(servers []*ServerConfig) bool {
+	for _, s := range servers {
+		if s.NeedsBootstrap() {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveHosts resolves the host names of the servers through the
+// bootstrap servers, and returns the addresses of each server along with
+// when to resolve them again. The previous addresses are kept on failure.
+func (cp *DNSClientPool) resolveHosts(
+	prev map[*ServerConfig][]net.IP) (map[*ServerConfig][]net.IP,
+	time.Duration) {
+	addrs := make(map[*ServerConfig][]net.IP, len(prev))
+	next := time.Duration(DefaultMaxTTL) * time.Second
+	for _, s := range cp.servers {
+		if !s.NeedsBootstrap() {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(),
+			cp.queryTimeout)
+		ips, ttl, err := cp.bootstrap.Resolve(ctx, s.Host)
+		cancel()
+		if err != nil {
+			log.Printf("Unable to resolve the upstream %s, keeping %d "+
+				"addresses: %s", s.String(), len(prev[s]), err.Error())
+			addrs[s] = prev[s]
+			ttl = BootstrapRetryInterval * time.Second
+		} else {
+			addrs[s] = ips
+		}
+		if ttl < next {
+			next = ttl
+		}
+	}
+	return addrs, next
+}
+
+// refreshHosts resolves the host names again whenever the addresses
+// expire, and updates the members of the pool.
+func (cp *DNSClientPool) refreshHosts(addrs map[*ServerConfig][]net.IP,
+	next time.Duration) {
+	refreshT := time.NewTimer(next)
+	defer refreshT.Stop()
+	for {
+		select {
+		case <-cp.done:
+			return
+		case <-refreshT.C:
+			addrs, next = cp.resolveHosts(addrs)
+			cp.setMembers(addrs)
+			refreshT.Reset(next)
+		}
+	}
+}
+
+// setMembers updates the upstreams from the servers and the addresses of
+// their host names. The upstreams of the addresses still present are kept
+// with their health state, and the clients of the others are closed once
+// their in-flight queries had the time to finish.
+func (cp *DNSClientPool) setMembers(addrs map[*ServerConfig][]net.IP) {
+	cp.Lock()
+	old := make(map[string]*Upstream, len(cp.upstreams))
+	for _, u := range cp.upstreams {
+		old[u.Name] = u
+	}
+	members := make([]*Upstream, 0, len(cp.servers))
+	addMember := func(s *ServerConfig) {
+		name := UpstreamName(s)
+		if u, ok := old[name]; ok {
+			members = append(members, u)
+			delete(old, name)
+			return
+		}
+		members = append(members, &Upstream{
+			Client:  NewCircuitBreaker(NewDNSClient(s), name, cp.breakerCfg),
+			Name:    name,
+			weight:  s.Weight,
+			healthy: true,
+		})
+	}
+	for _, s := range cp.servers {
+		if !s.NeedsBootstrap() {
+			addMember(s)
+			continue
+		}
+		ips := CloneSlice(addrs[s])
+		sort.Slice(ips, func(i, j int) bool {
+			return ips[i].String() < ips[j].String()
+		})
+		for _, ip := range ips {
+			member := *s
+			member.IP = ip
+			addMember(&member)
+		}
+	}
+	cp.upstreams = members
+	cp.Unlock()
+	if len(old) > 0 {
+		time.AfterFunc(cp.queryTimeout, func() {
+			for _, u := range old {
+				closeClient(u.Client)
+			}
+		})
+	}
+}
+
+// UpstreamName names the upstream of a server, with its host name if the
+// address was resolved from it.
+func UpstreamName(s *ServerConfig) string {
+	if s.Host != "" && s.IP != nil {
+		return fmt.Sprintf("%s at %s", s.Host, s.String())
+	}
+	return s.String()
+}
+
+// members returns the current upstreams of the pool.
+func (cp *DNSClientPool) members() []*Upstream {
+	cp.Lock()
+	defer cp.Unlock()
+	return cp.upstreams
+}
+
+// Len returns the number of upstream servers in the pool.
+func (cp *DNSClientPool) Len() int {
+	return len(cp.members())
+}
+
+// Pick returns the next healthy upstream chosen by the pool strategy,
+// skipping the ones already tried. If no healthy upstream is left, it falls
+// back to the unhealthy ones. It returns nil if every upstream was tried.
+func (cp *DNSClientPool) Pick(tried []*Upstream) *Upstream {
+	candidates := cp.candidates(tried)
+	if len(candidates) == 0 {
+		return nil
+	}
+	switch cp.strategy {
+	case StrategyFastest:
+		return cp.pickFastest(candidates)
+	case StrategyWeighted:
+		return cp.pickWeighted(candidates)
+	case StrategyRandom:
+		return candidates[rand.Intn(len(candidates))]
+	case StrategySequential:
+		return candidates[0]
+	default:
+		i := cp.next.Add(1) % uint32(len(candidates))
+		return candidates[i]
+	}
+}
+
+// candidates returns the healthy upstreams not tried yet, or the unhealthy
+// ones if there is none, in the configured order. An upstream with an open
+// circuit counts as unhealthy.
+func (cp *DNSClientPool) candidates(tried []*Upstream) []*Upstream {
+	upstreams := cp.members()
+	healthy := make([]*Upstream, 0, len(upstreams))
+	unhealthy := make([]*Upstream, 0)
+	for _, u := range upstreams {
+		if containsUpstream(tried, u) {
+			continue
+		}
+		if u.IsHealthy() && CircuitState(u.Client) != CircuitOpen {
+			healthy = append(healthy, u)
+		} else {
+			unhealthy = append(unhealthy, u)
+		}
+	}
+	if len(healthy) > 0 {
+		return healthy
+	}
+	return unhealthy
+}
+
+// pickFastest picks the upstream with the lowest average RTT, except for a
+// share of the queries sent to a random other one to measure it again.
+func (cp *DNSClientPool) pickFastest(candidates []*Upstream) *Upstream {
+	fastest := fastestUpstream(candidates, cp.queryTimeout)
+	if len(candidates) < 2 || rand.Float64() >= FastestExploreRate {
+		return fastest
+	}
+	i := rand.Intn(len(candidates) - 1)
+	if candidates[i] == fastest {
+		i = len(candidates) - 1
+	}
+	return candidates[i]
+}
+
+// fastestUpstream returns the upstream with the lowest average RTT. An
+// upstream without any measurement yet, neither from the queries nor from
+// the health probes, counts as answering in the given time.
+func fastestUpstream(candidates []*Upstream,
+	unmeasured time.Duration) *Upstream {
+	var fastest *Upstream
+	var fastestRTT time.Duration
+	for _, u := range candidates {
+		rtt := u.RTT()
+		if rtt == 0 {
+			rtt = unmeasured
+		}
+		if fastest == nil || rtt < fastestRTT {
+			fastest, fastestRTT = u, rtt
+		}
+	}
+	return fastest
+}
+
+// pickWeighted implements the smooth weighted round-robin, which spreads
+// the picks of each upstream evenly in proportion to its weight.
+func (cp *DNSClientPool) pickWeighted(candidates []*Upstream) *Upstream {
+	cp.Lock()
+	defer cp.Unlock()
+	var picked *Upstream
+	totalWeight := 0
+	for _, u := range candidates {
+		u.currentWeight += u.weight
+		totalWeight += u.weight
+		if picked == nil || u.currentWeight > picked.currentWeight {
+			picked = u
+		}
+	}
+	picked.currentWeight -= totalWeight
+	return picked
+}
+
+func containsUpstream(us []*Upstream, u *Upstream) bool {
+	for _, x := range us {
+		if x == u {
+			return true
+		}
+	}
+	return false
+}
+
+// Exchange sends the request to the upstream, and records the outcome in
+// its health state. A query cancelled by the caller or stopped by the
+// circuit breaker is not held against the upstream, but one that runs out
+// of time is.
+func (cp *DNSClientPool) Exchange(ctx context.Context, u *Upstream,
+	req *dns.Msg) (*dns.Msg, error) {
+	tStart := time.Now()
+	resp, err := u.Client.ExchangeContext(ctx, req)
+	if err == nil && resp == nil {
+		err = errors.New("empty response")
+	}
+	if err != nil {
+		if !errors.Is(err, context.Canceled) &&
+			!errors.Is(err, CircuitOpenError) {
+			u.ReportFailure(cp.healthCfg, err)
+		}
+		return nil, err
+	}
+	u.ReportSuccess(cp.healthCfg, time.Since(tStart))
+	return resp, nil
+}
+
+// ExchangeContext sends the request to an upstream in the pool, or races it
+// across several upstreams if configured so for the name. If the exchange
+// fails or the upstream answers SERVFAIL, it retries on the next healthy
+// upstream until the context is done. The last response received is
+// returned, even if it is SERVFAIL.
+func (cp *DNSClientPool) ExchangeContext(ctx context.Context,
+	req *dns.Msg) (*dns.Msg, error) {
+	tried := make([]*Upstream, 0, UpstreamMaxAttempts)
+	var resp *dns.Msg
+	err := errors.New("no upstream to query")
+	if n := cp.racing.CountFor(req.Question[0].Name); n > 1 {
+		resp, tried = cp.Race(ctx, req, n)
+		if resp != nil && resp.Rcode != dns.RcodeServerFailure {
+			return resp, nil
+		}
+	}
+	for len(tried) < UpstreamMaxAttempts && ctx.Err() == nil {
+		u := cp.Pick(tried)
+		if u == nil {
+			break
+		}
+		tried = append(tried, u)
+		var uResp *dns.Msg
+		uResp, err = cp.Exchange(ctx, u, req)
+		if err != nil {
+			log.Printf("Upstream %s failed for %s: %s",
+				u.Name, req.Question[0].String(), err.Error())
+			continue
+		}
+		resp = uResp
+		if resp.Rcode != dns.RcodeServerFailure {
+			break
+		}
+	}
+	if resp != nil {
+		return resp, nil
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return nil, err
+}
+
+// Race sends the request to n upstreams at once, and returns the first
+// valid answer that is not SERVFAIL, along with the upstreams it was sent
+// to. The slower queries are cancelled.
+func (cp *DNSClientPool) Race(ctx context.Context, req *dns.Msg,
+	n int) (*dns.Msg, []*Upstream) {
+	racers := make([]*Upstream, 0, n)
+	for len(racers) < n {
+		u := cp.Pick(racers)
+		if u == nil {
+			break
+		}
+		racers = append(racers, u)
+	}
+	type raceResult struct {
+		u    *Upstream
+		resp *dns.Msg
+	}
+	raceCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan raceResult, len(racers))
+	for _, u := range racers {
+		go func(u *Upstream) {
+			resp, _ := cp.Exchange(raceCtx, u, req)
+			results <- raceResult{u: u, resp: resp}
+		}(u)
+	}
+	var fallback *dns.Msg
+	for range racers {
+		r := <-results
+		if r.resp == nil {
+			continue
+		}
+		if r.resp.Rcode == dns.RcodeServerFailure {
+			fallback = r.resp
+			continue
+		}
+		r.u.Lock()
+		r.u.numWins++
+		r.u.Unlock()
+		return r.resp, racers
+	}
+	return fallback, racers
+}
+
+// ProbeAll sends the health probe query to every upstream concurrently.
+func (cp *DNSClientPool) ProbeAll() {
+	var wg sync.WaitGroup
+	for _, u := range cp.members() {
+		wg.Add(1)
+		go func(u *Upstream) {
+			defer wg.Done()
+			u.Probe(cp.healthCfg, cp.queryTimeout)
+		}(u)
+	}
+	wg.Wait()
+}
+
+// Stats returns the statistics of every upstream in the pool.
+func (cp *DNSClientPool) Stats() []UpstreamStat {
+	upstreams := cp.members()
+	stats := make([]UpstreamStat, len(upstreams))
+	for i, u := range upstreams {
+		stats[i] = u.Stat()
+	}
+	return stats
+}
+
+// Close stops probing the upstream servers, and closes the connections
+// kept open by the clients.
+func (cp *DNSClientPool) Close() {
+	close(cp.done)
+	for _, u := range cp.members() {
+		closeClient(u.Client)
+	}
+	if cp.bootstrap != nil {
+		cp.bootstrap.Close()
+	}
+}
+
+func closeClient(c DNSClient) {
+	if closer, ok := c.(io.Closer); ok {
+		_ = closer.Close()
+	}
+}
+
+// Probe queries the upstream with the health check query, and updates the
+// health state with the result. The probe bypasses the circuit breaker,
+// which only follows the real traffic.
+func (u *Upstream) Probe(healthCfg *HealthCheckConfig,
+	timeout time.Duration) {
+	probe := new(dns.Msg)
+	probe.SetQuestion(healthCfg.QueryName, healthCfg.QueryType.Value)
+	probe.RecursionDesired = true
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	client := u.Client
+	if cb, ok := client.(*CircuitBreaker); ok {
+		client = cb.client
+	}
+	tStart := time.Now()
+	resp, err := client.ExchangeContext(ctx, probe)
+	switch {
+	case err != nil:
+		u.ReportFailure(healthCfg, err)
+	case resp == nil || resp.Rcode == dns.RcodeServerFailure:
+		u.ReportFailure(healthCfg, fmt.Errorf("server failure on probe"))
+	default:
+		u.ReportSuccess(healthCfg, time.Since(tStart))
+	}
+}
+
+func (u *Upstream) IsHealthy() bool {
+	u.Lock()
+	defer u.Unlock()
+	return u.healthy
+}
+
+// RTT returns the exponentially weighted moving average of the round trip
+// time, or 0 if the upstream has not answered yet.
+func (u *Upstream) RTT() time.Duration {
+	u.Lock()
+	defer u.Unlock()
+	return u.rtt
+}
+
+func (u *Upstream) Stat() UpstreamStat {
+	u.Lock()
+	defer u.Unlock()
+	return UpstreamStat{
+		Name:        u.Name,
+		Healthy:     u.healthy,
+		RTT:         u.rtt,
+		NumQueries:  u.numQueries,
+		NumFailures: u.numFailures,
+		NumWins:     u.numWins,
+		NumSpoofed:  NumSpoofed(u.Client),
+		Circuit:     CircuitState(u.Client),
+	}
+}
+
+// NumSpoofed returns the number of responses the client dropped as
+// suspected spoofing, if it checks for them.
+func NumSpoofed(c DNSClient) int64 {
+	if sc, ok := c.(interface{ NumSpoofed() int64 }); ok {
+		return sc.NumSpoofed()
+	}
+	return 0
+}
+
+// ReportFailure records a failed exchange, and marks the upstream down
+// after too many consecutive failures.
+func (u *Upstream) ReportFailure(healthCfg *HealthCheckConfig, err error) {
+	u.Lock()
+	defer u.Unlock()
+	u.numQueries++
+	u.numFailures++
+	u.successes = 0
+	u.failures++
+	if u.healthy && u.failures >= healthCfg.FailThreshold {
+		u.healthy = false
+		log.Printf("Upstream %s is down after %d failures: %s",
+			u.Name, u.failures, err.Error())
+	}
+}
+
+// ReportSuccess records a successful exchange with its round trip time, and
+// restores a down upstream after enough consecutive successes.
+func (u *Upstream) ReportSuccess(healthCfg *HealthCheckConfig,
+	rtt time.Duration) {
+	u.Lock()
+	defer u.Unlock()
+	u.numQueries++
+	if u.rtt == 0 {
+		u.rtt = rtt
+	} else {
+		u.rtt = time.Duration(RTTSmoothingFactor*float64(rtt) +
+			(1-RTTSmoothingFactor)*float64(u.rtt))
+	}
+	u.failures = 0
+	if u.healthy {
+		return
+	}
+	u.successes++
+	if u.successes >= healthCfg.RecoverThreshold {
+		u.healthy = true
+		u.successes = 0
+		log.Printf("Upstream %s is back up", u.Name)
+	}
+}
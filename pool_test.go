@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFastestUpstream(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		name string
+		rtts []time.Duration
+		want int
+	}{
+		{name: "lowest RTT", rtts: []time.Duration{30 * ms, 10 * ms, 20 * ms},
+			want: 1},
+		{name: "unmeasured slower than the measured", rtts: []time.Duration{
+			0, 900 * ms, 0}, want: 1},
+		{name: "unmeasured faster than the measured", rtts: []time.Duration{
+			3 * time.Second, 0}, want: 1},
+		{name: "none measured", rtts: []time.Duration{0, 0}, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			candidates := make([]*Upstream, len(tt.rtts))
+			for i, rtt := range tt.rtts {
+				candidates[i] = &Upstream{rtt: rtt}
+			}
+			got := fastestUpstream(candidates, time.Second)
+			if got != candidates[tt.want] {
+				t.Errorf("got the RTT %s, want the upstream %d", got.rtt,
+					tt.want)
+			}
+		})
+	}
+}
+
+func TestPickFastestExplores(t *testing.T) {
+	cp := &DNSClientPool{strategy: StrategyFastest,
+		queryTimeout: time.Second}
+	for _, rtt := range []time.Duration{10 * time.Millisecond,
+		20 * time.Millisecond, 0} {
+		cp.upstreams = append(cp.upstreams, &Upstream{healthy: true,
+			rtt: rtt})
+	}
+	const n = 20000
+	picks := make(map[*Upstream]int)
+	for i := 0; i < n; i++ {
+		picks[cp.Pick(nil)]++
+	}
+	// the others share the exploring queries evenly
+	explored := float64(n) * FastestExploreRate / 2
+	for i, u := range cp.upstreams[1:] {
+		if got := float64(picks[u]); got < explored/2 || got > explored*2 {
+			t.Errorf("picked the upstream %d %d times, want about %.0f",
+				i+1, picks[u], explored)
+		}
+	}
+	if picks[cp.upstreams[0]] < n*(1-2*FastestExploreRate) {
+		t.Errorf("picked the fastest upstream %d times out of %d",
+			picks[cp.upstreams[0]], n)
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"github.com/miekg/dns"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// proxyStandIn is a SOCKS5 or HTTP CONNECT proxy accepting the user "u"
+// with the password "p". It keeps the addresses it was asked to connect to.
+type proxyStandIn struct {
+	addr    string
+	targets []string
+	sync.Mutex
+}
+
+func startProxyStandIn(t *testing.T, socks bool) *proxyStandIn {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	ps := &proxyStandIn{addr: ln.Addr().String()}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			if socks {
+				go ps.serveSOCKS5(conn)
+			} else {
+				go ps.serveConnect(conn)
+			}
+		}
+	}()
+	return ps
+}
+
+// serveSOCKS5 follows RFC 1928, with the authentication of RFC 1929.
+func (ps *proxyStandIn) serveSOCKS5(conn net.Conn) {
+	defer conn.Close()
+	buf := make([]byte, 256)
+	// the methods offered by the client
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return
+	}
+	if _, err := io.ReadFull(conn, buf[:buf[1]]); err != nil {
+		return
+	}
+	_, _ = conn.Write([]byte{5, 2})
+	readString := func() string {
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return ""
+		}
+		n := buf[0]
+		if _, err := io.ReadFull(conn, buf[:n]); err != nil {
+			return ""
+		}
+		return string(buf[:n])
+	}
+	if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+		return
+	}
+	if user, password := readString(), readString(); user != "u" ||
+		password != "p" {
+		_, _ = conn.Write([]byte{1, 1})
+		return
+	}
+	_, _ = conn.Write([]byte{1, 0})
+	if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+		return
+	}
+	var host string
+	switch buf[3] {
+	case 1:
+		if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+			return
+		}
+		host = net.IP(buf[:4]).String()
+	case 3:
+		host = readString()
+	default:
+		return
+	}
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return
+	}
+	port := binary.BigEndian.Uint16(buf[:2])
+	target := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	ps.tunnel(conn, conn, target, func(ok bool) {
+		if ok {
+			_, _ = conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		} else {
+			_, _ = conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		}
+	})
+}
+
+// serveConnect follows RFC 9110 Section 9.3.6, with the basic
+// authentication.
+func (ps *proxyStandIn) serveConnect(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
+	if err != nil || req.Method != http.MethodConnect {
+		return
+	}
+	// "u:p" in base64
+	if req.Header.Get("Proxy-Authorization") != "Basic dTpw" {
+		_, _ = io.WriteString(conn,
+			"HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+		return
+	}
+	ps.tunnel(conn, br, req.Host, func(ok bool) {
+		if ok {
+			_, _ = io.WriteString(conn, "HTTP/1.1 200 OK\r\n\r\n")
+		} else {
+			_, _ = io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+		}
+	})
+}
+
+// tunnel connects to the target, and relays the client connection to it.
+func (ps *proxyStandIn) tunnel(conn net.Conn, r io.Reader, target string,
+	reply func(ok bool)) {
+	upstream, err := net.Dial("tcp", target)
+	if err != nil {
+		reply(false)
+		return
+	}
+	defer upstream.Close()
+	ps.Lock()
+	ps.targets = append(ps.targets, target)
+	ps.Unlock()
+	reply(true)
+	go func() { _, _ = io.Copy(upstream, r) }()
+	_, _ = io.Copy(conn, upstream)
+}
+
+func (ps *proxyStandIn) Targets() []string {
+	ps.Lock()
+	defer ps.Unlock()
+	return CloneSlice(ps.targets)
+}
+
+// startTCPTestServer serves DNS over TCP on a local port, answering every
+// query with an empty response.
+func startTCPTestServer(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{Listener: ln, Handler: dns.HandlerFunc(
+		func(w dns.ResponseWriter, req *dns.Msg) {
+			resp := new(dns.Msg)
+			resp.SetReply(req)
+			_ = w.WriteMsg(resp)
+		})}
+	go func() { _ = srv.ActivateAndServe() }()
+	t.Cleanup(func() { _ = srv.Shutdown() })
+	return ln.Addr().String()
+}
+
+func TestProxyDialer(t *testing.T) {
+	server := startTCPTestServer(t)
+	_, port, _ := net.SplitHostPort(server)
+	socks := startProxyStandIn(t, true)
+	connect := startProxyStandIn(t, false)
+	tests := []struct {
+		name    string
+		proxy   *proxyStandIn
+		url     string
+		network string
+		addr    string
+		wantErr bool
+	}{
+		{name: "SOCKS5", proxy: socks, url: "socks5://u:p@" + socks.addr,
+			network: "tcp", addr: server},
+		{name: "SOCKS5 resolving the host name", proxy: socks,
+			url: "socks5h://u:p@" + socks.addr, network: "tcp",
+			addr: net.JoinHostPort("localhost", port)},
+		{name: "SOCKS5 with a wrong password", proxy: socks,
+			url: "socks5://u:x@" + socks.addr, network: "tcp", addr: server,
+			wantErr: true},
+		{name: "HTTP CONNECT", proxy: connect,
+			url: "http://u:p@" + connect.addr, network: "tcp", addr: server},
+		{name: "HTTP CONNECT with a wrong password", proxy: connect,
+			url: "http://u:x@" + connect.addr, network: "tcp", addr: server,
+			wantErr: true},
+		{name: "UDP", proxy: socks, url: "socks5://u:p@" + socks.addr,
+			network: "udp", addr: server, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pd, err := NewProxyDialer(tt.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			before := len(tt.proxy.Targets())
+			ctx, cancel := context.WithTimeout(context.Background(),
+				5*time.Second)
+			defer cancel()
+			conn, err := pd.DialContext(ctx, tt.network, tt.addr)
+			if tt.wantErr {
+				if err == nil {
+					conn.Close()
+					t.Fatal("connected, want an error")
+				}
+				if len(tt.proxy.Targets()) != before {
+					t.Error("tunnel opened despite the error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			// the host name is sent to the proxy as is
+			if targets := tt.proxy.Targets(); len(targets) != before+1 ||
+				targets[before] != tt.addr {
+				t.Errorf("got the tunnels %v, want one to %s", targets,
+					tt.addr)
+			}
+			dc := &dns.Conn{Conn: conn}
+			req := new(dns.Msg)
+			req.SetQuestion("example.", dns.TypeA)
+			if err = dc.WriteMsg(req); err != nil {
+				t.Fatal(err)
+			}
+			if resp, err := dc.ReadMsg(); err != nil || resp.Id != req.Id {
+				t.Fatalf("got %v (%v) through the tunnel", resp, err)
+			}
+		})
+	}
+}
+
+func TestProxyUpstream(t *testing.T) {
+	server := startTCPTestServer(t)
+	host, port, _ := net.SplitHostPort(server)
+	portNum, _ := strconv.Atoi(port)
+	socks := startProxyStandIn(t, true)
+	s := &ServerConfig{IP: net.ParseIP(host), Port: uint16(portNum),
+		Proto: TCPProto}
+	SetDefaultProxy([]*ServerConfig{s}, "socks5://u:p@"+socks.addr)
+	if err := VerifyServerConfig(s, "upstream server"); err != nil {
+		t.Fatal(err)
+	}
+	client := NewDNSClient(s)
+	defer closeClient(client)
+	req := new(dns.Msg)
+	req.SetQuestion("example.", dns.TypeA)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := client.ExchangeContext(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+	if targets := socks.Targets(); len(targets) != 1 ||
+		targets[0] != server {
+		t.Errorf("got the tunnels %v, want one to %s", targets, server)
+	}
+}
+
+func TestSetDefaultProxy(t *testing.T) {
+	const proxyURL = "socks5://127.0.0.1:1080"
+	tests := []struct {
+		proto string
+		proxy string
+		want  string
+	}{
+		{proto: "", want: ""},
+		{proto: UDPProto, want: ""},
+		{proto: QUICProto, want: ""},
+		{proto: RecursiveProto, want: ""},
+		{proto: TCPProto, want: proxyURL},
+		{proto: TLSProto, want: proxyURL},
+		{proto: HTTPSProto, want: proxyURL},
+		{proto: TCPProto, proxy: DirectProxy, want: DirectProxy},
+	}
+	for _, tt := range tests {
+		s := &ServerConfig{IP: net.IPv4(127, 0, 0, 1), Port: 53,
+			Proto: tt.proto, Proxy: tt.proxy}
+		SetDefaultProxy([]*ServerConfig{s}, proxyURL)
+		if s.Proxy != tt.want {
+			t.Errorf("%q with the proxy %q: got %q, want %q", tt.proto,
+				tt.proxy, s.Proxy, tt.want)
+		}
+	}
+	// a plain server is still accepted with a global proxy
+	s := &ServerConfig{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+	SetDefaultProxy([]*ServerConfig{s}, proxyURL)
+	if err := VerifyServerConfig(s, "bootstrap server"); err != nil {
+		t.Error(err)
+	}
+}
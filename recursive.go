@@ -0,0 +1,468 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const RecursionServerTimeoutMillis = 1500
+const RecursionMaxSteps = 32
+const RecursionMaxDepth = 6
+const RecursionMaxCNAMEs = 8
+const DefaultRecursionPort = 53
+const DefaultRecursionCacheSize = 4096
+
+// DefaultRootHints are the addresses of the IANA root servers, A to M.
+var DefaultRootHints = []string{
+	"198.41.0.4", "170.247.170.2", "192.33.4.12", "199.7.91.13",
+	"192.203.230.10", "192.5.5.241", "192.112.36.4", "198.97.190.53",
+	"192.36.148.17", "192.58.128.30", "193.0.14.129", "199.7.83.42",
+	"202.12.27.33",
+}
+
+// RecursiveResolver is a DNSClient resolving the queries iteratively from
+// the root servers, instead of asking an upstream resolver. Only the labels
+// needed to find the next zone cut are revealed to each server (QNAME
+// minimisation, RFC 9156), and the delegations are cached.
+type RecursiveResolver struct {
+	rootHints []string
+	port      string
+	cache     DNSCache
+}
+
+func NewRecursiveResolver(rc *RecursionConfig) *RecursiveResolver {
+	port := strconv.Itoa(int(rc.Port))
+	rootHints := make([]string, len(rc.RootHints))
+	for i, ip := range rc.RootHints {
+		rootHints[i] = net.JoinHostPort(ip.String(), port)
+	}
+	return &RecursiveResolver{
+		rootHints: rootHints,
+		port:      port,
+		cache: NewDNSCache(&DNSCacheConfig{
+			CacheSize: rc.CacheSize,
+			MaxTTL:    DefaultMaxTTL,
+			RecordTypes: []*RecordType{
+				{Name: dns.TypeToString[dns.TypeNS], Value: dns.TypeNS},
+			},
+		}),
+	}
+}
+
+// ExchangeContext resolves the question of the request, following the
+// CNAME chain across zones if needed.
+func (rr *RecursiveResolver) ExchangeContext(ctx context.Context,
+	req *dns.Msg) (*dns.Msg, error) {
+	if rr == nil {
+		return nil, fmt.Errorf(
+			"attempted to use uninitialized DNS client")
+	}
+	if len(req.Question) != 1 {
+		return nil, fmt.Errorf("%w: %d", InvalidQuestionError,
+			len(req.Question))
+	}
+	q := req.Question[0]
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.RecursionAvailable = true
+	name := dns.Fqdn(q.Name)
+	for i := 0; i <= RecursionMaxCNAMEs; i++ {
+		authResp, err := rr.resolve(ctx, name, q.Qtype, 0)
+		if err != nil {
+			return nil, err
+		}
+		chain, next := followCNAMEs(authResp.Answer, name, q.Qtype)
+		resp.Answer = append(resp.Answer, chain...)
+		resp.Rcode = authResp.Rcode
+		if next == "" {
+			resp.Ns = authResp.Ns
+			return resp, nil
+		}
+		name = next
+	}
+	return nil, fmt.Errorf("CNAME chain of %s is too long", q.Name)
+}
+
+// Close stops the maintenance of the delegation cache.
+func (rr *RecursiveResolver) Close() error {
+	rr.cache.Close()
+	return nil
+}
+
+// resolve finds the servers of the zone closest to the name, and follows
+// the referrals down to the servers authoritative for the name. Each server
+// is only asked for the name one label below the zone it serves, until the
+// zone of the name itself is found.
+func (rr *RecursiveResolver) resolve(ctx context.Context, qname string,
+	qtype uint16, depth int) (*dns.Msg, error) {
+	if depth > RecursionMaxDepth {
+		return nil, fmt.Errorf("too many nested lookups for %s", qname)
+	}
+	qname = dns.CanonicalName(qname)
+	start := qname
+	// RFC 4035 Section 3.1.4.1: the DS records are served by the parent
+	if qtype == dns.TypeDS && qname != "." {
+		start = parentName(qname)
+	}
+	zone, servers := rr.closestServers(start)
+	// the deepest name known to exist below the current zone
+	known := zone
+	for i := 0; i < RecursionMaxSteps; i++ {
+		qmin, mtype := qname, qtype
+		if known != qname {
+			qmin = childName(qname, known)
+		}
+		// RFC 9156 Section 3: QTYPE A is used for the minimised queries,
+		// but not for the name itself
+		if qmin != qname {
+			mtype = dns.TypeA
+		}
+		resp, err := rr.queryServers(ctx, servers, zone, qmin, mtype)
+		if err != nil {
+			return nil, err
+		}
+		if delegation := referral(resp, zone, qmin); delegation != nil {
+			if qtype == dns.TypeDS && delegation.Question[0].Name == qname {
+				// ask the parent for the DS records, not the child
+				known = qname
+				continue
+			}
+			servers, err = rr.delegationServers(ctx, delegation, zone, depth)
+			if err != nil {
+				return nil, err
+			}
+			zone = delegation.Question[0].Name
+			known = zone
+			continue
+		}
+		if qmin != qname {
+			// RFC 8020: nothing exists below a nonexistent name
+			if resp.Rcode == dns.RcodeNameError {
+				return inBailiwick(resp, zone), nil
+			}
+			known = qmin
+			continue
+		}
+		return inBailiwick(resp, zone), nil
+	}
+	return nil, fmt.Errorf("too many referrals for %s", qname)
+}
+
+// closestServers returns the closest enclosing zone of the name with a
+// cached delegation, and the addresses of its servers. The root servers
+// are the last resort.
+func (rr *RecursiveResolver) closestServers(name string) (string,
+	[]string) {
+	for off, end := 0, name == "."; !end; {
+		zone := name[off:]
+		if servers := rr.cachedServers(zone); len(servers) > 0 {
+			return zone, servers
+		}
+		off, end = dns.NextLabel(name, off)
+	}
+	return ".", shuffled(rr.rootHints)
+}
+
+// cachedServers returns the addresses of the servers of the zone from the
+// cached delegation, whose glue was validated before it was cached.
+func (rr *RecursiveResolver) cachedServers(zone string) []string {
+	q := new(dns.Msg)
+	q.SetQuestion(zone, dns.TypeNS)
+	cached, err := rr.cache.Query(q, "")
+	if err != nil || cached == nil {
+		return nil
+	}
+	addrs := make([]string, 0, len(cached.Extra))
+	for _, rec := range cached.Extra {
+		if ip := rrAddr(rec); ip != nil {
+			addrs = append(addrs, net.JoinHostPort(ip.String(), rr.port))
+		}
+	}
+	return shuffled(addrs)
+}
+
+// delegationServers returns the addresses of the servers of a delegation
+// sent by a server of the parent zone, and caches the delegation. Glue
+// records are only trusted for the name servers within the parent zone;
+// the other name servers are resolved on their own.
+func (rr *RecursiveResolver) delegationServers(ctx context.Context,
+	delegation *dns.Msg, parent string, depth int) ([]string, error) {
+	addrs := make([]string, 0)
+	glue := make([]dns.RR, 0)
+	glueless := make([]string, 0)
+	for _, rec := range delegation.Ns {
+		target := dns.CanonicalName(rec.(*dns.NS).Ns)
+		found := false
+		for _, extra := range delegation.Extra {
+			if dns.CanonicalName(extra.Header().Name) != target ||
+				!dns.IsSubDomain(parent, target) {
+				continue
+			}
+			if ip := rrAddr(extra); ip != nil {
+				addrs = append(addrs, net.JoinHostPort(ip.String(), rr.port))
+				glue = append(glue, extra)
+				found = true
+			}
+		}
+		// a server within the delegated zone cannot be found without glue
+		if !found &&
+			!dns.IsSubDomain(delegation.Question[0].Name, target) {
+			glueless = append(glueless, target)
+		}
+	}
+	if len(addrs) == 0 {
+		for _, target := range glueless {
+			resolved := rr.resolveAddrs(ctx, target, depth+1)
+			for _, rec := range resolved {
+				ip := rrAddr(rec)
+				addrs = append(addrs, net.JoinHostPort(ip.String(), rr.port))
+				glue = append(glue, rec)
+			}
+			if len(addrs) > 0 {
+				break
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no address for the servers of %s",
+			delegation.Question[0].Name)
+	}
+	delegation.Extra = glue
+	_ = rr.cache.Update(delegation, "", Indeterminate)
+	return shuffled(addrs), nil
+}
+
+// resolveAddrs returns the A records of the name, or its AAAA records if
+// there is none.
+func (rr *RecursiveResolver) resolveAddrs(ctx context.Context, name string,
+	depth int) []dns.RR {
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		resp, err := rr.resolve(ctx, name, qtype, depth)
+		if err != nil {
+			continue
+		}
+		addrs := make([]dns.RR, 0)
+		for _, rec := range resp.Answer {
+			if rrAddr(rec) != nil &&
+				dns.CanonicalName(rec.Header().Name) == name {
+				addrs = append(addrs, rec)
+			}
+		}
+		if len(addrs) > 0 {
+			return addrs
+		}
+	}
+	return nil
+}
+
+// queryServers sends a non-recursive query to the servers of a zone in
+// turn, until one of them answers. A server referring to a zone that is not
+// below its own is lame, and skipped.
+func (rr *RecursiveResolver) queryServers(ctx context.Context,
+	servers []string, zone, name string, qtype uint16) (*dns.Msg, error) {
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	req.RecursionDesired = false
+	// the signatures are kept for the DNSSEC validation
+	req.SetEdns0(EDNS_BUFFER_SIZE, true)
+	lastErr := errors.New("no server to ask")
+	for _, addr := range servers {
+		resp, err := queryServer(ctx, addr, req)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if len(resp.Question) != 1 ||
+			!isSameQuestion(resp.Question[0], req.Question[0]) {
+			lastErr = fmt.Errorf("mismatched response from %s", addr)
+			continue
+		}
+		if resp.Rcode != dns.RcodeSuccess &&
+			resp.Rcode != dns.RcodeNameError {
+			lastErr = fmt.Errorf("%s from %s", dns.RcodeToString[resp.Rcode],
+				addr)
+			continue
+		}
+		if isReferral(resp) && referral(resp, zone, name) == nil {
+			lastErr = fmt.Errorf("lame delegation to %s", addr)
+			continue
+		}
+		return resp, nil
+	}
+	return nil, fmt.Errorf("unable to resolve %s: %w", name, lastErr)
+}
+
+// queryServer sends the query over UDP, and over TCP if the response is
+// truncated.
+func queryServer(ctx context.Context, addr string, req *dns.Msg) (*dns.Msg,
+	error) {
+	ctx, cancel := context.WithTimeout(ctx,
+		RecursionServerTimeoutMillis*time.Millisecond)
+	defer cancel()
+	resp, err := (&UDPClient{serverAddr: addr}).ExchangeContext(ctx, req)
+	if err != nil || !resp.Truncated {
+		return resp, err
+	}
+	tcpClient := &dns.Client{Net: TCPProto}
+	resp, _, err = tcpClient.ExchangeContext(ctx, req, addr)
+	return resp, err
+}
+
+// referral returns the delegation in the response, if it is a referral to
+// a zone below the zone of the server and above the name. The NS records
+// of other zones are ignored.
+func referral(resp *dns.Msg, zone, name string) *dns.Msg {
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) > 0 {
+		return nil
+	}
+	var child string
+	nsRecords := make([]dns.RR, 0)
+	for _, rec := range resp.Ns {
+		ns, ok := rec.(*dns.NS)
+		if !ok {
+			continue
+		}
+		owner := dns.CanonicalName(ns.Hdr.Name)
+		if child == "" {
+			child = owner
+		}
+		if owner == child {
+			nsRecords = append(nsRecords, ns)
+		}
+	}
+	if child == "" || child == zone || !dns.IsSubDomain(zone, child) ||
+		!dns.IsSubDomain(child, name) {
+		return nil
+	}
+	delegation := new(dns.Msg)
+	delegation.SetQuestion(child, dns.TypeNS)
+	delegation.Response = true
+	delegation.Ns = nsRecords
+	delegation.Extra = CloneSlice(resp.Extra)
+	return delegation
+}
+
+// isReferral checks if the response only points to other name servers.
+func isReferral(resp *dns.Msg) bool {
+	if resp.Authoritative || len(resp.Answer) > 0 {
+		return false
+	}
+	for _, rec := range resp.Ns {
+		if rec.Header().Rrtype == dns.TypeNS {
+			return true
+		}
+	}
+	return false
+}
+
+// inBailiwick removes the records for names outside the zone of the server
+// from the response, so that a server cannot answer for another zone.
+func inBailiwick(resp *dns.Msg, zone string) *dns.Msg {
+	filter := func(section []dns.RR) []dns.RR {
+		kept := make([]dns.RR, 0, len(section))
+		for _, rec := range section {
+			if rec.Header().Rrtype != dns.TypeOPT &&
+				dns.IsSubDomain(zone, rec.Header().Name) {
+				kept = append(kept, rec)
+			}
+		}
+		return kept
+	}
+	resp.Answer = filter(resp.Answer)
+	resp.Ns = filter(resp.Ns)
+	resp.Extra = filter(resp.Extra)
+	return resp
+}
+
+// followCNAMEs returns the CNAME chain from the name and the records it
+// ends with, along with their signatures. If the chain ends with a name
+// without records in the answer, that name is returned to be resolved next.
+func followCNAMEs(answer []dns.RR, name string,
+	qtype uint16) ([]dns.RR, string) {
+	chain := make([]dns.RR, 0, len(answer))
+	seen := make(map[string]struct{})
+	for {
+		cname := dns.CanonicalName(name)
+		if _, loop := seen[cname]; loop {
+			return chain, ""
+		}
+		seen[cname] = struct{}{}
+		var target string
+		found := false
+		for _, rec := range answer {
+			hdr := rec.Header()
+			if dns.CanonicalName(hdr.Name) != cname {
+				continue
+			}
+			if hdr.Rrtype == qtype || qtype == dns.TypeANY {
+				chain = append(chain, rec)
+				found = true
+			} else if sig, ok := rec.(*dns.RRSIG); ok &&
+				(sig.TypeCovered == qtype || sig.TypeCovered == dns.TypeCNAME) {
+				chain = append(chain, sig)
+			} else if c, ok := rec.(*dns.CNAME); ok && target == "" {
+				chain = append(chain, c)
+				target = c.Target
+			}
+		}
+		if found || target == "" || qtype == dns.TypeCNAME {
+			return chain, ""
+		}
+		if !containsOwner(answer, target) {
+			return chain, target
+		}
+		name = target
+	}
+}
+
+func containsOwner(rrs []dns.RR, name string) bool {
+	for _, rec := range rrs {
+		if dns.CanonicalName(rec.Header().Name) == dns.CanonicalName(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func rrAddr(rec dns.RR) net.IP {
+	switch r := rec.(type) {
+	case *dns.A:
+		return r.A
+	case *dns.AAAA:
+		return r.AAAA
+	}
+	return nil
+}
+
+// childName returns the ancestor of the name one label below the parent.
+func childName(name, parent string) string {
+	labels := dns.SplitDomainName(name)
+	n := dns.CountLabel(parent) + 1
+	return dns.Fqdn(strings.Join(labels[len(labels)-n:], "."))
+}
+
+func parentName(name string) string {
+	off, end := dns.NextLabel(name, 0)
+	if end {
+		return "."
+	}
+	return name[off:]
+}
+
+func shuffled(addrs []string) []string {
+	s := CloneSlice(addrs)
+	rand.Shuffle(len(s), func(i, j int) {
+		s[i], s[j] = s[j], s[i]
+	})
+	return s
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"net"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// authServer is a stand-in authoritative server of one or more zones. It
+// refers the queries below its zone cuts to the child servers, and keeps
+// the questions it was asked.
+type authServer struct {
+	zones   map[string][]dns.RR
+	poison  []dns.RR
+	queries []string
+	sync.Mutex
+}
+
+func testRRs(t *testing.T, records ...string) []dns.RR {
+	t.Helper()
+	rrs := make([]dns.RR, len(records))
+	for i, s := range records {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rrs[i] = rr
+	}
+	return rrs
+}
+
+func (as *authServer) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	q := req.Question[0]
+	name := dns.CanonicalName(q.Name)
+	as.Lock()
+	as.queries = append(as.queries, name+" "+dns.TypeToString[q.Qtype])
+	as.Unlock()
+	zone := ""
+	for z := range as.zones {
+		if dns.IsSubDomain(z, name) &&
+			(zone == "" || dns.CountLabel(z) > dns.CountLabel(zone)) {
+			zone = z
+		}
+	}
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	if zone == "" {
+		resp.Rcode = dns.RcodeRefused
+		_ = w.WriteMsg(resp)
+		return
+	}
+	records := as.zones[zone]
+	// the deepest zone cut at or above the name, except for the DS records
+	// of the child, which the parent serves
+	cut := ""
+	for _, rr := range records {
+		owner := rr.Header().Name
+		if rr.Header().Rrtype != dns.TypeNS || owner == zone ||
+			!dns.IsSubDomain(owner, name) ||
+			(q.Qtype == dns.TypeDS && owner == name) {
+			continue
+		}
+		if cut == "" || dns.CountLabel(owner) > dns.CountLabel(cut) {
+			cut = owner
+		}
+	}
+	if cut != "" {
+		for _, rr := range records {
+			if rr.Header().Rrtype == dns.TypeNS && rr.Header().Name == cut {
+				resp.Ns = append(resp.Ns, rr)
+			}
+		}
+		for _, ns := range resp.Ns {
+			for _, rr := range records {
+				if rrAddr(rr) != nil &&
+					rr.Header().Name == ns.(*dns.NS).Ns {
+					resp.Extra = append(resp.Extra, rr)
+				}
+			}
+		}
+		_ = w.WriteMsg(resp)
+		return
+	}
+	resp.Authoritative = true
+	exists := false
+	for _, rr := range records {
+		owner := rr.Header().Name
+		if dns.IsSubDomain(name, owner) {
+			exists = true
+		}
+		if owner == name && (rr.Header().Rrtype == q.Qtype ||
+			rr.Header().Rrtype == dns.TypeCNAME) {
+			resp.Answer = append(resp.Answer, rr)
+		}
+	}
+	if len(resp.Answer) > 0 {
+		resp.Answer = append(resp.Answer, as.poison...)
+	} else {
+		if !exists {
+			resp.Rcode = dns.RcodeNameError
+		}
+		resp.Ns = []dns.RR{&dns.SOA{
+			Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA,
+				Class: dns.ClassINET, Ttl: 300},
+			Ns:     "ns." + zone,
+			Mbox:   "host." + zone,
+			Minttl: 300,
+		}}
+	}
+	_ = w.WriteMsg(resp)
+}
+
+func (as *authServer) takeQueries() []string {
+	as.Lock()
+	defer as.Unlock()
+	queries := as.queries
+	as.queries = nil
+	return queries
+}
+
+// startAuthServers serves each stand-in on its own loopback address, all
+// on the same UDP port, as the recursion uses a single port, and returns
+// the port.
+func startAuthServers(t *testing.T, servers map[string]*authServer) uint16 {
+	t.Helper()
+	for attempt := 0; attempt < 10; attempt++ {
+		conns := make([]net.PacketConn, 0, len(servers))
+		port := 0
+		for ip := range servers {
+			pc, err := net.ListenPacket("udp",
+				net.JoinHostPort(ip, strconv.Itoa(port)))
+			if err != nil {
+				break
+			}
+			port = pc.LocalAddr().(*net.UDPAddr).Port
+			conns = append(conns, pc)
+		}
+		if len(conns) < len(servers) {
+			for _, pc := range conns {
+				_ = pc.Close()
+			}
+			continue
+		}
+		for _, pc := range conns {
+			ip := pc.LocalAddr().(*net.UDPAddr).IP.String()
+			srv := &dns.Server{PacketConn: pc, Handler: servers[ip]}
+			go func() { _ = srv.ActivateAndServe() }()
+			t.Cleanup(func() { _ = srv.Shutdown() })
+		}
+		return uint16(port)
+	}
+	t.Fatal("no UDP port free on all the loopback addresses")
+	return 0
+}
+
+// newTestRecursion sets up the root, com. and example.com. on their own
+// servers, and glueless.com. and net. on a server whose name is in net.
+func newTestRecursion(t *testing.T) (*RecursiveResolver,
+	map[string]*authServer) {
+	t.Helper()
+	servers := map[string]*authServer{
+		"127.0.0.2": {zones: map[string][]dns.RR{".": testRRs(t,
+			"com. 300 IN NS ns.com.",
+			"ns.com. 300 IN A 127.0.0.3",
+			"net. 300 IN NS ns.net.",
+			"ns.net. 300 IN A 127.0.0.5",
+		)}},
+		"127.0.0.3": {zones: map[string][]dns.RR{"com.": testRRs(t,
+			"example.com. 300 IN NS ns1.example.com.",
+			"ns1.example.com. 300 IN A 127.0.0.4",
+			"example.com. 300 IN DS 12345 13 2 "+
+				"0123456789ABCDEF0123456789ABCDEF"+
+				"0123456789ABCDEF0123456789ABCDEF",
+			"glueless.com. 300 IN NS ns.net.",
+		)}},
+		"127.0.0.4": {zones: map[string][]dns.RR{"example.com.": testRRs(t,
+			"www.example.com. 300 IN A 192.0.2.1",
+			"a.b.c.example.com. 300 IN A 192.0.2.5",
+			"alias.example.com. 300 IN CNAME target.glueless.com.",
+		)},
+			// an answer for a name the server is not authoritative for
+			poison: testRRs(t, "bank.net. 300 IN A 192.0.2.66")},
+		"127.0.0.5": {zones: map[string][]dns.RR{
+			"net.": testRRs(t, "ns.net. 300 IN A 127.0.0.5"),
+			"glueless.com.": testRRs(t,
+				"target.glueless.com. 300 IN A 192.0.2.7"),
+		}},
+	}
+	port := startAuthServers(t, servers)
+	rc := &RecursionConfig{
+		Enabled:   true,
+		RootHints: []net.IP{net.IPv4(127, 0, 0, 2)},
+		Port:      port,
+	}
+	if err := VerifyRecursionConfig(rc); err != nil {
+		t.Fatal(err)
+	}
+	resolver := NewRecursiveResolver(rc)
+	t.Cleanup(func() { _ = resolver.Close() })
+	return resolver, servers
+}
+
+func resolveTest(t *testing.T, resolver *RecursiveResolver, name string,
+	qtype uint16) *dns.Msg {
+	t.Helper()
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := resolver.ExchangeContext(ctx, req)
+	if err != nil {
+		t.Fatalf("%s %s: %s", name, dns.TypeToString[qtype], err)
+	}
+	if resp.Id != req.Id || !resp.RecursionAvailable {
+		t.Fatalf("%s %s: not a reply to the query: %v", name,
+			dns.TypeToString[qtype], resp)
+	}
+	return resp
+}
+
+func TestRecursiveResolve(t *testing.T) {
+	resolver, _ := newTestRecursion(t)
+	tests := []struct {
+		name   string
+		qname  string
+		qtype  uint16
+		rcode  int
+		answer []string
+	}{
+		{name: "address", qname: "www.example.com.", qtype: dns.TypeA,
+			answer: []string{"www.example.com. 300 IN A 192.0.2.1"}},
+		{name: "below empty non-terminals", qname: "a.b.c.example.com.",
+			qtype:  dns.TypeA,
+			answer: []string{"a.b.c.example.com. 300 IN A 192.0.2.5"}},
+		{name: "NXDOMAIN", qname: "nx.example.com.", qtype: dns.TypeA,
+			rcode: dns.RcodeNameError},
+		{name: "NODATA", qname: "www.example.com.", qtype: dns.TypeAAAA},
+		{name: "CNAME to a glueless delegation",
+			qname: "alias.example.com.", qtype: dns.TypeA,
+			answer: []string{
+				"alias.example.com. 300 IN CNAME target.glueless.com.",
+				"target.glueless.com. 300 IN A 192.0.2.7",
+			}},
+		{name: "DS from the parent", qname: "example.com.",
+			qtype: dns.TypeDS,
+			answer: []string{"example.com. 300 IN DS 12345 13 2 " +
+				"0123456789ABCDEF0123456789ABCDEF" +
+				"0123456789ABCDEF0123456789ABCDEF"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := resolveTest(t, resolver, tt.qname, tt.qtype)
+			if resp.Rcode != tt.rcode {
+				t.Errorf("got %s, want %s", dns.RcodeToString[resp.Rcode],
+					dns.RcodeToString[tt.rcode])
+			}
+			answer := make([]string, 0, len(resp.Answer))
+			for _, rr := range resp.Answer {
+				answer = append(answer, rr.String())
+			}
+			want := make([]string, 0, len(tt.answer))
+			for _, rr := range testRRs(t, tt.answer...) {
+				want = append(want, rr.String())
+			}
+			if !reflect.DeepEqual(answer, want) {
+				t.Errorf("got %v, want %v", answer, want)
+			}
+		})
+	}
+}
+
+func TestRecursiveQNAMEMinimisation(t *testing.T) {
+	tests := []struct {
+		name  string
+		qname string
+		qtype uint16
+		// the questions each server is asked, by address
+		queries map[string][]string
+	}{
+		{name: "one label more for each zone", qname: "a.b.c.example.com.",
+			qtype: dns.TypeMX,
+			queries: map[string][]string{
+				"127.0.0.2": {"com. A"},
+				"127.0.0.3": {"example.com. A"},
+				"127.0.0.4": {"c.example.com. A", "b.c.example.com. A",
+					"a.b.c.example.com. MX"},
+			}},
+		{name: "nothing below a nonexistent name",
+			qname: "a.b.nx.example.com.", qtype: dns.TypeA,
+			queries: map[string][]string{
+				"127.0.0.2": {"com. A"},
+				"127.0.0.3": {"example.com. A"},
+				"127.0.0.4": {"nx.example.com. A"},
+			}},
+		{name: "DS asked of the parent", qname: "example.com.",
+			qtype: dns.TypeDS,
+			queries: map[string][]string{
+				"127.0.0.2": {"com. A"},
+				"127.0.0.3": {"example.com. DS"},
+			}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolver, servers := newTestRecursion(t)
+			resolveTest(t, resolver, tt.qname, tt.qtype)
+			for ip, server := range servers {
+				queries := server.takeQueries()
+				if !reflect.DeepEqual(queries, tt.queries[ip]) &&
+					(len(queries) > 0 || len(tt.queries[ip]) > 0) {
+					t.Errorf("%s was asked %v, want %v", ip, queries,
+						tt.queries[ip])
+				}
+			}
+		})
+	}
+}
+
+func TestRecursiveBailiwick(t *testing.T) {
+	resolver, _ := newTestRecursion(t)
+	resp := resolveTest(t, resolver, "www.example.com.", dns.TypeA)
+	for _, rr := range resp.Answer {
+		if rr.Header().Name != "www.example.com." {
+			t.Errorf("kept the out-of-bailiwick record %s", rr)
+		}
+	}
+	// the poisoned address must not have been cached for bank.net. either
+	resp = resolveTest(t, resolver, "bank.net.", dns.TypeA)
+	if resp.Rcode != dns.RcodeNameError || len(resp.Answer) != 0 {
+		t.Errorf("got %v, want NXDOMAIN", resp)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"log"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+)
+
+const ConfigWatchInterval = 10
+
+// HandlerState bundles the components built from the config that serve the
+// queries. It is swapped as a whole when the config is reloaded.
+type HandlerState struct {
+	config             *LiteDNSConfig
+	cache              DNSCache
+	adBlocker          AdBlocker
+	upstreamClients    *DNSClientPool
+	localResolvClients *DNSClientPool
+	// the pools of the forwarding rules, by rule name and by suffix
+	forwardingClients  map[string]*DNSClientPool
+	forwardingSuffixes map[string]*DNSClientPool
+	// the DNSSEC validator of the upstream responses, if enabled
+	validator *Validator
+	anchors   *TrustAnchors
+}
+
+// NewHandlerState builds the components for the config. Components of the
+// previous state whose config did not change are reused.
+func NewHandlerState(cfg *LiteDNSConfig, prev *HandlerState) (*HandlerState,
+	error) {
+	st := &HandlerState{config: cfg}
+	if prev != nil &&
+		reflect.DeepEqual(prev.config.AdBlocker, cfg.AdBlocker) {
+		st.adBlocker = prev.adBlocker
+	} else {
+		adb, err := LoadAdBlockerHTTP(cfg.HTTPResolvers(),
+			cfg.AdBlocker.ABPFilterURL)
+		if err != nil {
+			return nil, err
+		}
+		st.adBlocker = adb
+	}
+	// the anchors are loaded before anything that has to be closed, which
+	// would be leaked if they failed to load
+	if cfg.DNSSEC.Enabled {
+		// the keys learned through the rollover outlive the reload
+		if prev != nil && prev.anchors != nil &&
+			reflect.DeepEqual(prev.config.DNSSEC, cfg.DNSSEC) {
+			st.anchors = prev.anchors
+		} else {
+			anchors, err := NewTrustAnchors(cfg.DNSSEC)
+			if err != nil {
+				return nil, err
+			}
+			st.anchors = anchors
+		}
+	}
+	if prev != nil &&
+		reflect.DeepEqual(prev.config.CacheConfig, cfg.CacheConfig) {
+		st.cache = prev.cache
+	} else {
+		st.cache = NewDNSCache(cfg.CacheConfig)
+	}
+	st.upstreamClients = NewDNSClientPool(cfg.UpstreamServers, cfg)
+	st.localResolvClients = NewDNSClientPool(cfg.LocalNameServers, cfg)
+	if st.anchors != nil {
+		st.validator = NewValidator(st.upstreamClients, st.anchors)
+	}
+	st.forwardingClients = make(map[string]*DNSClientPool,
+		len(cfg.ForwardingRules))
+	st.forwardingSuffixes = make(map[string]*DNSClientPool)
+	for _, r := range cfg.ForwardingRules {
+		pool := NewDNSClientPool(r.Servers, cfg)
+		st.forwardingClients[r.Name] = pool
+		for _, suffix := range r.Suffixes {
+			st.forwardingSuffixes[suffix] = pool
+		}
+	}
+	return st, nil
+}
+
+// ForwardingPool returns the pool of the forwarding rule with the longest
+// suffix of the name, or nil if no rule matches.
+func (st *HandlerState) ForwardingPool(name string) *DNSClientPool {
+	pool, _ := LongestSuffixMatch(st.forwardingSuffixes, name)
+	return pool
+}
+
+// Retire releases the components that are not reused by the next state,
+// once the queries still holding them had the time to finish.
+func (st *HandlerState) Retire(next *HandlerState, grace time.Duration) {
+	time.AfterFunc(grace, func() {
+		st.upstreamClients.Close()
+		st.localResolvClients.Close()
+		for _, pool := range st.forwardingClients {
+			pool.Close()
+		}
+		if st.cache != next.cache {
+			st.cache.Close()
+		}
+	})
+}
+
+// ConfigReloader re-reads the config file, and applies it to the handler if
+// it is valid.
+type ConfigReloader struct {
+	filename string
+	handler  *MainHandler
+	modTime  time.Time
+	sync.Mutex
+}
+
+func NewConfigReloader(filename string, handler *MainHandler) *ConfigReloader {
+	cr := &ConfigReloader{
+		filename: filename,
+		handler:  handler,
+	}
+	if stat, err := os.Stat(filename); err == nil {
+		cr.modTime = stat.ModTime()
+	}
+	return cr
+}
+
+// Reload loads the config file and swaps in the components built from it.
+// If the config is invalid, the current one stays active.
+func (cr *ConfigReloader) Reload() error {
+	cr.Lock()
+	defer cr.Unlock()
+	if stat, err := os.Stat(cr.filename); err == nil {
+		cr.modTime = stat.ModTime()
+	}
+	cfg, err := LoadConfig(cr.filename)
+	if err != nil {
+		return err
+	}
+	prev := cr.handler.State()
+	st, err := NewHandlerState(cfg, prev)
+	if err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(prev.config.ListenerConfig, cfg.ListenerConfig) {
+		log.Printf("Warning: Listener changes in %s require a restart",
+			cr.filename)
+	}
+	cr.handler.SwapState(st)
+	GlobalConfig.Store(cfg)
+	// the queries still holding the previous state run for up to its query
+	// timeout
+	grace := max(time.Duration(prev.config.QueryTimeout)*time.Millisecond,
+		time.Duration(prev.config.ShutdownTimeout)*time.Second)
+	prev.Retire(st, grace)
+	return nil
+}
+
+// IsModified checks if the config file has changed since the last reload.
+func (cr *ConfigReloader) IsModified() bool {
+	stat, err := os.Stat(cr.filename)
+	if err != nil {
+		return false
+	}
+	cr.Lock()
+	defer cr.Unlock()
+	return !stat.ModTime().Equal(cr.modTime)
+}
+
+// ReloadAndLog reloads the config and logs the outcome.
+func (cr *ConfigReloader) ReloadAndLog(reason string) {
+	if err := cr.Reload(); err != nil {
+		log.Printf("Unable to reload config from %s (%s), "+
+			"keeping the current one: %s", cr.filename, reason, err.Error())
+		return
+	}
+	log.Printf("Reloaded LiteDNS config from %s (%s)", cr.filename, reason)
+}
+
+// Watch reloads the config whenever a signal arrives on sigC, or, if the
+// active config sets watchConfig, whenever the config file is modified.
+func (cr *ConfigReloader) Watch(sigC <-chan os.Signal) {
+	pollT := time.NewTicker(ConfigWatchInterval * time.Second)
+	defer pollT.Stop()
+	for {
+		select {
+		case sig := <-sigC:
+			cr.ReloadAndLog(sig.String())
+		case <-pollT.C:
+			// the flag itself may have been changed by a reload
+			if cr.handler.State().config.WatchConfig && cr.IsModified() {
+				cr.ReloadAndLog("file modified")
+			}
+		}
+	}
+}
@@ -103,13 +103,35 @@ func PrintStat() {
 	}
 }
 
+// PrintUpstreamStat prints the health and the average RTT of every upstream
+// in the pool.
+func PrintUpstreamStat(pool *DNSClientPool) {
+	for _, u := range pool.Stats() {
+		health := "up"
+		if !u.Healthy {
+			health = "down"
+		}
+		log.Printf("Upstream %s (%s): RTT %d ms, %d queries, %d failures, "+
+			"%d races won", u.Name, health, u.RTT.Milliseconds(),
+			u.NumQueries, u.NumFailures, u.NumWins)
+		if u.Circuit != CircuitClosed {
+			log.Printf("Upstream %s: circuit %s", u.Name, u.Circuit)
+		}
+		if u.NumSpoofed > 0 {
+			log.Printf("Upstream %s: %d suspected spoofed responses dropped",
+				u.Name, u.NumSpoofed)
+		}
+	}
+}
+
 type RequestLogEntry struct {
-	tStartMillis int64
-	cacheStatus  CacheStatus
-	rcode        int
-	domain       string
-	qType        uint16
-	isLocalReq   bool
+	tStartMillis   int64
+	cacheStatus    CacheStatus
+	rcode          int
+	domain         string
+	qType          uint16
+	isLocalReq     bool
+	isForwardedReq bool
 }
 
 func PopulateLogEntry(logEntry *RequestLogEntry, resp *dns.Msg) {
@@ -129,7 +151,9 @@ func StartLogEntry() (func(*RequestLogEntry), *RequestLogEntry) {
 		tElapsed := tEndMillis - logEntry.tStartMillis
 		AddStat(logEntry.cacheStatus, tElapsed)
 		var networkType, cacheStatus, domain, qTypeStr, rcodeStr string
-		if logEntry.isLocalReq {
+		if logEntry.isForwardedReq {
+			networkType = LabelForwardQuery
+		} else if logEntry.isLocalReq {
 			networkType = LabelLocalQuery
 		} else {
 			networkType = LabelUpstreamQuery
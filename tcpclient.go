@@ -0,0 +1,475 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const TCPDialTimeoutMillis = 1000
+const TCPMaxRetry = 3
+
+// TCPPipelineDepth is the number of outstanding queries on a connection
+// before another connection is opened.
+const TCPPipelineDepth = 32
+
+// TCPClient is a DNSClient querying a server over TCP or DNS-over-TLS. It
+// keeps a pool of connections, and pipelines the queries on each of them
+// (RFC 7766 Section 6.2.1.1): responses are matched to the queries by
+// message ID, in whatever order they arrive.
+type TCPClient struct {
+	tlsCfg      *tls.Config
+	proxy       *ProxyDialer
+	serverAddr  string
+	minConns    int
+	maxConns    int
+	idleTimeout time.Duration
+	conns       []*pipelinedConn
+	maintaining bool
+	closed      bool
+	done        chan struct{}
+	dialMu      sync.Mutex
+	sync.Mutex
+}
+
+// pipelinedConn is a connection of TCPClient, and the queries waiting for a
+// response on it.
+type pipelinedConn struct {
+	conn     *dns.Conn
+	pending  map[uint16]*pendingQuery
+	lastUsed time.Time
+	// the idle timeout of the server (RFC 7828), or negative if unknown
+	keepalive time.Duration
+	err       error
+	writeMu   sync.Mutex
+	sync.Mutex
+}
+
+type pendingQuery struct {
+	question dns.Question
+	respC    chan *dns.Msg
+}
+
+func NewTCPClient(server *ServerConfig, useTLS bool) DNSClient {
+	var tlsCfg *tls.Config
+	if useTLS {
+		tlsCfg = server.UpstreamTLSConfig()
+	}
+	tc := &TCPClient{
+		tlsCfg:      tlsCfg,
+		proxy:       server.proxyDialer,
+		serverAddr:  server.String(),
+		minConns:    server.MinConns,
+		maxConns:    server.MaxConns,
+		idleTimeout: time.Duration(server.IdleTimeout) * time.Second,
+		done:        make(chan struct{}),
+	}
+	if tc.maxConns <= 0 {
+		tc.maxConns = DefaultMaxConns
+	}
+	if tc.idleTimeout <= 0 {
+		tc.idleTimeout = DefaultConnIdleTimeout * time.Second
+	}
+	if tc.minConns > 0 {
+		tc.maintaining = true
+		go tc.maintainConns()
+	}
+	return tc
+}
+
+func (tc *TCPClient) ExchangeContext(ctx context.Context,
+	req *dns.Msg) (*dns.Msg, error) {
+	if tc == nil {
+		return nil, fmt.Errorf(
+			"attempted to use uninitialized DNS client")
+	}
+	req = req.Copy()
+	AddTCPKeepalive(req)
+	if tc.tlsCfg != nil {
+		PadMsg(req, QueryPaddingBlock)
+	}
+	var err error
+	for i := 0; i <= TCPMaxRetry; i++ {
+		var pc *pipelinedConn
+		pc, err = tc.pickConn(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var resp *dns.Msg
+		resp, err = pc.exchange(ctx, req)
+		if err == nil {
+			StripPadding(resp)
+			return resp, nil
+		}
+		// retry on another connection only if this one was closed
+		if pc.Err() == nil || ctx.Err() != nil {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// pickConn returns the connection with the fewest outstanding queries. A
+// new connection is dialed if there is none, or if every connection has
+// TCPPipelineDepth outstanding queries and the pool is not full.
+func (tc *TCPClient) pickConn(ctx context.Context) (*pipelinedConn,
+	error) {
+	best, ok, err := tc.leastLoadedConn()
+	if ok || err != nil {
+		return best, err
+	}
+	tc.dialMu.Lock()
+	defer tc.dialMu.Unlock()
+	// another query may have dialed a connection in the meantime
+	best, ok, err = tc.leastLoadedConn()
+	if ok || err != nil {
+		return best, err
+	}
+	pc, err := tc.addConn(ctx)
+	if err != nil {
+		if best != nil {
+			return best, nil
+		}
+		return nil, err
+	}
+	return pc, nil
+}
+
+// leastLoadedConn returns the connection with the fewest outstanding
+// queries, and whether it should be used rather than dialing a new one.
+func (tc *TCPClient) leastLoadedConn() (*pipelinedConn, bool, error) {
+	tc.Lock()
+	defer tc.Unlock()
+	if tc.closed {
+		return nil, false, net.ErrClosed
+	}
+	var best *pipelinedConn
+	bestLoad, numUsable := 0, 0
+	for _, pc := range tc.conns {
+		// the server may close the connection before the query arrives
+		if pc.Expiring() {
+			continue
+		}
+		numUsable++
+		if load := pc.Load(); best == nil || load < bestLoad {
+			best, bestLoad = pc, load
+		}
+	}
+	if best == nil {
+		return nil, false, nil
+	}
+	return best, bestLoad < TCPPipelineDepth || numUsable >= tc.maxConns,
+		nil
+}
+
+// addConn dials a new connection and adds it to the pool.
+func (tc *TCPClient) addConn(ctx context.Context) (*pipelinedConn, error) {
+	conn, err := tc.CreateConn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%w %s: %w", ConnectionError, tc.serverAddr,
+			err)
+	}
+	pc := &pipelinedConn{
+		conn:      conn,
+		pending:   make(map[uint16]*pendingQuery),
+		lastUsed:  time.Now(),
+		keepalive: -1,
+	}
+	tc.Lock()
+	if tc.closed {
+		tc.Unlock()
+		_ = conn.Close()
+		return nil, net.ErrClosed
+	}
+	tc.conns = append(tc.conns, pc)
+	if !tc.maintaining {
+		tc.maintaining = true
+		go tc.maintainConns()
+	}
+	tc.Unlock()
+	go func() {
+		pc.readResponses()
+		tc.removeConn(pc)
+	}()
+	return pc, nil
+}
+
+func (tc *TCPClient) CreateConn(ctx context.Context) (*dns.Conn, error) {
+	if tc.proxy != nil {
+		return tc.createProxiedConn(ctx)
+	}
+	client := &dns.Client{
+		Net:         TCPProto,
+		DialTimeout: TCPDialTimeoutMillis * time.Millisecond,
+	}
+	if tc.tlsCfg != nil {
+		client.Net = TLSProto
+		client.TLSConfig = tc.tlsCfg
+	}
+	return client.DialContext(ctx, tc.serverAddr)
+}
+
+// createProxiedConn connects to the server through the proxy, and does the
+// TLS handshake over the tunnel.
+func (tc *TCPClient) createProxiedConn(ctx context.Context) (*dns.Conn,
+	error) {
+	ctx, cancel := context.WithTimeout(ctx,
+		TCPDialTimeoutMillis*time.Millisecond)
+	defer cancel()
+	conn, err := tc.proxy.DialContext(ctx, TCPProto, tc.serverAddr)
+	if err != nil {
+		return nil, err
+	}
+	if tc.tlsCfg == nil {
+		return &dns.Conn{Conn: conn}, nil
+	}
+	tlsConn := tls.Client(conn, tc.tlsCfg)
+	if err = tlsConn.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return &dns.Conn{Conn: tlsConn}, nil
+}
+
+func (tc *TCPClient) removeConn(pc *pipelinedConn) {
+	tc.Lock()
+	defer tc.Unlock()
+	for i, x := range tc.conns {
+		if x == pc {
+			tc.conns = append(tc.conns[:i], tc.conns[i+1:]...)
+			return
+		}
+	}
+}
+
+// maintainConns periodically closes the connections idle for longer than
+// the idle timeout or the one of the server, and dials new ones to keep the
+// minimum number open. It stops once no connection is left to maintain.
+func (tc *TCPClient) maintainConns() {
+	tc.fillConns()
+	reapT := time.NewTicker(tc.idleTimeout / 2)
+	defer reapT.Stop()
+	for {
+		select {
+		case <-tc.done:
+			return
+		case <-reapT.C:
+			tc.reapIdleConns()
+			tc.fillConns()
+			tc.Lock()
+			if len(tc.conns) == 0 && tc.minConns == 0 {
+				tc.maintaining = false
+				tc.Unlock()
+				return
+			}
+			tc.Unlock()
+		}
+	}
+}
+
+func (tc *TCPClient) reapIdleConns() {
+	tc.Lock()
+	defer tc.Unlock()
+	kept := make([]*pipelinedConn, 0, len(tc.conns))
+	for i, pc := range tc.conns {
+		remaining := len(kept) + len(tc.conns) - i - 1
+		// a connection the server is about to close is replaced, even if
+		// it is one of the minimum
+		expired := pc.Expiring() && pc.Load() == 0
+		if expired ||
+			(remaining >= tc.minConns && pc.IdleFor() > tc.idleTimeout) {
+			pc.Close(net.ErrClosed)
+			continue
+		}
+		kept = append(kept, pc)
+	}
+	tc.conns = kept
+}
+
+func (tc *TCPClient) fillConns() {
+	tc.dialMu.Lock()
+	defer tc.dialMu.Unlock()
+	for {
+		tc.Lock()
+		numConns := len(tc.conns)
+		tc.Unlock()
+		if numConns >= tc.minConns {
+			return
+		}
+		if _, err := tc.addConn(context.Background()); err != nil {
+			return
+		}
+	}
+}
+
+// Close closes every connection, and stops the maintenance of the pool.
+func (tc *TCPClient) Close() error {
+	tc.Lock()
+	defer tc.Unlock()
+	if tc.closed {
+		return nil
+	}
+	tc.closed = true
+	close(tc.done)
+	for _, pc := range tc.conns {
+		pc.Close(net.ErrClosed)
+	}
+	tc.conns = nil
+	return nil
+}
+
+// exchange sends the query under a message ID unique on the connection, and
+// waits for the response with the same ID.
+func (pc *pipelinedConn) exchange(ctx context.Context, req *dns.Msg) (
+	*dns.Msg, error) {
+	if len(req.Question) != 1 {
+		return nil, fmt.Errorf("%w: %d", InvalidQuestionError,
+			len(req.Question))
+	}
+	pq := &pendingQuery{
+		question: req.Question[0],
+		respC:    make(chan *dns.Msg, 1),
+	}
+	connReq := req.Copy()
+	pc.Lock()
+	if pc.err != nil {
+		pc.Unlock()
+		return nil, pc.err
+	}
+	connReq.Id = dns.Id()
+	for pc.pending[connReq.Id] != nil {
+		connReq.Id = dns.Id()
+	}
+	pc.pending[connReq.Id] = pq
+	pc.lastUsed = time.Now()
+	pc.Unlock()
+	defer pc.release(connReq.Id, pq)
+
+	pc.writeMu.Lock()
+	deadline, _ := ctx.Deadline()
+	_ = pc.conn.SetWriteDeadline(deadline)
+	err := pc.conn.WriteMsg(connReq)
+	pc.writeMu.Unlock()
+	if err != nil {
+		// a partial write leaves the stream unusable
+		pc.Close(err)
+		return nil, err
+	}
+	select {
+	case resp, ok := <-pq.respC:
+		if !ok {
+			return nil, pc.Err()
+		}
+		resp.Id = req.Id
+		return resp, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("gave up waiting for response to %s: %w",
+			pq.question.String(), ctx.Err())
+	}
+}
+
+// readResponses delivers the responses to the waiting queries until the
+// connection fails.
+func (pc *pipelinedConn) readResponses() {
+	for {
+		resp, err := pc.conn.ReadMsg()
+		if err != nil {
+			pc.Close(err)
+			return
+		}
+		pc.Lock()
+		pq := pc.pending[resp.Id]
+		// a late response to a query that timed out is dropped, even if its
+		// ID was taken by another query since
+		if pq != nil && len(resp.Question) == 1 &&
+			isSameQuestion(pq.question, resp.Question[0]) {
+			if timeout, ok := TCPKeepaliveTimeout(resp); ok {
+				pc.keepalive = timeout
+			}
+			RemoveEDNSOption(resp, dns.EDNS0TCPKEEPALIVE)
+			delete(pc.pending, resp.Id)
+			pq.respC <- resp
+		}
+		pc.Unlock()
+	}
+}
+
+func (pc *pipelinedConn) release(id uint16, pq *pendingQuery) {
+	pc.Lock()
+	defer pc.Unlock()
+	if pc.pending[id] == pq {
+		delete(pc.pending, id)
+	}
+	pc.lastUsed = time.Now()
+}
+
+// Close closes the connection, and fails the queries waiting on it.
+func (pc *pipelinedConn) Close(reason error) {
+	pc.Lock()
+	defer pc.Unlock()
+	if pc.err != nil {
+		return
+	}
+	pc.err = reason
+	if pc.err == nil {
+		pc.err = errors.New("connection closed")
+	}
+	_ = pc.conn.Close()
+	for id, pq := range pc.pending {
+		close(pq.respC)
+		delete(pc.pending, id)
+	}
+}
+
+// Err returns the reason the connection was closed, or nil if it is open.
+func (pc *pipelinedConn) Err() error {
+	pc.Lock()
+	defer pc.Unlock()
+	return pc.err
+}
+
+// Load returns the number of outstanding queries on the connection.
+func (pc *pipelinedConn) Load() int {
+	pc.Lock()
+	defer pc.Unlock()
+	return len(pc.pending)
+}
+
+// IdleFor returns how long the connection has had no outstanding query.
+func (pc *pipelinedConn) IdleFor() time.Duration {
+	pc.Lock()
+	defer pc.Unlock()
+	if len(pc.pending) > 0 {
+		return 0
+	}
+	return time.Since(pc.lastUsed)
+}
+
+// Expiring checks if the server may close the connection soon, by the idle
+// timeout it sent. A quarter of the timeout is left as a margin for the
+// query to reach the server. A zero timeout asks for no more queries on
+// the connection (RFC 7828 Section 3.3.2).
+func (pc *pipelinedConn) Expiring() bool {
+	pc.Lock()
+	defer pc.Unlock()
+	switch {
+	case pc.keepalive < 0:
+		return false
+	case pc.keepalive == 0:
+		return true
+	case len(pc.pending) > 0:
+		return false
+	}
+	return time.Since(pc.lastUsed) > pc.keepalive*3/4
+}
+
+func isSameQuestion(q1, q2 dns.Question) bool {
+	return q1.Qtype == q2.Qtype && q1.Qclass == q2.Qclass &&
+		strings.EqualFold(q1.Name, q2.Name)
+}
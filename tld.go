@@ -13,7 +13,7 @@ func LatestTLDs(resolvers []*ServerConfig) (map[string]struct{}, error) {
 	tlds := make(map[string]struct{})
 	for _, r := range resolvers {
 		log.Printf("Creating HTTPS client from resolver %v", r.String())
-		c := NewHTTPSClient(r.String())
+		c := NewHTTPSClient(r)
 		resp, err = c.Get(TLDListURL)
 		c.CloseIdleConnections()
 		if err != nil {
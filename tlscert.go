@@ -0,0 +1,214 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const CertCheckInterval = 30
+const SelfSignedCertValidDays = 825
+const SelfSignedCertName = "litedns"
+
+// CertReloader holds a certificate/key pair loaded from disk, and reloads it
+// whenever either of the files is modified.
+type CertReloader struct {
+	certFile    string
+	keyFile     string
+	cert        *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+	sync.RWMutex
+}
+
+// NewCertReloader loads the certificate/key pair and starts watching the
+// files for changes. If generate is true and neither file exists, a
+// self-signed pair is created first.
+func NewCertReloader(certFile, keyFile string, generate bool,
+	hosts []string) (*CertReloader, error) {
+	if generate {
+		if err := EnsureSelfSignedCert(certFile, keyFile, hosts); err != nil {
+			return nil, err
+		}
+	}
+	cr := &CertReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := cr.Reload(); err != nil {
+		return nil, err
+	}
+	go func() {
+		checkInterval := CertCheckInterval * time.Second
+		checkT := time.NewTicker(checkInterval)
+		for {
+			<-checkT.C
+			if !cr.IsModified() {
+				continue
+			}
+			if err := cr.Reload(); err != nil {
+				log.Printf("Unable to reload TLS certificate %s: %s",
+					cr.certFile, err.Error())
+			} else {
+				log.Printf("Reloaded TLS certificate %s", cr.certFile)
+			}
+		}
+	}()
+	return cr, nil
+}
+
+// Reload reads the certificate/key pair from disk and replaces the current
+// one. The current pair is kept if the new one cannot be loaded.
+func (cr *CertReloader) Reload() error {
+	certStat, err := os.Stat(cr.certFile)
+	if err != nil {
+		return err
+	}
+	keyStat, err := os.Stat(cr.keyFile)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+	cr.Lock()
+	defer cr.Unlock()
+	cr.cert = &cert
+	cr.certModTime = certStat.ModTime()
+	cr.keyModTime = keyStat.ModTime()
+	return nil
+}
+
+// IsModified checks if either of the files has changed since the last load.
+func (cr *CertReloader) IsModified() bool {
+	certStat, err := os.Stat(cr.certFile)
+	if err != nil {
+		return false
+	}
+	keyStat, err := os.Stat(cr.keyFile)
+	if err != nil {
+		return false
+	}
+	cr.RLock()
+	defer cr.RUnlock()
+	return !certStat.ModTime().Equal(cr.certModTime) ||
+		!keyStat.ModTime().Equal(cr.keyModTime)
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (cr *CertReloader) GetCertificate(
+	*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.RLock()
+	defer cr.RUnlock()
+	return cr.cert, nil
+}
+
+// TLSConfig creates a server-side TLS config backed by the reloader.
+func (cr *CertReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: cr.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+}
+
+// EnsureSelfSignedCert generates a self-signed certificate/key pair for the
+// given hosts, unless both files already exist.
+func EnsureSelfSignedCert(certFile, keyFile string, hosts []string) error {
+	certExists, err := fileExists(certFile)
+	if err != nil {
+		return err
+	}
+	keyExists, err := fileExists(keyFile)
+	if err != nil {
+		return err
+	}
+	if certExists && keyExists {
+		return nil
+	}
+	if certExists != keyExists {
+		return fmt.Errorf(
+			"only one of the certificate/key pair exists: %s, %s",
+			certFile, keyFile)
+	}
+	certPEM, keyPEM, err := GenerateSelfSignedCert(hosts)
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		return err
+	}
+	if err = os.WriteFile(certFile, certPEM, 0644); err != nil {
+		return err
+	}
+	log.Printf("Generated self-signed TLS certificate %s", certFile)
+	return nil
+}
+
+// GenerateSelfSignedCert creates a PEM-encoded self-signed ECDSA
+// certificate and key, valid for the given host names and IP addresses.
+func GenerateSelfSignedCert(hosts []string) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serialLimit := new(big.Int).Lsh(big.NewInt(1), 128)
+	serial, err := rand.Int(rand.Reader, serialLimit)
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: SelfSignedCertName},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.AddDate(0, 0, SelfSignedCertValidDays),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{SelfSignedCertName},
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if h != "" {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template,
+		&key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY",
+		Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+func fileExists(filename string) (bool, error) {
+	_, err := os.Stat(filename)
+	if err == nil {
+		return true, nil
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return false, err
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RFC 5011 Section 2.4.1: a new key is trusted once it was seen for 30 days
+const TrustAnchorHoldDownDays = 30
+
+// DefaultRootTrustAnchors are the DS records of the root key signing keys,
+// as published by IANA.
+var DefaultRootTrustAnchors = []string{
+	". IN DS 20326 8 2 " +
+		"E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". IN DS 38696 8 2 " +
+		"683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+// RFC 5011 Section 4: states of the keys tracked for the rollover
+const (
+	// seen in the root DNSKEY set, but not trusted before the hold-down
+	AnchorAddPend = "addpend"
+	AnchorValid   = "valid"
+	// revoked by a self-signed DNSKEY with the REVOKE bit
+	AnchorRevoked = "revoked"
+)
+
+// anchorKey is a key signing key of the root zone tracked for the rollover.
+type anchorKey struct {
+	State     string    `json:"state"`
+	FirstSeen time.Time `json:"firstSeen"`
+	// the DNSKEY record in the zone file format
+	Key    string `json:"key"`
+	dnskey *dns.DNSKEY
+}
+
+// TrustAnchors are the keys trusted to sign the DNSKEY set of the root zone:
+// the configured anchors, and the keys they introduced through the RFC 5011
+// rollover. The tracked keys are kept in the trust anchor file, if any.
+type TrustAnchors struct {
+	ds      []*dns.DS
+	keys    []*dns.DNSKEY
+	tracked map[string]*anchorKey
+	file    string
+	sync.Mutex
+}
+
+func NewTrustAnchors(cfg *DNSSECConfig) (*TrustAnchors, error) {
+	ta := &TrustAnchors{
+		tracked: make(map[string]*anchorKey),
+		file:    cfg.TrustAnchorFile,
+	}
+	for _, rr := range cfg.anchors {
+		switch anchor := rr.(type) {
+		case *dns.DS:
+			ta.ds = append(ta.ds, anchor)
+		case *dns.DNSKEY:
+			ta.keys = append(ta.keys, anchor)
+		}
+	}
+	if ta.file == "" {
+		return ta, nil
+	}
+	saved, err := os.ReadFile(ta.file)
+	if errors.Is(err, os.ErrNotExist) {
+		return ta, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var tracked []*anchorKey
+	if err = json.Unmarshal(saved, &tracked); err != nil {
+		return nil, fmt.Errorf("invalid trust anchor file %s: %w", ta.file,
+			err)
+	}
+	for _, ak := range tracked {
+		rr, err := dns.NewRR(ak.Key)
+		key, ok := rr.(*dns.DNSKEY)
+		if err != nil || !ok {
+			return nil, fmt.Errorf("invalid key %q in the trust anchor file %s",
+				ak.Key, ta.file)
+		}
+		ak.dnskey = key
+		ta.tracked[anchorKeyID(key)] = ak
+	}
+	return ta, nil
+}
+
+// anchorKeyID identifies a key regardless of its flags, which change when
+// the key is revoked.
+func anchorKeyID(key *dns.DNSKEY) string {
+	return fmt.Sprintf("%d %s", key.Algorithm, key.PublicKey)
+}
+
+// TrustedKeys returns the keys of the root DNSKEY set that are trusted to
+// sign it.
+func (ta *TrustAnchors) TrustedKeys(keys []*dns.DNSKEY) []*dns.DNSKEY {
+	ta.Lock()
+	defer ta.Unlock()
+	trusted := make([]*dns.DNSKEY, 0, len(keys))
+	for _, key := range keys {
+		if key.Flags&dns.REVOKE != 0 {
+			continue
+		}
+		if ak, ok := ta.tracked[anchorKeyID(key)]; ok {
+			if ak.State == AnchorValid {
+				trusted = append(trusted, key)
+			}
+			continue
+		}
+		if ta.isConfigured(key) {
+			trusted = append(trusted, key)
+		}
+	}
+	return trusted
+}
+
+// isConfigured checks if the key is one of the configured anchors, or
+// matches one of their DS records.
+func (ta *TrustAnchors) isConfigured(key *dns.DNSKEY) bool {
+	for _, anchor := range ta.keys {
+		if anchorKeyID(anchor) == anchorKeyID(key) {
+			return true
+		}
+	}
+	for _, ds := range ta.ds {
+		if matchesDS(key, ds) {
+			return true
+		}
+	}
+	return false
+}
+
+// Update tracks the key signing keys of a root DNSKEY set that was verified
+// with the trusted keys (RFC 5011 Section 4). New keys are trusted after
+// the hold-down time, and revoked keys are never trusted again.
+func (ta *TrustAnchors) Update(keys []*dns.DNSKEY, sigs []*dns.RRSIG) {
+	rrset := make([]dns.RR, len(keys))
+	for i, key := range keys {
+		rrset[i] = key
+	}
+	now := time.Now()
+	holdDown := TrustAnchorHoldDownDays * 24 * time.Hour
+	ta.Lock()
+	defer ta.Unlock()
+	changed := false
+	seen := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		if key.Flags&dns.SEP == 0 {
+			continue
+		}
+		id := anchorKeyID(key)
+		seen[id] = struct{}{}
+		ak, tracked := ta.tracked[id]
+		if key.Flags&dns.REVOKE != 0 {
+			// RFC 5011 Section 2.1: the revocation has to be self-signed
+			if (tracked && ak.State == AnchorRevoked) ||
+				!isSignedBy(rrset, sigs, key) {
+				continue
+			}
+			log.Printf("Revoked the trust anchor %d", key.KeyTag())
+			ta.tracked[id] = &anchorKey{State: AnchorRevoked,
+				FirstSeen: now, Key: key.String(), dnskey: key}
+			changed = true
+			continue
+		}
+		switch {
+		case !tracked && ta.isConfigured(key):
+			ta.tracked[id] = &anchorKey{State: AnchorValid, FirstSeen: now,
+				Key: key.String(), dnskey: key}
+			changed = true
+		case !tracked:
+			log.Printf("Added the trust anchor %d pending its hold-down",
+				key.KeyTag())
+			ta.tracked[id] = &anchorKey{State: AnchorAddPend, FirstSeen: now,
+				Key: key.String(), dnskey: key}
+			changed = true
+		case ak.State == AnchorAddPend && now.Sub(ak.FirstSeen) >= holdDown:
+			log.Printf("Trusted the trust anchor %d", key.KeyTag())
+			ak.State = AnchorValid
+			changed = true
+		}
+	}
+	// RFC 5011 Section 4: a pending key that disappears is forgotten
+	for id, ak := range ta.tracked {
+		if _, ok := seen[id]; !ok && ak.State == AnchorAddPend {
+			delete(ta.tracked, id)
+			changed = true
+		}
+	}
+	if changed && ta.file != "" {
+		if err := ta.save(); err != nil {
+			log.Printf("Unable to save the trust anchors to %s: %s",
+				ta.file, err.Error())
+		}
+	}
+}
+
+// save writes the tracked keys to the trust anchor file, replacing it as a
+// whole so that an interrupted write leaves the old file.
+func (ta *TrustAnchors) save() error {
+	tracked := make([]*anchorKey, 0, len(ta.tracked))
+	for _, ak := range ta.tracked {
+		tracked = append(tracked, ak)
+	}
+	b, err := json.MarshalIndent(tracked, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := ta.file + ".tmp"
+	if err = os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, ta.file)
+}
+
+// matchesDS checks if the DS record is the digest of the key.
+func matchesDS(key *dns.DNSKEY, ds *dns.DS) bool {
+	if key.KeyTag() != ds.KeyTag || key.Algorithm != ds.Algorithm {
+		return false
+	}
+	digest := key.ToDS(ds.DigestType)
+	return digest != nil && strings.EqualFold(digest.Digest, ds.Digest)
+}
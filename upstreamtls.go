@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+)
+
+// RFC 8310 Section 5: usage profiles of the encrypted upstreams
+const (
+	// the server must be authenticated, or no query is sent to it
+	StrictPrivacy = "strict"
+	// the server is used unauthenticated, or over cleartext DNS if no
+	// encrypted connection can be made to it
+	OpportunisticPrivacy = "opportunistic"
+)
+
+// upstreamVerifier authenticates the certificate chain presented by an
+// upstream server.
+type upstreamVerifier struct {
+	name       string
+	serverName string
+	roots      *x509.CertPool
+	skipVerify bool
+	pins       [][]byte
+	profile    string
+}
+
+// VerifyUpstreamTLS checks the TLS settings of an encrypted upstream, and
+// builds its TLS configuration.
+func VerifyUpstreamTLS(s *ServerConfig, kind string) error {
+	switch s.Proto {
+	case TLSProto, HTTPSProto, QUICProto:
+	default:
+		if s.TLSServerName != "" || s.CAFile != "" || len(s.SPKIPins) > 0 ||
+			s.InsecureSkipVerify || s.PrivacyProfile != "" {
+			return fmt.Errorf("TLS settings for the cleartext %s %s",
+				kind, s.String())
+		}
+		return nil
+	}
+	v := &upstreamVerifier{
+		name:       s.String(),
+		serverName: s.TLSName(),
+		skipVerify: s.InsecureSkipVerify,
+		profile:    s.PrivacyProfile,
+	}
+	switch v.profile {
+	case "":
+		v.profile = StrictPrivacy
+		s.PrivacyProfile = StrictPrivacy
+	case StrictPrivacy, OpportunisticPrivacy:
+	default:
+		return fmt.Errorf("invalid privacy profile %s for the %s %s",
+			s.PrivacyProfile, kind, s.String())
+	}
+	if v.serverName == "" && !v.skipVerify {
+		return fmt.Errorf("no TLS server name to verify for the %s %s",
+			kind, s.String())
+	}
+	if s.CAFile != "" {
+		pemCerts, err := os.ReadFile(s.CAFile)
+		if err != nil {
+			return err
+		}
+		v.roots = x509.NewCertPool()
+		if !v.roots.AppendCertsFromPEM(pemCerts) {
+			return fmt.Errorf("no certificate in %s for the %s %s",
+				s.CAFile, kind, s.String())
+		}
+	}
+	for _, pin := range s.SPKIPins {
+		digest, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(digest) != sha256.Size {
+			return fmt.Errorf("invalid SPKI pin %q for the %s %s",
+				pin, kind, s.String())
+		}
+		v.pins = append(v.pins, digest)
+	}
+	if v.profile == StrictPrivacy && v.skipVerify && len(v.pins) == 0 {
+		return fmt.Errorf(
+			"no way to authenticate the %s %s in the strict privacy profile",
+			kind, s.String())
+	}
+	s.tlsCfg = &tls.Config{
+		ServerName: v.serverName,
+		// the chain is verified by VerifyConnection instead, so that pins,
+		// custom roots and the opportunistic profile are handled alike
+		InsecureSkipVerify: true,
+		VerifyConnection:   v.VerifyConnection,
+	}
+	return nil
+}
+
+// TLSName returns the name to verify in the certificate of the server: the
+// configured TLS server name, or else the host name, the host in the DoH
+// URL, or the IP address.
+func (sc *ServerConfig) TLSName() string {
+	if sc.TLSServerName != "" {
+		return sc.TLSServerName
+	}
+	if sc.Host != "" {
+		return sc.Host
+	}
+	if sc.Proto == HTTPSProto {
+		if u, err := url.Parse(DoHURLFromTemplate(sc.URL)); err == nil &&
+			u.Hostname() != "" {
+			return u.Hostname()
+		}
+	}
+	if sc.IP != nil {
+		return sc.IP.String()
+	}
+	return ""
+}
+
+// UpstreamTLSConfig returns a TLS configuration for connecting to the
+// server. A server that was not verified gets the standard verification of
+// its name.
+func (sc *ServerConfig) UpstreamTLSConfig() *tls.Config {
+	if sc.tlsCfg == nil {
+		return &tls.Config{ServerName: sc.TLSName()}
+	}
+	return sc.tlsCfg.Clone()
+}
+
+// VerifyConnection authenticates the server after the handshake. In the
+// opportunistic profile, a server failing authentication is still used.
+func (v *upstreamVerifier) VerifyConnection(cs tls.ConnectionState) error {
+	err := v.authenticate(cs)
+	if err != nil && v.profile == OpportunisticPrivacy {
+		log.Printf("Unable to authenticate the upstream %s, using it "+
+			"unauthenticated: %s", v.name, err.Error())
+		return nil
+	}
+	return err
+}
+
+func (v *upstreamVerifier) authenticate(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("no certificate presented by the server")
+	}
+	if !v.skipVerify {
+		intermediates := x509.NewCertPool()
+		for _, cert := range cs.PeerCertificates[1:] {
+			intermediates.AddCert(cert)
+		}
+		_, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+			DNSName:       v.serverName,
+			Roots:         v.roots,
+			Intermediates: intermediates,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if len(v.pins) == 0 {
+		return nil
+	}
+	// RFC 7858 Section 4.2: any certificate of the chain may be pinned
+	for _, cert := range cs.PeerCertificates {
+		digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		for _, pin := range v.pins {
+			if bytes.Equal(digest[:], pin) {
+				return nil
+			}
+		}
+	}
+	return errors.New("no certificate matches the SPKI pins")
+}
@@ -11,6 +11,7 @@ const (
 	LabelUnknown       = "??????"
 	LabelLocalQuery    = "L"
 	LabelUpstreamQuery = "U"
+	LabelForwardQuery  = "F"
 	LabelCacheHit      = "CACHED"
 	LabelCacheMiss     = "MISSED"
 	LabelNoCaching     = "BYPASS"
@@ -33,6 +34,19 @@ func Unique[T any, K comparable](s []T, asKey func(T) K) []T {
 	return acc
 }
 
+// LongestSuffixMatch returns the value for the longest suffix of the name
+// found in the map, whose keys are canonical domain names.
+func LongestSuffixMatch[V any](m map[string]V, name string) (V, bool) {
+	cname := dns.CanonicalName(name)
+	for off, end := 0, false; !end; off, end = dns.NextLabel(cname, off) {
+		if v, ok := m[cname[off:]]; ok {
+			return v, true
+		}
+	}
+	var zero V
+	return zero, false
+}
+
 // CloneSlice works similarly to slices.Clone(), but the size is explicitly
 // allocated exactly the same as the original slice length.
 func CloneSlice[S ~[]E, E any](s S) S {